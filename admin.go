@@ -0,0 +1,312 @@
+package warlock
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gernest/render"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// admin serves the user management dashboard
+type admin struct {
+	h      *Handlers
+	prefix string
+}
+
+// Admin returns the user management dashboard mounted at prefix, like /admin/users. Only
+// users with RoleAdmin get through, the others see the forbidden page. The list and detail
+// pages are rendered with Config.AdminUsersTmpl and Config.AdminUserTmpl so apps can
+// restyle them, the actions are form posts to
+//
+//	<prefix>/user/disable
+//	<prefix>/user/enable
+//	<prefix>/user/reset
+//	<prefix>/user/delete
+//	<prefix>/user/impersonate
+//
+// carrying the email of the user. Posting to <prefix>/backup downloads a snapshot of the
+// bolt database. <prefix>/webhooks lists the pending and dead webhook deliveries with
+// Config.AdminWebhooksTmpl, dead ones are put back in the queue by posting their id to
+// <prefix>/webhooks/retry.
+//
+// Every post must carry the csrf_token value which the templates get along with the
+// rest of their data, posts without it are forbidden.
+func (h *Handlers) Admin(prefix string) http.Handler {
+	a := &admin{h: h, prefix: strings.TrimRight(prefix, "/")}
+	return h.SessionMiddleware(h.RequireRole(RoleAdmin)(a))
+}
+
+func (a *admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimPrefix(r.URL.Path, a.prefix)
+	switch p {
+	case "/backup", "/webhooks/retry", "/user/disable", "/user/enable", "/user/reset", "/user/delete", "/user/impersonate":
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		if !validCSRF(r) {
+			a.h.forbidden(w)
+			return
+		}
+	}
+	switch p {
+	case "", "/":
+		a.users(w, r)
+	case "/user":
+		a.user(w, r)
+	case "/backup":
+		a.backup(w, r)
+	case "/webhooks":
+		a.webhooks(w, r)
+	case "/webhooks/retry":
+		a.retryWebhook(w, r)
+	case "/user/impersonate":
+		a.impersonate(w, r)
+	case "/user/disable", "/user/enable", "/user/reset", "/user/delete":
+		a.action(w, r, strings.TrimPrefix(p, "/user/"))
+	default:
+		a.h.rendr.HTML(w, http.StatusNotFound, a.h.cfg.NotFoundTmpl, nil)
+	}
+}
+
+// users lists the users matching the q parameter, page by page. Pages are read from the
+// store with a cursor, the after parameter, so only one page is loaded at a time.
+func (a *admin) users(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	after := r.URL.Query().Get("after")
+	page, err := a.h.ustore.List(ListOptions{Search: q, Cursor: after, Limit: a.h.cfg.AdminPageSize})
+	if err != nil {
+		log.Println(err)
+		a.h.rendr.HTML(w, http.StatusInternalServerError, a.h.cfg.ServerErrTmpl, nil)
+		return
+	}
+	found := make([]*PublicUser, len(page.Users))
+	for i, usr := range page.Users {
+		found[i] = usr.Public()
+	}
+	data := a.data(w, r)
+	data.Add("users", found)
+	data.Add("q", q)
+	data.Add("after", after)
+	if page.Next != "" {
+		data.Add("next", page.Next)
+	}
+	a.h.rendr.HTML(w, http.StatusOK, a.h.cfg.AdminUsersTmpl, data)
+}
+
+// user shows the account, sessions and audit events of the user given by the email
+// parameter
+func (a *admin) user(w http.ResponseWriter, r *http.Request) {
+	usr, err := a.h.ustore.GetUser(r.URL.Query().Get("email"))
+	if err != nil {
+		a.h.rendr.HTML(w, http.StatusNotFound, a.h.cfg.NotFoundTmpl, nil)
+		return
+	}
+	me, _ := CurrentUser(r.Context())
+	data := a.data(w, r)
+	data.Add("user", usr.Public())
+	data.Add("can_impersonate", usr.Email != me.Email && !usr.HasRole(RoleAdmin))
+	if sl, ok := a.h.sess.(SessionLister); ok {
+		list, err := sl.UserSessions(usr.Email)
+		if err != nil {
+			log.Println(err)
+		}
+		data.Add("sessions", list)
+	}
+	if a.h.auditLog != nil {
+		events, err := a.h.auditLog.Events(usr.Email, 50)
+		if err != nil {
+			log.Println(err)
+		}
+		data.Add("events", events)
+	}
+	a.h.rendr.HTML(w, http.StatusOK, a.h.cfg.AdminUserTmpl, data)
+}
+
+// backup streams a snapshot of the bolt database as a download
+func (a *admin) backup(w http.ResponseWriter, r *http.Request) {
+	me, _ := CurrentUser(r.Context())
+	name := fmt.Sprintf("warlock-%s.db", time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	if _, err := Backup(a.h.cfg.DB, w); err != nil {
+		// the headers are gone already, all that is left is to cut the download short
+		log.Println(err)
+		return
+	}
+	a.h.audit(me.Email, me.Email, AuditBackup, name)
+}
+
+// webhooks lists the deliveries waiting in the webhook queue and the dead letters
+func (a *admin) webhooks(w http.ResponseWriter, r *http.Request) {
+	q := a.h.webhooks
+	if q == nil {
+		a.h.rendr.HTML(w, http.StatusNotFound, a.h.cfg.NotFoundTmpl, nil)
+		return
+	}
+	pending, err := q.Pending()
+	if err == nil {
+		var dead []*Delivery
+		if dead, err = q.DeadLetters(); err == nil {
+			data := a.data(w, r)
+			data.Add("pending", pending)
+			data.Add("dead", dead)
+			a.h.rendr.HTML(w, http.StatusOK, a.h.cfg.AdminWebhooksTmpl, data)
+			return
+		}
+	}
+	log.Println(err)
+	a.h.rendr.HTML(w, http.StatusInternalServerError, a.h.cfg.ServerErrTmpl, nil)
+}
+
+// retryWebhook puts the dead letter given by the id form value back into the queue
+func (a *admin) retryWebhook(w http.ResponseWriter, r *http.Request) {
+	if a.h.webhooks == nil {
+		a.h.rendr.HTML(w, http.StatusNotFound, a.h.cfg.NotFoundTmpl, nil)
+		return
+	}
+	flash := NewFlash()
+	if err := a.h.webhooks.Retry(r.FormValue("id")); err != nil {
+		flash.Error("the delivery is not a dead letter")
+	} else {
+		flash.Success("the delivery is queued again")
+	}
+	a.redirect(w, r, flash, a.prefix+"/webhooks")
+}
+
+// action applies one of the dashboard actions to the user given by the email form value
+// and sends the admin back with a flash message
+func (a *admin) action(w http.ResponseWriter, r *http.Request, name string) {
+	me, _ := CurrentUser(r.Context())
+	email := r.FormValue("email")
+	usr, err := a.h.ustore.GetUser(email)
+	if err != nil {
+		a.h.rendr.HTML(w, http.StatusNotFound, a.h.cfg.NotFoundTmpl, nil)
+		return
+	}
+	back := a.prefix + "/user?" + url.Values{"email": {usr.Email}}.Encode()
+	flash := NewFlash()
+	if usr.Email == me.Email && name != "enable" {
+		flash.Error("you can not " + name + " your own account")
+		a.redirect(w, r, flash, back)
+		return
+	}
+	var event string
+	switch name {
+	case "disable":
+		usr.Disabled = true
+		err = a.h.ustore.UpdateUser(usr)
+		event = AuditDisable
+		flash.Success("the account is locked")
+	case "enable":
+		usr.Disabled = false
+		err = a.h.ustore.UpdateUser(usr)
+		event = AuditEnable
+		flash.Success("the account is unlocked")
+	case "reset":
+		usr.ResetRequired = true
+		err = a.h.ustore.UpdateUser(usr)
+		event = AuditResetPassword
+		flash.Success("the user has to reset the password before logging in again")
+	case "delete":
+		if err = a.h.ustore.DeleteUser(usr.Email); err == nil {
+			err = a.h.orgs.RemoveUser(usr.Email)
+		}
+		event = AuditDelete
+		back = a.prefix + "/"
+		flash.Success("the account " + usr.Email + " is deleted")
+	}
+	if err != nil {
+		log.Println(err)
+		a.h.rendr.HTML(w, http.StatusInternalServerError, a.h.cfg.ServerErrTmpl, nil)
+		return
+	}
+	if name != "enable" {
+		// sessions of cookie based backends can not be ended, sessionUser ignores them instead
+		if sl, ok := a.h.sess.(SessionLister); ok {
+			if _, err = sl.DeleteUserSessions(usr.Email); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	a.h.audit(me.Email, usr.Email, event, "")
+	if name == "delete" {
+		a.h.emit(EventUserDeleted, usr)
+	}
+	a.redirect(w, r, flash, back)
+}
+
+func (a *admin) redirect(w http.ResponseWriter, r *http.Request, flash *Flash, to string) {
+	if ss, ok := CurrentSession(r.Context()); ok {
+		flash.Add(ss)
+		if err := ss.Save(r, w); err != nil {
+			log.Println(err)
+		}
+	}
+	http.Redirect(w, r, to, http.StatusFound)
+}
+
+// data holds what every dashboard page gets, the mount point, the csrf token forms post
+// back and the pending flash which is removed from the session once shown
+func (a *admin) data(w http.ResponseWriter, r *http.Request) render.TemplateData {
+	data := render.NewTemplateData()
+	data.Add("prefix", a.prefix)
+	if ss, ok := CurrentSession(r.Context()); ok {
+		_, hadToken := ss.Values[sessionCSRFKey].(string)
+		data.Add("csrf_token", csrfToken(ss))
+		f := NewFlash().Get(ss)
+		if f != nil {
+			data.Add("flash", f.Data)
+		}
+		if f != nil || !hadToken {
+			if err := ss.Save(r, w); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	return data
+}
+
+// csrfToken returns the csrf token of the session, it is created on first use and lives
+// as long as the session
+func csrfToken(ss *sessions.Session) string {
+	if tok, ok := ss.Values[sessionCSRFKey].(string); ok && tok != "" {
+		return tok
+	}
+	tok := base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+	ss.Values[sessionCSRFKey] = tok
+	return tok
+}
+
+// validCSRF reports whether the csrf_token form value matches the token of the session
+func validCSRF(r *http.Request) bool {
+	ss, ok := CurrentSession(r.Context())
+	if !ok {
+		return false
+	}
+	tok, _ := ss.Values[sessionCSRFKey].(string)
+	return tok != "" && subtle.ConstantTimeCompare([]byte(tok), []byte(r.PostFormValue("csrf_token"))) == 1
+}
+
+// matchUser reports whether q is found in the email or the names of the user, ignoring case
+func matchUser(usr *User, q string) bool {
+	if q == "" {
+		return true
+	}
+	q = strings.ToLower(q)
+	for _, v := range []string{usr.Email, usr.FirstName, usr.LastName} {
+		if strings.Contains(strings.ToLower(v), q) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,234 @@
+package warlock
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var csrfField = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// adminToken returns the csrf token the dashboard hands to the logged in admin
+func adminToken(t *testing.T, client *http.Client, base string) string {
+	res, err := client.Get(base + dPath + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	buf := new(bytes.Buffer)
+	io.Copy(buf, res.Body)
+	m := csrfField.FindStringSubmatch(buf.String())
+	if m == nil {
+		t.Fatalf("Expected a csrf token actual %s", buf)
+	}
+	return m[1]
+}
+
+func TestHandlers_Admin(t *testing.T) {
+	ts, client, y := testServerConfig(t, &Config{AdminPageSize: 2})
+	defer ts.Close()
+	defer cleanUp("warlock_test.db")
+
+	get := func(path string) (int, string) {
+		res, err := client.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		buf := new(bytes.Buffer)
+		io.Copy(buf, res.Body)
+		return res.StatusCode, buf.String()
+	}
+	token := ""
+	post := func(path, email string) string {
+		res, err := client.PostForm(ts.URL+path, url.Values{"email": {email}, "csrf_token": {token}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		buf := new(bytes.Buffer)
+		io.Copy(buf, res.Body)
+		return buf.String()
+	}
+
+	for _, e := range []string{"admin@me.com", "bob@me.com", "carol@me.com", "dave@me.com"} {
+		usr := &User{Email: e, FirstName: strings.Split(e, "@")[0], Password: "pass"}
+		if err := y.ustore.CreateUser(usr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Anonymous
+	if code, _ := get(dPath + "/"); code != http.StatusForbidden {
+		t.Errorf("Expected %d actual %d", http.StatusForbidden, code)
+	}
+
+	if err := GrantRole(y.ustore, "admin@me.com", RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	wl, err := client.PostForm(ts.URL+lPath, url.Values{"Email": {"admin@me.com"}, "Password": {"pass"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wl.Body.Close()
+
+	// Pagination
+	code, body := get(dPath + "/")
+	if code != http.StatusOK {
+		t.Errorf("Expected %d actual %d", http.StatusOK, code)
+	}
+	if !strings.Contains(body, "admin@me.com") || strings.Contains(body, "carol@me.com") {
+		t.Errorf("Expected the first page actual %s", body)
+	}
+	if !strings.Contains(body, "after=bob%40me.com") {
+		t.Errorf("Expected a link to the next page actual %s", body)
+	}
+	_, body = get(dPath + "/?after=bob@me.com")
+	if !strings.Contains(body, "carol@me.com") || strings.Contains(body, "bob@me.com") {
+		t.Errorf("Expected the second page actual %s", body)
+	}
+	if strings.Contains(body, "after=") {
+		t.Errorf("Expected the last page actual %s", body)
+	}
+
+	// Search
+	_, body = get(dPath + "/?q=CAROL")
+	if !strings.Contains(body, "carol@me.com") || strings.Contains(body, "dave@me.com") {
+		t.Errorf("Expected only carol actual %s", body)
+	}
+
+	// Detail
+	bob := url.Values{"email": {"bob@me.com"}}.Encode()
+	code, body = get(dPath + "/user?" + bob)
+	if code != http.StatusOK || !strings.Contains(body, "<h2>bob@me.com</h2>") {
+		t.Errorf("Expected bob's page actual %d %s", code, body)
+	}
+	_, body = get(dPath + "/user?email=admin@me.com")
+	if !strings.Contains(body, "login by admin@me.com") {
+		t.Errorf("Expected the login event actual %s", body)
+	}
+	if code, _ = get(dPath + "/user?email=nobody@me.com"); code != http.StatusNotFound {
+		t.Errorf("Expected %d actual %d", http.StatusNotFound, code)
+	}
+
+	// Actions need the csrf token of the session
+	post(dPath+"/user/disable", "bob@me.com")
+	if usr, _ := y.ustore.GetUser("bob@me.com"); usr.Disabled {
+		t.Error("Expected bob not to be locked without a csrf token")
+	}
+	token = "forged"
+	post(dPath+"/user/disable", "bob@me.com")
+	if usr, _ := y.ustore.GetUser("bob@me.com"); usr.Disabled {
+		t.Error("Expected bob not to be locked with a forged csrf token")
+	}
+	token = adminToken(t, client, ts.URL)
+	body = post(dPath+"/user/disable", "bob@me.com")
+	if !strings.Contains(body, "the account is locked") {
+		t.Errorf("Expected the flash message actual %s", body)
+	}
+	if usr, _ := y.ustore.GetUser("bob@me.com"); !usr.Disabled {
+		t.Error("Expected bob to be locked")
+	}
+	if !strings.Contains(body, "disable by admin@me.com") {
+		t.Errorf("Expected the audit event actual %s", body)
+	}
+	post(dPath+"/user/enable", "bob@me.com")
+	if usr, _ := y.ustore.GetUser("bob@me.com"); usr.Disabled {
+		t.Error("Expected bob to be unlocked")
+	}
+	post(dPath+"/user/reset", "bob@me.com")
+	if usr, _ := y.ustore.GetUser("bob@me.com"); !usr.ResetRequired {
+		t.Error("Expected bob to have to reset the password")
+	}
+	body = post(dPath+"/user/delete", "admin@me.com")
+	if !strings.Contains(body, "you can not delete your own account") {
+		t.Errorf("Expected a refusal actual %s", body)
+	}
+	post(dPath+"/user/delete", "dave@me.com")
+	if _, err = y.ustore.GetUser("dave@me.com"); err == nil {
+		t.Error("Expected dave to be deleted")
+	}
+
+	res, err := client.Get(fmt.Sprintf("%s%s/user/delete?email=bob@me.com", ts.URL, dPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected %d actual %d", http.StatusMethodNotAllowed, res.StatusCode)
+	}
+}
+
+func TestHandlers_LoginResetRequired(t *testing.T) {
+	ts, client, y := testServer(t)
+	defer ts.Close()
+	defer cleanUp("warlock_test.db")
+
+	usr := &User{Email: "me@me.com", Password: "pass", ResetRequired: true}
+	if err := y.ustore.CreateUser(usr); err != nil {
+		t.Fatal(err)
+	}
+	res, m, err := postJSON(client, ts.URL+lPath, `{"Email":"me@me.com","Password":"pass"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected %d actual %d", http.StatusForbidden, res.StatusCode)
+	}
+	if !strings.Contains(fmt.Sprint(m["error"]), "reset") {
+		t.Errorf("Expected a reset error actual %v", m)
+	}
+
+	if err = SetPassword(y.ustore, y.hasher, usr.Email, "new pass"); err != nil {
+		t.Fatal(err)
+	}
+	res, _, err = postJSON(client, ts.URL+lPath, `{"Email":"me@me.com","Password":"new pass"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected %d actual %d", http.StatusOK, res.StatusCode)
+	}
+}
+
+func TestHandlers_AdminBackup(t *testing.T) {
+	ts, client, y := testServer(t)
+	defer ts.Close()
+	defer cleanUp("warlock_test.db")
+
+	usr := &User{Email: "admin@me.com", Password: "pass", Roles: []string{RoleAdmin}}
+	if err := y.ustore.CreateUser(usr); err != nil {
+		t.Fatal(err)
+	}
+	wl, err := client.PostForm(ts.URL+lPath, url.Values{"Email": {usr.Email}, "Password": {"pass"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wl.Body.Close()
+
+	res, err := client.PostForm(ts.URL+dPath+"/backup", url.Values{"csrf_token": {adminToken(t, client, ts.URL)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var snap bytes.Buffer
+	io.Copy(&snap, res.Body)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected %d actual %d", http.StatusOK, res.StatusCode)
+	}
+	if !strings.HasPrefix(res.Header.Get("Content-Disposition"), "attachment") {
+		t.Errorf("Expected a download actual %s", res.Header.Get("Content-Disposition"))
+	}
+	if err = Restore("admin_backup.db", &snap); err != nil {
+		t.Fatalf("Expected a valid snapshot actual %v", err)
+	}
+	defer cleanUp("admin_backup.db")
+	if _, err = NewUserStore("admin_backup.db", UserBucket).GetUser(usr.Email); err != nil {
+		t.Errorf("Expected the admin in the snapshot actual %v", err)
+	}
+}
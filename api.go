@@ -0,0 +1,123 @@
+package warlock
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/monoculum/formam"
+)
+
+// PublicUser is the representation of a user sent to api clients, it never carries the
+// password hash
+type PublicUser struct {
+	ID            string    `json:"id"`
+	FirstName     string    `json:"first_name"`
+	LastName      string    `json:"last_name"`
+	Email         string    `json:"email"`
+	DisplayEmail  string    `json:"display_email,omitempty"`
+	Username      string    `json:"username,omitempty"`
+	Roles         []string  `json:"roles,omitempty"`
+	Permissions   []string  `json:"permissions,omitempty"`
+	Disabled      bool      `json:"disabled"`
+	ResetRequired bool      `json:"reset_required"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// Public returns the representation of the user which is safe to send to clients
+func (u *User) Public() *PublicUser {
+	return &PublicUser{
+		ID:            u.ID,
+		FirstName:     u.FirstName,
+		LastName:      u.LastName,
+		Email:         u.Email,
+		DisplayEmail:  u.DisplayEmail,
+		Username:      u.Username,
+		Roles:         u.Roles,
+		Permissions:   u.Permissions,
+		Disabled:      u.Disabled,
+		ResetRequired: u.ResetRequired,
+		CreatedAt:     u.CreatedAt,
+		UpdatedAt:     u.UpdatedAt,
+	}
+}
+
+// PublicInvitation is the representation of an invitation sent to api clients
+type PublicInvitation struct {
+	Code      string    `json:"code"`
+	Link      string    `json:"link"`
+	Email     string    `json:"email,omitempty"`
+	Org       string    `json:"org,omitempty"`
+	Roles     []string  `json:"roles,omitempty"`
+	MaxUses   int       `json:"max_uses"`
+	Uses      int       `json:"uses"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Public returns the representation of the invitation sent to clients, the link starts
+// with registerPath
+func (inv *Invitation) Public(registerPath string) *PublicInvitation {
+	return &PublicInvitation{
+		Code:      inv.Code,
+		Link:      inv.Link(registerPath),
+		Email:     inv.Email,
+		Org:       inv.OrgID,
+		Roles:     inv.Roles,
+		MaxUses:   inv.MaxUses,
+		Uses:      inv.Uses,
+		ExpiresAt: inv.ExpiresAt,
+	}
+}
+
+// apiResponse is the body of every json response sent by the handlers
+type apiResponse struct {
+	User       *PublicUser       `json:"user,omitempty"`
+	Invitation *PublicInvitation `json:"invitation,omitempty"`
+	Org        *Organization     `json:"org,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Errors     map[string]string `json:"errors,omitempty"`
+	Warning    string            `json:"warning,omitempty"`
+}
+
+// wantsJSON returns true if the client asked for json or sent a json body
+func wantsJSON(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mt, _, err := mime.ParseMediaType(strings.TrimSpace(v)); err == nil && mt == "application/json" {
+			return true
+		}
+	}
+	return hasJSONBody(r)
+}
+
+func hasJSONBody(r *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mt == "application/json"
+}
+
+// decodeRegister reads the registration details either from a json body or from the form.
+// Only the fields of RegisterForm are read, anything else sent along, like roles, is
+// ignored.
+func decodeRegister(r *http.Request, f *RegisterForm) error {
+	if !hasJSONBody(r) {
+		r.ParseForm()
+		dec := formam.NewDecoder(&formam.DecoderOptions{IgnoreUnknownKeys: true})
+		if err := dec.Decode(r.Form, f); err != nil {
+			return err
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(f); err != nil {
+		return err
+	}
+	f.Invite = strings.TrimSpace(f.Invite)
+	return nil
+}
+
+// decodeLogin reads the login details either from a json body or from the form
+func decodeLogin(r *http.Request, lg *LoginForm) error {
+	if !hasJSONBody(r) {
+		return formam.Decode(r.Form, lg)
+	}
+	return json.NewDecoder(r.Body).Decode(lg)
+}
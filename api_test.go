@@ -0,0 +1,188 @@
+package warlock
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func postJSON(client *http.Client, u string, body string) (*http.Response, map[string]interface{}, error) {
+	req, err := http.NewRequest("POST", u, strings.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(res.Body)
+	m := make(map[string]interface{})
+	if buf.Len() > 0 {
+		if err = json.Unmarshal(buf.Bytes(), &m); err != nil {
+			return res, nil, fmt.Errorf("%v: %s", err, buf.String())
+		}
+	}
+	return res, m, nil
+}
+
+func TestHandlers_RegisterJSON(t *testing.T) {
+	ts, client, _ := testServer(t)
+	defer ts.Close()
+	defer cleanUp("warlock_test.db")
+	reqURL := fmt.Sprintf("%s%s", ts.URL, rPath)
+
+	body := `{"first_name":"young","last_name":"warlock","email":"me@me.com","password":"open sesame 42","confirm_password":"open sesame 42"}`
+	res, m, err := postJSON(client, reqURL, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusCreated {
+		t.Errorf("Expected %d actual %d", http.StatusCreated, res.StatusCode)
+	}
+	usr, ok := m["user"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("Expected a user actual %v", m)
+	}
+	if usr["email"] != "me@me.com" || usr["first_name"] != "young" {
+		t.Errorf("Expected me@me.com young actual %v %v", usr["email"], usr["first_name"])
+	}
+	for k := range usr {
+		if strings.Contains(strings.ToLower(k), "password") {
+			t.Errorf("Expected no password in the response actual %v", usr)
+		}
+	}
+	if len(res.Cookies()) == 0 {
+		t.Error("Expected the session cookie to be set")
+	}
+
+	// Already exists
+	res, _, err = postJSON(client, reqURL, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("Expected %d actual %d", http.StatusConflict, res.StatusCode)
+	}
+
+	// Validation errors
+	res, m, err = postJSON(client, reqURL, `{"first_name":"young","email":"me","password":"pass","confirm_password":"past"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Expected %d actual %d", http.StatusUnprocessableEntity, res.StatusCode)
+	}
+	errs, ok := m["errors"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("Expected field errors actual %v", m)
+	}
+	for _, k := range []string{"LastName", "Email", "ConfirmPassword"} {
+		if _, ok := errs[k]; !ok {
+			t.Errorf("Expected an error for %s actual %v", k, errs)
+		}
+	}
+
+	// Longer than bcrypt accepts although within max_length
+	long := strings.Repeat("é", 40)
+	res, m, err = postJSON(client, reqURL, fmt.Sprintf(
+		`{"first_name":"young","last_name":"warlock","email":"long@me.com","password":%q,"confirm_password":%q}`, long, long))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Expected %d actual %d", http.StatusUnprocessableEntity, res.StatusCode)
+	}
+	if errs, _ = m["errors"].(map[string]interface{}); errs["Password.max_bytes"] == nil {
+		t.Errorf("Expected an error for Password.max_bytes actual %v", m)
+	}
+
+	// Malformed
+	res, _, err = postJSON(client, reqURL, `{"first_name":`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected %d actual %d", http.StatusBadRequest, res.StatusCode)
+	}
+}
+
+func TestHandlers_LoginJSON(t *testing.T) {
+	ts, client, y := testServer(t)
+	defer ts.Close()
+	defer cleanUp("warlock_test.db")
+	reqURL := fmt.Sprintf("%s%s", ts.URL, lPath)
+
+	usr := new(User)
+	usr.Email = "me@me.com"
+	usr.Password = "pass"
+	y.ustore.CreateUser(usr)
+
+	res, m, err := postJSON(client, reqURL, `{"Email":"me@me.com","Password":"wrong"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected %d actual %d", http.StatusUnauthorized, res.StatusCode)
+	}
+	if m["error"] == nil {
+		t.Errorf("Expected an error actual %v", m)
+	}
+
+	res, _, err = postJSON(client, reqURL, `{"Email":"me","Password":"pass"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Expected %d actual %d", http.StatusUnprocessableEntity, res.StatusCode)
+	}
+
+	res, m, err = postJSON(client, reqURL, `{"Email":"me@me.com","Password":"pass"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected %d actual %d", http.StatusOK, res.StatusCode)
+	}
+	if u, ok := m["user"].(map[string]interface{}); !ok || u["id"] != usr.ID {
+		t.Errorf("Expected user %s actual %v", usr.ID, m)
+	}
+	if len(res.Cookies()) == 0 {
+		t.Error("Expected the session cookie to be set")
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s%s", ts.URL, oPath), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	out, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Body.Close()
+	if out.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected %d actual %d", http.StatusNoContent, out.StatusCode)
+	}
+
+	// Locked accounts
+	if err = SetDisabled(y.ustore, usr.Email, true); err != nil {
+		t.Fatal(err)
+	}
+	res, m, err = postJSON(client, reqURL, `{"Email":"me@me.com","Password":"pass"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected %d actual %d", http.StatusForbidden, res.StatusCode)
+	}
+	if m["error"] == nil {
+		t.Errorf("Expected an error actual %v", m)
+	}
+}
@@ -0,0 +1,144 @@
+package warlock
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/gernest/nutz"
+	u "github.com/nu7hatch/gouuid"
+)
+
+// AuditBucket is the bucket used by YoungWarlock for the bolt audit log
+const AuditBucket = "audit"
+
+// Actions recorded in the audit log
+const (
+	AuditRegister        = "register"
+	AuditLogin           = "login"
+	AuditLoginFailed     = "login_failed"
+	AuditLogout          = "logout"
+	AuditDisable         = "disable"
+	AuditEnable          = "enable"
+	AuditResetPassword   = "reset_password"
+	AuditDelete          = "delete"
+	AuditBackup          = "backup"
+	AuditInvite          = "invite"
+	AuditRevokeInvite    = "revoke_invite"
+	AuditJoinOrg         = "join_org"
+	AuditImpersonate     = "impersonate"
+	AuditStopImpersonate = "stop_impersonate"
+	AuditCreate          = "create"
+	AuditUpdate          = "update"
+	AuditSetPassword     = "set_password"
+	AuditLeaveOrg        = "leave_org"
+	AuditDeleteOrg       = "delete_org"
+	AuditRestore         = "restore"
+)
+
+// AuditEvent is something which happened to an account. Actor is the email of whoever did
+// it and Subject the email of the account, they are the same when users act on their own
+// account.
+type AuditEvent struct {
+	ID      string
+	Time    time.Time
+	Actor   string
+	Subject string
+	Action  string
+	Detail  string
+}
+
+// AuditStorer is implemented by audit log backends
+type AuditStorer interface {
+	// Record appends the event to the log, the ID and Time are set when empty
+	Record(ev *AuditEvent) error
+
+	// Events returns at most limit events about subject, newest first. There is no
+	// limit when it is zero or negative.
+	Events(subject string, limit int) ([]*AuditEvent, error)
+}
+
+// AuditStore keeps the audit log in bolt
+type AuditStore struct {
+	store  nutz.Storage
+	bucket string
+}
+
+// NewAuditStore creates a bolt backed audit log
+func NewAuditStore(db, bucket string) AuditStore {
+	return AuditStore{
+		store:  nutz.NewStorage(db, 0600, nil),
+		bucket: bucket,
+	}
+}
+
+// Record appends the event to the log
+func (a AuditStore) Record(ev *AuditEvent) error {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	if ev.ID == "" {
+		uid, err := u.NewV4()
+		if err != nil {
+			return err
+		}
+		ev.ID = uid.String()
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	// keys sort by time so the log reads in order when browsed with bolt tools
+	key := fmt.Sprintf("%020d-%s", ev.Time.UnixNano(), ev.ID)
+	c := a.store.Create(a.bucket, key, data)
+	return c.Error
+}
+
+// Events returns the events about subject, newest first
+func (a AuditStore) Events(subject string, limit int) ([]*AuditEvent, error) {
+	all := a.store.GetAll(a.bucket)
+	if all.Error != nil {
+		// the bucket is only created with the first event
+		return nil, nil
+	}
+	var events []*AuditEvent
+	for _, v := range all.DataList {
+		ev := new(AuditEvent)
+		if err := json.Unmarshal(v, ev); err != nil {
+			return nil, err
+		}
+		if ev.Subject == subject {
+			events = append(events, ev)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Time.After(events[j].Time)
+	})
+	if limit > 0 && len(events) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
+
+// RecordAudit records an event in the audit log. The handlers record through it, and so
+// should tools changing accounts outside of them, like the warlock command.
+func RecordAudit(store AuditStorer, actor, subject, action, detail string) error {
+	return store.Record(&AuditEvent{
+		Actor:   actor,
+		Subject: subject,
+		Action:  action,
+		Detail:  detail,
+	})
+}
+
+// audit records an event, failures are logged and never stop the request
+func (h *Handlers) audit(actor, subject, action, detail string) {
+	if h.auditLog == nil {
+		return
+	}
+	if err := RecordAudit(h.auditLog, actor, subject, action, detail); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,45 @@
+package warlock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuditStore(t *testing.T) {
+	db := "audit_test.db"
+	defer cleanUp(db)
+	a := NewAuditStore(db, AuditBucket)
+
+	events, err := a.Events("me@me.com", 0)
+	if err != nil || len(events) != 0 {
+		t.Errorf("Expected no events actual %v %v", events, err)
+	}
+	now := time.Now()
+	sample := []*AuditEvent{
+		{Subject: "me@me.com", Action: AuditRegister, Time: now.Add(-2 * time.Minute)},
+		{Subject: "you@me.com", Action: AuditLogin, Time: now.Add(-time.Minute)},
+		{Subject: "me@me.com", Action: AuditLogin, Time: now},
+	}
+	for _, ev := range sample {
+		if err = a.Record(ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.ID == "" {
+			t.Error("Expected an ID to be set")
+		}
+	}
+	events, err = a.Events("me@me.com", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 actual %d", len(events))
+	}
+	if events[0].Action != AuditLogin || events[1].Action != AuditRegister {
+		t.Errorf("Expected newest first actual %s %s", events[0].Action, events[1].Action)
+	}
+	events, _ = a.Events("me@me.com", 1)
+	if len(events) != 1 {
+		t.Errorf("Expected 1 actual %d", len(events))
+	}
+}
@@ -0,0 +1,135 @@
+package warlock
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// lockTimeout is how long Backup and Restore wait for the database file lock
+const lockTimeout = 5 * time.Second
+
+// Backup writes a consistent snapshot of the bolt database to w while the application keeps
+// running. The snapshot is first copied to a temporary file in a read transaction of a read
+// only connection, so the database is only locked for the local copy and not while w, which
+// may be a slow download, is written to. It returns the number of bytes written.
+func Backup(db string, w io.Writer) (int64, error) {
+	tmp, err := ioutil.TempFile("", filepath.Base(db)+".backup-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	conn, err := bolt.Open(db, 0600, &bolt.Options{ReadOnly: true, Timeout: lockTimeout})
+	if err != nil {
+		return 0, err
+	}
+	err = conn.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(tmp)
+		return err
+	})
+	conn.Close()
+	if err != nil {
+		return 0, err
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, tmp)
+}
+
+// Restore replaces the bolt database with the snapshot read from r. The snapshot is
+// written next to the database and checked for consistency first. The database is only
+// replaced once it passes, by copying the snapshot over the database file while holding
+// its file lock. The file is overwritten rather than renamed over so that connections
+// waiting for the lock open the restored data, not the replaced file. Should the copy be
+// cut short the snapshot is kept and its path is in the error.
+func Restore(db string, r io.Reader) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(db), filepath.Base(db)+".restore-")
+	if err != nil {
+		return err
+	}
+	keep := false
+	defer func() {
+		if !keep {
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = checkSnapshot(tmp.Name()); err != nil {
+		return err
+	}
+	live, err := bolt.Open(db, 0600, &bolt.Options{Timeout: lockTimeout})
+	if err != nil {
+		return err
+	}
+	defer live.Close()
+	if err = overwrite(db, tmp.Name()); err != nil {
+		keep = true
+		return fmt.Errorf("warlock: restore of %s failed, the snapshot is kept at %s: %v", db, tmp.Name(), err)
+	}
+	return nil
+}
+
+// overwrite replaces the content of the file at dst with the one of src in place
+func overwrite(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// checkSnapshot opens the snapshot read only and walks every page of it, bolt panics on
+// some corrupted files so panics are reported as errors too
+func checkSnapshot(path string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("warlock: corrupted snapshot: %v", r)
+		}
+	}()
+	conn, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("warlock: invalid snapshot: %v", err)
+	}
+	defer conn.Close()
+	return conn.View(func(tx *bolt.Tx) error {
+		var errs []string
+		for err := range tx.Check() {
+			errs = append(errs, err.Error())
+		}
+		if len(errs) > 0 {
+			return errors.New("warlock: corrupted snapshot: " + errs[0])
+		}
+		return nil
+	})
+}
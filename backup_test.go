@@ -0,0 +1,91 @@
+package warlock
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupRestore(t *testing.T) {
+	db := "backup.db"
+	ns := NewUserStore(db, "account")
+	defer ns.store.DeleteDatabase()
+	if err := ns.CreateUser(&User{Email: "kept@me.com"}); err != nil {
+		t.Fatal(err)
+	}
+	var snap bytes.Buffer
+	n, err := Backup(db, &snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 || int64(snap.Len()) != n {
+		t.Errorf("Expected %d bytes actual %d", n, snap.Len())
+	}
+
+	if err = ns.CreateUser(&User{Email: "lost@me.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = Restore(db, bytes.NewReader(snap.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ns.GetUser("kept@me.com"); err != nil {
+		t.Errorf("Expected nil actual %v", err)
+	}
+	if _, err = ns.GetUser("lost@me.com"); err != ErrUserNotFound {
+		t.Errorf("Expected %v actual %v", ErrUserNotFound, err)
+	}
+
+	// invalid snapshots leave the database alone
+	if err = Restore(db, strings.NewReader("not a bolt database")); err == nil {
+		t.Error("Expected an error restoring garbage")
+	}
+	bad := append([]byte(nil), snap.Bytes()...)
+	for i := 4096; i < len(bad); i++ {
+		bad[i] = 0xff
+	}
+	if err = Restore(db, bytes.NewReader(bad)); err == nil {
+		t.Error("Expected an error restoring a corrupted snapshot")
+	}
+	if _, err = ns.GetUser("kept@me.com"); err != nil {
+		t.Errorf("Expected nil actual %v", err)
+	}
+}
+
+// writeFunc calls fn on the first write, like a download stalling at its start
+type writeFunc struct {
+	fn   func()
+	done bool
+}
+
+func (w *writeFunc) Write(p []byte) (int, error) {
+	if !w.done {
+		w.done = true
+		w.fn()
+	}
+	return len(p), nil
+}
+
+func TestBackup_doesNotBlockWriters(t *testing.T) {
+	db := "backup.db"
+	ns := NewUserStore(db, "account")
+	defer ns.store.DeleteDatabase()
+	if err := ns.CreateUser(&User{Email: "kept@me.com"}); err != nil {
+		t.Fatal(err)
+	}
+	w := &writeFunc{fn: func() {
+		done := make(chan error, 1)
+		go func() { done <- ns.CreateUser(&User{Email: "new@me.com"}) }()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Error("Expected writers to go on while the backup is sent")
+		}
+	}}
+	if _, err := Backup(db, w); err != nil {
+		t.Fatal(err)
+	}
+}
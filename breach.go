@@ -0,0 +1,118 @@
+package warlock
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Supported values for Config.BreachAction
+const (
+	BreachReject = "reject"
+	BreachWarn   = "warn"
+)
+
+// maxBreachLine is the longest line expected in the corpus, a 40 characters hash, a colon,
+// the count and the line ending
+const maxBreachLine = 64
+
+// BreachList looks up passwords in a local copy of the Pwned Passwords corpus. The file
+// has one upper case SHA-1 hash per line optionally followed by :count, ordered by hash,
+// which is the format of the downloadable "ordered by hash" files. Lookups are binary
+// searches over the file so it is never loaded into memory, and no network is used.
+type BreachList struct {
+	f    *os.File
+	size int64
+}
+
+// OpenBreachList opens the corpus at path
+func OpenBreachList(path string) (*BreachList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &BreachList{f: f, size: info.Size()}, nil
+}
+
+// Close releases the corpus file
+func (b *BreachList) Close() error {
+	return b.f.Close()
+}
+
+// Count returns how many times the password appears in the corpus, zero means it was
+// not found
+func (b *BreachList) Count(password string) (int, error) {
+	sum := sha1.Sum([]byte(password))
+	target := []byte(strings.ToUpper(hex.EncodeToString(sum[:])))
+	lo, hi := int64(0), b.size
+	for lo < hi {
+		start, end, line, err := b.lineAt(lo + (hi-lo)/2)
+		if err != nil {
+			return 0, err
+		}
+		hash := line
+		if i := bytes.IndexByte(line, ':'); i >= 0 {
+			hash = line[:i]
+		}
+		switch bytes.Compare(bytes.ToUpper(hash), target) {
+		case 0:
+			return breachCount(line[len(hash):]), nil
+		case -1:
+			lo = end
+		default:
+			hi = start
+		}
+	}
+	return 0, nil
+}
+
+// lineAt returns the line containing off, with the offsets of its first byte and of the
+// byte after its line ending
+func (b *BreachList) lineAt(off int64) (start, end int64, line []byte, err error) {
+	from := off - maxBreachLine
+	if from < 0 {
+		from = 0
+	}
+	buf := make([]byte, 2*maxBreachLine)
+	n, err := b.f.ReadAt(buf, from)
+	if err != nil && err != io.EOF {
+		return 0, 0, nil, err
+	}
+	buf = buf[:n]
+	rel := int(off - from)
+	s := bytes.LastIndexByte(buf[:rel], '\n') + 1
+	e := bytes.IndexByte(buf[rel:], '\n')
+	if e < 0 {
+		if from+int64(n) < b.size {
+			return 0, 0, nil, errors.New("warlock: breach list line too long")
+		}
+		e = len(buf)
+	} else {
+		e += rel + 1
+	}
+	line = bytes.TrimRight(buf[s:e], "\r\n")
+	return from + int64(s), from + int64(e), line, nil
+}
+
+// breachCount parses the :count suffix of a line, lines without a count are taken to
+// have been seen once
+func breachCount(suffix []byte) int {
+	if len(suffix) < 2 {
+		return 1
+	}
+	n, err := strconv.Atoi(string(suffix[1:]))
+	if err != nil || n < 1 {
+		return 1
+	}
+	return n
+}
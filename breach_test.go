@@ -0,0 +1,115 @@
+package warlock
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var breachedPasswords = []string{"password1", "letmein123", "qwertyuiop", "dragon2000"}
+
+// writeBreachList writes a small corpus in the Pwned Passwords ordered by hash format
+func writeBreachList(t *testing.T) string {
+	var lines []string
+	for i := 0; i < 500; i++ {
+		lines = append(lines, fmt.Sprintf("filler-%d", i))
+	}
+	lines = append(lines, breachedPasswords...)
+	for i, v := range lines {
+		sum := sha1.Sum([]byte(v))
+		lines[i] = fmt.Sprintf("%s:%d", strings.ToUpper(hex.EncodeToString(sum[:])), i+1)
+	}
+	sort.Strings(lines)
+	f, err := ioutil.TempFile("", "pwned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString(strings.Join(lines, "\r\n") + "\r\n")
+	return f.Name()
+}
+
+func TestBreachList(t *testing.T) {
+	path := writeBreachList(t)
+	defer os.Remove(path)
+	b, err := OpenBreachList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	for i := 0; i < 500; i += 37 {
+		n, err := b.Count(fmt.Sprintf("filler-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != i+1 {
+			t.Errorf("Expected %d actual %d", i+1, n)
+		}
+	}
+	for _, v := range breachedPasswords {
+		n, err := b.Count(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			t.Errorf("Expected %s to be found", v)
+		}
+	}
+	for _, v := range []string{"open sesame 42", "", "filler-500"} {
+		n, err := b.Count(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("Expected %q not to be found actual %d", v, n)
+		}
+	}
+	if _, err = OpenBreachList("missing.txt"); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
+
+func TestHandlers_RegisterBreached(t *testing.T) {
+	path := writeBreachList(t)
+	defer os.Remove(path)
+	sample := []struct {
+		action string
+		broken bool
+		status int
+	}{
+		{BreachReject, false, http.StatusUnprocessableEntity},
+		{BreachWarn, false, http.StatusCreated},
+		{BreachReject, true, http.StatusUnprocessableEntity},
+	}
+	for _, v := range sample {
+		ts, client, y := testServerConfig(t, &Config{BreachFile: path, BreachAction: v.action})
+		if v.broken {
+			// lookups fail once the file is closed, which must not let the password through
+			y.breach.Close()
+		}
+		body := `{"first_name":"young","last_name":"warlock","email":"me@me.com","password":"letmein123","confirm_password":"letmein123"}`
+		res, m, err := postJSON(client, fmt.Sprintf("%s%s", ts.URL, rPath), body)
+		ts.Close()
+		cleanUp("warlock_test.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != v.status {
+			t.Errorf("%s: Expected %d actual %d", v.action, v.status, res.StatusCode)
+		}
+		if v.action == BreachReject {
+			errs, _ := m["errors"].(map[string]interface{})
+			if _, ok := errs["Password.breached"]; !ok {
+				t.Errorf("Expected Password.breached actual %v", m)
+			}
+		} else if m["warning"] == nil {
+			t.Errorf("Expected a warning actual %v", m)
+		}
+	}
+}
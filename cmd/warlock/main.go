@@ -0,0 +1,852 @@
+// Command warlock administers the users and sessions kept in a warlock bolt database.
+//
+//	warlock [-config file] [-db path] [-json] <command> [arguments]
+//
+// The commands are
+//
+//	user list [-role <role>] [-prefix <email prefix>] [-search <text>]
+//	user show <email>
+//	user create -email <email> -first <name> -last <name> [-username <name>] [-password <password>] [-roles a,b]
+//	user update <email> [-first <name>] [-last <name>] [-username <name>] [-roles a,b]
+//	user delete <email>
+//	user passwd <email> [-password <password>]
+//	user lock <email>
+//	user unlock <email>
+//	user reindex
+//	user normalize-emails [-apply]
+//	invite create -inviter <email> [-email <email>] [-org <id>] [-roles a,b] [-max-uses n] [-ttl duration]
+//	invite list [-inviter <email>]
+//	invite revoke <code>
+//	org create -name <name> -owner <email>
+//	org list [-user <email>]
+//	org delete <id>
+//	org members <id>
+//	org add <id> <email> [-roles a,b]
+//	org remove <id> <email>
+//	webhooks list [-dead]
+//	webhooks retry <id>
+//	webhooks deliver
+//	sessions purge [-all]
+//	db backup <file>
+//	db restore <file>
+//	schema status
+//	schema migrate
+//	keys generate
+//
+// Passwords which are not given as flags are read from the first line of stdin, backups
+// are written to stdout and restores read from stdin when the file is -. The
+// configuration is loaded with warlock.LoadConfig, so WARLOCK_* variables apply too. When
+// webhooks are configured, creating and deleting users and changing passwords queues the
+// matching events, they are sent by the application or by webhooks deliver. Changes to
+// users, invitations and memberships as well as restores are recorded in the audit log,
+// with cli: and the name of the system user as actor.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gernest/warlock"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "warlock:", err)
+		os.Exit(1)
+	}
+}
+
+// app carries what every command needs
+type app struct {
+	cfg    *warlock.Config
+	asJSON bool
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+func run(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("warlock", flag.ContinueOnError)
+	fs.SetOutput(stdout)
+	cfgFile := fs.String("config", "", "configuration file (json, yaml or toml)")
+	db := fs.String("db", "", "bolt database, overrides the configuration")
+	asJSON := fs.Bool("json", false, "print json instead of tables")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	cfg, err := warlock.LoadConfig(*cfgFile)
+	if err != nil {
+		return err
+	}
+	if *db != "" {
+		cfg.DB = *db
+	}
+	a := &app{cfg: cfg, asJSON: *asJSON, stdin: stdin, stdout: stdout}
+	rest := fs.Args()
+	if len(rest) < 2 {
+		return errors.New("usage: warlock [-config file] [-db path] [-json] <user|invite|org|webhooks|sessions|db|schema|keys> <command> [arguments]")
+	}
+	switch rest[0] {
+	case "user":
+		return a.user(rest[1], rest[2:])
+	case "invite":
+		return a.invite(rest[1], rest[2:])
+	case "org":
+		return a.org(rest[1], rest[2:])
+	case "webhooks":
+		return a.webhooks(rest[1], rest[2:])
+	case "sessions":
+		return a.sessions(rest[1], rest[2:])
+	case "db":
+		return a.db(rest[1], rest[2:])
+	case "schema":
+		return a.schema(rest[1], rest[2:])
+	case "keys":
+		return a.keys(rest[1], rest[2:])
+	}
+	return fmt.Errorf("unknown command %q", rest[0])
+}
+
+func (a *app) store() (warlock.UserStore, warlock.Hasher, error) {
+	h, err := warlock.NewHasher(a.cfg.Hasher, a.cfg.HashCost)
+	if err != nil {
+		return warlock.UserStore{}, nil, err
+	}
+	if p := a.cfg.PasswordPolicy; p != nil && p.DenyListFile != "" {
+		if err = p.LoadDenyList(p.DenyListFile); err != nil {
+			return warlock.UserStore{}, nil, err
+		}
+	}
+	return warlock.NewUserStore(a.cfg.DB, warlock.UserBucket, h), h, nil
+}
+
+func (a *app) user(cmd string, args []string) error {
+	us, h, err := a.store()
+	if err != nil {
+		return err
+	}
+	switch cmd {
+	case "list":
+		fs := a.flags("user list")
+		opts := warlock.ListOptions{}
+		fs.StringVar(&opts.Role, "role", "", "only users with the role")
+		fs.StringVar(&opts.Prefix, "prefix", "", "only emails starting with the prefix")
+		fs.StringVar(&opts.Search, "search", "", "only users whose email or name contain the text")
+		if err = fs.Parse(args); err != nil {
+			return err
+		}
+		var users []*warlock.User
+		for {
+			p, err := us.List(opts)
+			if err != nil {
+				return err
+			}
+			users = append(users, p.Users...)
+			if p.Next == "" {
+				break
+			}
+			opts.Cursor = p.Next
+		}
+		return a.printUsers(users...)
+	case "show":
+		email, err := oneArg(cmd, args)
+		if err != nil {
+			return err
+		}
+		usr, err := us.GetUser(email)
+		if err != nil {
+			return err
+		}
+		return a.printUsers(usr)
+	case "create":
+		fs := a.flags("user create")
+		email := fs.String("email", "", "email of the user")
+		first := fs.String("first", "", "first name")
+		last := fs.String("last", "", "last name")
+		username := fs.String("username", "", "optional unique username")
+		pass := fs.String("password", "", "password, read from stdin when empty")
+		roles := fs.String("roles", "", "comma separated roles")
+		if err = fs.Parse(args); err != nil {
+			return err
+		}
+		if *pass == "" {
+			if *pass, err = a.readPassword(); err != nil {
+				return err
+			}
+		}
+		usr := &warlock.User{
+			FirstName:       *first,
+			LastName:        *last,
+			Email:           *email,
+			Username:        *username,
+			Password:        *pass,
+			ConfirmPassword: *pass,
+			Roles:           splitList(*roles),
+		}
+		if v := usr.ValidateWith(a.cfg.PasswordPolicy.ForHasher(h)); v != nil {
+			return validationError(v)
+		}
+		if err = a.checkBreached(*pass); err != nil {
+			return err
+		}
+		if err = us.CreateUser(usr); err != nil {
+			return err
+		}
+		if err = a.audit(usr.Email, warlock.AuditCreate, strings.Join(usr.Roles, ",")); err != nil {
+			return err
+		}
+		if err = a.emit(warlock.EventUserCreated, usr); err != nil {
+			return err
+		}
+		return a.printUsers(usr)
+	case "update":
+		if len(args) == 0 {
+			return errors.New("usage: warlock user update <email> [-first name] [-last name] [-username name] [-roles a,b]")
+		}
+		fs := a.flags("user update")
+		first := fs.String("first", "", "first name")
+		last := fs.String("last", "", "last name")
+		username := fs.String("username", "", "unique username, empty removes it")
+		roles := fs.String("roles", "", "comma separated roles, replaces the current ones")
+		if err = fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		usr, err := us.GetUser(args[0])
+		if err != nil {
+			return err
+		}
+		var changed []string
+		fs.Visit(func(f *flag.Flag) {
+			changed = append(changed, f.Name+"="+f.Value.String())
+			switch f.Name {
+			case "first":
+				usr.FirstName = *first
+			case "last":
+				usr.LastName = *last
+			case "username":
+				usr.Username = *username
+			case "roles":
+				usr.Roles = splitList(*roles)
+			}
+		})
+		if err = us.UpdateUser(usr); err != nil {
+			return err
+		}
+		if err = a.audit(usr.Email, warlock.AuditUpdate, strings.Join(changed, " ")); err != nil {
+			return err
+		}
+		return a.printUsers(usr)
+	case "delete":
+		email, err := oneArg(cmd, args)
+		if err != nil {
+			return err
+		}
+		usr, err := us.GetUser(email)
+		if err != nil {
+			return err
+		}
+		if err = us.DeleteUser(email); err != nil {
+			return err
+		}
+		if err = warlock.NewOrgStore(a.cfg.DB, warlock.OrgBucket).RemoveUser(email); err != nil {
+			return err
+		}
+		if err = a.audit(usr.Email, warlock.AuditDelete, ""); err != nil {
+			return err
+		}
+		return a.emit(warlock.EventUserDeleted, usr)
+	case "passwd":
+		if len(args) == 0 {
+			return errors.New("usage: warlock user passwd <email> [-password password]")
+		}
+		fs := a.flags("user passwd")
+		pass := fs.String("password", "", "new password, read from stdin when empty")
+		if err = fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		usr, err := us.GetUser(args[0])
+		if err != nil {
+			return err
+		}
+		if *pass == "" {
+			if *pass, err = a.readPassword(); err != nil {
+				return err
+			}
+		}
+		if p := a.cfg.PasswordPolicy.ForHasher(h); p != nil {
+			if v := p.Check(*pass, usr); v != nil {
+				return validationError(v)
+			}
+		}
+		if err = a.checkBreached(*pass); err != nil {
+			return err
+		}
+		if err = warlock.SetPassword(us, h, usr.Email, *pass); err != nil {
+			return err
+		}
+		if err = a.audit(usr.Email, warlock.AuditSetPassword, ""); err != nil {
+			return err
+		}
+		return a.emit(warlock.EventPasswordChanged, usr)
+	case "lock", "unlock":
+		email, err := oneArg(cmd, args)
+		if err != nil {
+			return err
+		}
+		if err = warlock.SetDisabled(us, email, cmd == "lock"); err != nil {
+			return err
+		}
+		action := warlock.AuditEnable
+		if cmd == "lock" {
+			action = warlock.AuditDisable
+		}
+		return a.audit(warlock.NormalizeEmail(email), action, "")
+	case "reindex":
+		return us.Reindex()
+	case "normalize-emails":
+		fs := a.flags("user normalize-emails")
+		apply := fs.Bool("apply", false, "move the records instead of only reporting")
+		if err = fs.Parse(args); err != nil {
+			return err
+		}
+		report, err := us.NormalizeEmails(*apply)
+		if err != nil {
+			return err
+		}
+		return a.printEmailReport(report, *apply)
+	}
+	return fmt.Errorf("unknown user command %q", cmd)
+}
+
+// invite creates, lists and revokes registration invitations
+func (a *app) invite(cmd string, args []string) error {
+	store := warlock.NewInviteStore(a.cfg.DB, warlock.InviteBucket)
+	switch cmd {
+	case "create":
+		fs := a.flags("invite create")
+		inviter := fs.String("inviter", "", "email of the user sending the invitation")
+		email := fs.String("email", "", "only this email may use the invitation")
+		org := fs.String("org", "", "invite to this organization, roles then apply within it")
+		roles := fs.String("roles", "", "comma separated roles granted on registration")
+		maxUses := fs.Int("max-uses", 1, "how many registrations the invitation allows")
+		ttl := fs.Duration("ttl", time.Duration(a.cfg.InviteMaxAge)*time.Second, "how long the invitation is valid")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if *inviter == "" {
+			return errors.New("-inviter is required")
+		}
+		if *org != "" {
+			if _, err := warlock.NewOrgStore(a.cfg.DB, warlock.OrgBucket).GetOrg(*org); err != nil {
+				return err
+			}
+		}
+		inv := &warlock.Invitation{
+			Inviter: *inviter,
+			Email:   *email,
+			OrgID:   *org,
+			Roles:   splitList(*roles),
+			MaxUses: *maxUses,
+			Trusted: true,
+		}
+		if err := store.Create(inv, *ttl); err != nil {
+			return err
+		}
+		if err := a.audit(inv.Inviter, warlock.AuditInvite, inv.Email); err != nil {
+			return err
+		}
+		return a.printInvitations(inv)
+	case "list":
+		fs := a.flags("invite list")
+		inviter := fs.String("inviter", "", "only list the invitations of this user")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		list, err := store.List(*inviter)
+		if err != nil {
+			return err
+		}
+		return a.printInvitations(list...)
+	case "revoke":
+		if len(args) != 1 {
+			return errors.New("usage: warlock invite revoke <code>")
+		}
+		inv, err := store.Get(args[0])
+		if err != nil {
+			return err
+		}
+		if err = store.Delete(inv.Code); err != nil {
+			return err
+		}
+		return a.audit(inv.Inviter, warlock.AuditRevokeInvite, inv.Email)
+	}
+	return fmt.Errorf("unknown invite command %q", cmd)
+}
+
+// org manages organizations and their members
+func (a *app) org(cmd string, args []string) error {
+	store := warlock.NewOrgStore(a.cfg.DB, warlock.OrgBucket)
+	switch cmd {
+	case "create":
+		fs := a.flags("org create")
+		name := fs.String("name", "", "name of the organization")
+		owner := fs.String("owner", "", "email of the first owner")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if *name == "" || *owner == "" {
+			return errors.New("-name and -owner are required")
+		}
+		org := &warlock.Organization{Name: *name}
+		if err := store.CreateOrg(org, *owner); err != nil {
+			return err
+		}
+		if err := a.audit(warlock.NormalizeEmail(*owner), warlock.AuditJoinOrg, org.ID+" "+warlock.OrgRoleOwner); err != nil {
+			return err
+		}
+		return a.printOrgs(org)
+	case "list":
+		fs := a.flags("org list")
+		user := fs.String("user", "", "only list the organizations of this user")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		var list []*warlock.Organization
+		var err error
+		if *user != "" {
+			list, err = store.UserOrgs(*user)
+		} else {
+			list, err = store.ListOrgs()
+		}
+		if err != nil {
+			return err
+		}
+		return a.printOrgs(list...)
+	case "delete":
+		if len(args) != 1 {
+			return errors.New("usage: warlock org delete <id>")
+		}
+		members, err := store.Members(args[0])
+		if err != nil {
+			return err
+		}
+		if err = store.DeleteOrg(args[0]); err != nil {
+			return err
+		}
+		for _, m := range members {
+			if err = a.audit(m.Email, warlock.AuditLeaveOrg, args[0]); err != nil {
+				return err
+			}
+		}
+		return a.audit("", warlock.AuditDeleteOrg, args[0])
+	case "members":
+		if len(args) != 1 {
+			return errors.New("usage: warlock org members <id>")
+		}
+		list, err := store.Members(args[0])
+		if err != nil {
+			return err
+		}
+		if a.asJSON {
+			enc := json.NewEncoder(a.stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(list)
+		}
+		w := tabwriter.NewWriter(a.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "EMAIL\tROLES\tJOINED")
+		for _, m := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", m.Email, strings.Join(m.Roles, ","), m.JoinedAt.Format(time.RFC3339))
+		}
+		return w.Flush()
+	case "add":
+		if len(args) < 2 {
+			return errors.New("usage: warlock org add <id> <email> [-roles a,b]")
+		}
+		fs := a.flags("org add")
+		roles := fs.String("roles", warlock.OrgRoleMember, "comma separated roles within the organization")
+		if err := fs.Parse(args[2:]); err != nil {
+			return err
+		}
+		us, _, err := a.store()
+		if err != nil {
+			return err
+		}
+		usr, err := us.GetUser(args[1])
+		if err != nil {
+			return err
+		}
+		if err = store.AddMember(args[0], usr.Email, splitList(*roles)...); err != nil {
+			return err
+		}
+		return a.audit(usr.Email, warlock.AuditJoinOrg, args[0]+" "+*roles)
+	case "remove":
+		if len(args) != 2 {
+			return errors.New("usage: warlock org remove <id> <email>")
+		}
+		if err := store.RemoveMember(args[0], args[1]); err != nil {
+			return err
+		}
+		return a.audit(warlock.NormalizeEmail(args[1]), warlock.AuditLeaveOrg, args[0])
+	}
+	return fmt.Errorf("unknown org command %q", cmd)
+}
+
+// webhooks inspects the webhook queue, retries dead letters and delivers what is due
+func (a *app) webhooks(cmd string, args []string) error {
+	q := a.queue()
+	if q == nil {
+		return errors.New("no webhooks are configured")
+	}
+	switch cmd {
+	case "list":
+		fs := a.flags("webhooks list")
+		dead := fs.Bool("dead", false, "list the dead letters instead of the pending deliveries")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		list, err := q.Pending()
+		if *dead {
+			list, err = q.DeadLetters()
+		}
+		if err != nil {
+			return err
+		}
+		if a.asJSON {
+			enc := json.NewEncoder(a.stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(list)
+		}
+		w := tabwriter.NewWriter(a.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tEVENT\tURL\tATTEMPTS\tNEXT\tERROR")
+		for _, d := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n",
+				d.ID, d.Event, d.URL, d.Attempts, d.NextAttempt.Format(time.RFC3339), d.LastError)
+		}
+		return w.Flush()
+	case "retry":
+		if len(args) != 1 {
+			return errors.New("usage: warlock webhooks retry <id>")
+		}
+		return q.Retry(args[0])
+	case "deliver":
+		n, err := q.Deliver()
+		if err != nil {
+			return err
+		}
+		if a.asJSON {
+			return json.NewEncoder(a.stdout).Encode(map[string]int{"delivered": n})
+		}
+		_, err = fmt.Fprintf(a.stdout, "delivered %d webhooks\n", n)
+		return err
+	}
+	return fmt.Errorf("unknown webhooks command %q", cmd)
+}
+
+// queue returns the webhook queue, it is nil when no webhook is configured
+func (a *app) queue() *warlock.WebhookQueue {
+	if len(a.cfg.Webhooks) == 0 {
+		return nil
+	}
+	q := warlock.NewWebhookQueue(a.cfg.DB, warlock.WebhookBucket, a.cfg.Webhooks)
+	q.MaxAttempts = a.cfg.WebhookMaxAttempts
+	return q
+}
+
+// emit queues the event about usr for the configured webhooks
+func (a *app) emit(event string, usr *warlock.User) error {
+	if q := a.queue(); q != nil {
+		return q.Enqueue(event, usr)
+	}
+	return nil
+}
+
+// audit records a change made with the command in the audit log, the actor is cli: and
+// the name of the user running it. Changes which are not about an account, like restores,
+// have the actor as subject.
+func (a *app) audit(subject, action, detail string) error {
+	actor := "cli"
+	if u, err := user.Current(); err == nil {
+		actor += ":" + u.Username
+	}
+	if subject == "" {
+		subject = actor
+	}
+	return warlock.RecordAudit(warlock.NewAuditStore(a.cfg.DB, warlock.AuditBucket), actor, subject, action, detail)
+}
+
+// flags returns the flag set of a command, usage and errors are printed to stdout like
+// the output of the commands
+func (a *app) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(a.stdout)
+	return fs
+}
+
+func (a *app) sessions(cmd string, args []string) error {
+	if cmd != "purge" {
+		return fmt.Errorf("unknown sessions command %q", cmd)
+	}
+	fs := a.flags("sessions purge")
+	all := fs.Bool("all", false, "remove every session instead of the expired ones")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if a.cfg.SessStore != "" && a.cfg.SessStore != warlock.SessBolt {
+		return fmt.Errorf("sessions are kept in the %s store, only bolt sessions can be purged", a.cfg.SessStore)
+	}
+	s := warlock.NewSessStore(a.cfg.DB, warlock.SessionBucket, 0, nil)
+	n, err := s.Purge(*all)
+	if err != nil {
+		return err
+	}
+	if a.asJSON {
+		return json.NewEncoder(a.stdout).Encode(map[string]int{"purged": n})
+	}
+	_, err = fmt.Fprintf(a.stdout, "purged %d sessions\n", n)
+	return err
+}
+
+// db backs up or restores the bolt database
+func (a *app) db(cmd string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: warlock db %s <file>", cmd)
+	}
+	switch cmd {
+	case "backup":
+		if args[0] == "-" {
+			_, err := warlock.Backup(a.cfg.DB, a.stdout)
+			return err
+		}
+		f, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		if _, err = warlock.Backup(a.cfg.DB, f); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	case "restore":
+		in := a.stdin
+		if args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+		if err := warlock.Restore(a.cfg.DB, in); err != nil {
+			return err
+		}
+		// recorded in the restored database, which is the log from now on
+		return a.audit("", warlock.AuditRestore, args[0])
+	}
+	return fmt.Errorf("unknown db command %q", cmd)
+}
+
+// schema reports or upgrades the schema version of the stored users and sessions
+func (a *app) schema(cmd string, args []string) error {
+	us, _, err := a.store()
+	if err != nil {
+		return err
+	}
+	out := map[string]int{}
+	switch cmd {
+	case "status":
+		v, err := us.AppliedVersion()
+		if err != nil {
+			return err
+		}
+		out["users_applied"] = v
+		out["users_current"] = warlock.SchemaVersion(warlock.KindUser)
+		out["sessions_current"] = warlock.SchemaVersion(warlock.KindSession)
+	case "migrate":
+		n, err := us.Migrate()
+		if err != nil {
+			return err
+		}
+		out["users_migrated"] = n
+		if a.cfg.SessStore == "" || a.cfg.SessStore == warlock.SessBolt {
+			s := warlock.NewSessStore(a.cfg.DB, warlock.SessionBucket, 0, nil)
+			if n, err = s.Migrate(); err != nil {
+				return err
+			}
+			out["sessions_migrated"] = n
+		}
+	default:
+		return fmt.Errorf("unknown schema command %q", cmd)
+	}
+	if a.asJSON {
+		return json.NewEncoder(a.stdout).Encode(out)
+	}
+	var lines []string
+	for k, v := range out {
+		lines = append(lines, fmt.Sprintf("%s: %d", strings.Replace(k, "_", " ", -1), v))
+	}
+	sort.Strings(lines)
+	_, err = fmt.Fprintln(a.stdout, strings.Join(lines, "\n"))
+	return err
+}
+
+func (a *app) keys(cmd string, args []string) error {
+	if cmd != "generate" {
+		return fmt.Errorf("unknown keys command %q", cmd)
+	}
+	k, err := warlock.GenerateKeyPair()
+	if err != nil {
+		return err
+	}
+	if a.asJSON {
+		return json.NewEncoder(a.stdout).Encode(k)
+	}
+	_, err = fmt.Fprintf(a.stdout, "hash:  %s\nblock: %s\n", k.Hash, k.Block)
+	return err
+}
+
+// checkBreached refuses passwords found in the configured breached passwords file
+func (a *app) checkBreached(pass string) error {
+	if a.cfg.BreachFile == "" {
+		return nil
+	}
+	b, err := warlock.OpenBreachList(a.cfg.BreachFile)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	n, err := b.Count(pass)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		if a.cfg.BreachAction == warlock.BreachWarn {
+			fmt.Fprintln(a.stdout, "warning: the password has appeared in a data breach")
+			return nil
+		}
+		return errors.New("the password has appeared in a data breach, choose another one")
+	}
+	return nil
+}
+
+func (a *app) readPassword() (string, error) {
+	line, err := bufio.NewReader(a.stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", errors.New("no password given")
+	}
+	return line, nil
+}
+
+func (a *app) printUsers(users ...*warlock.User) error {
+	if a.asJSON {
+		out := make([]*warlock.PublicUser, len(users))
+		for i, u := range users {
+			out[i] = u.Public()
+		}
+		enc := json.NewEncoder(a.stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	}
+	w := tabwriter.NewWriter(a.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "EMAIL\tUSERNAME\tNAME\tROLES\tLOCKED\tCREATED")
+	for _, u := range users {
+		fmt.Fprintf(w, "%s\t%s\t%s %s\t%s\t%v\t%s\n",
+			u.Email, u.Username, u.FirstName, u.LastName, strings.Join(u.Roles, ","),
+			u.Disabled, u.CreatedAt.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func (a *app) printOrgs(list ...*warlock.Organization) error {
+	if a.asJSON {
+		enc := json.NewEncoder(a.stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(list)
+	}
+	w := tabwriter.NewWriter(a.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tCREATED")
+	for _, org := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", org.ID, org.Name, org.CreatedAt.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func (a *app) printInvitations(list ...*warlock.Invitation) error {
+	out := make([]*warlock.PublicInvitation, len(list))
+	for i, inv := range list {
+		out[i] = inv.Public(a.cfg.RegisterPath)
+	}
+	if a.asJSON {
+		enc := json.NewEncoder(a.stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	}
+	w := tabwriter.NewWriter(a.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CODE\tINVITER\tEMAIL\tROLES\tUSES\tEXPIRES\tLINK")
+	for i, inv := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d/%d\t%s\t%s\n",
+			inv.Code, inv.Inviter, inv.Email, strings.Join(inv.Roles, ","),
+			inv.Uses, inv.MaxUses, inv.ExpiresAt.Format(time.RFC3339), out[i].Link)
+	}
+	return w.Flush()
+}
+
+func (a *app) printEmailReport(r *warlock.EmailReport, applied bool) error {
+	if a.asJSON {
+		return json.NewEncoder(a.stdout).Encode(r)
+	}
+	verb := "would rename"
+	if applied {
+		verb = "renamed"
+	}
+	var lines []string
+	for from, to := range r.Renamed {
+		lines = append(lines, fmt.Sprintf("%s %s to %s", verb, from, to))
+	}
+	for to, list := range r.Collisions {
+		lines = append(lines, fmt.Sprintf("collision on %s: %s", to, strings.Join(list, ", ")))
+	}
+	sort.Strings(lines)
+	for _, l := range lines {
+		fmt.Fprintln(a.stdout, l)
+	}
+	_, err := fmt.Fprintf(a.stdout, "%d to rename, %d collisions\n", len(r.Renamed), len(r.Collisions))
+	return err
+}
+
+func oneArg(cmd string, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("usage: warlock user %s <email>", cmd)
+	}
+	return args[0], nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func validationError(v map[string]string) error {
+	var msgs []string
+	for k, m := range v {
+		msgs = append(msgs, k+" "+m)
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
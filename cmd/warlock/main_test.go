@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gernest/warlock"
+	"github.com/gorilla/sessions"
+)
+
+func runCmd(t *testing.T, db, stdin string, args ...string) (string, error) {
+	var out bytes.Buffer
+	err := run(append([]string{"-db", db}, args...), strings.NewReader(stdin), &out)
+	return out.String(), err
+}
+
+// auditActions returns the actions recorded about subject, oldest first
+func auditActions(t *testing.T, db, subject string) string {
+	events, err := warlock.NewAuditStore(db, warlock.AuditBucket).Events(subject, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := make([]string, len(events))
+	for i, ev := range events {
+		actions[len(events)-1-i] = ev.Action
+	}
+	return strings.Join(actions, " ")
+}
+
+func TestUserCommands(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "cli.db")
+	email := "ops@example.com"
+
+	_, err := runCmd(t, db, "", "user", "create", "-email", email, "-first", "Ops",
+		"-last", "Team", "-password", "a-long-passphrase", "-roles", "admin,ops")
+	if err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	if _, err = runCmd(t, db, "", "user", "create", "-email", "bad@example.com", "-first", "Ops",
+		"-last", "Team", "-password", "short"); err == nil {
+		t.Error("Expected a policy error")
+	}
+
+	out, err := runCmd(t, db, "", "user", "list")
+	if err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	if !strings.Contains(out, email) || !strings.Contains(out, "admin,ops") {
+		t.Errorf("Expected the user in the table actual %s", out)
+	}
+	if out, _ = runCmd(t, db, "", "user", "list", "-role", "staff"); strings.Contains(out, email) {
+		t.Errorf("Expected no staff actual %s", out)
+	}
+
+	if _, err = runCmd(t, db, "", "user", "update", email, "-first", "Operator", "-roles", "ops"); err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	out, err = runCmd(t, db, "", "-json", "user", "show", email)
+	if err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	var users []warlock.PublicUser
+	if err = json.Unmarshal([]byte(out), &users); err != nil {
+		t.Fatalf("Expected json actual %v", err)
+	}
+	if len(users) != 1 || users[0].FirstName != "Operator" || len(users[0].Roles) != 1 {
+		t.Errorf("Expected updated user actual %+v", users)
+	}
+
+	if _, err = runCmd(t, db, "another-passphrase\n", "user", "passwd", email); err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	if _, err = runCmd(t, db, "", "user", "lock", email); err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	us := warlock.NewUserStore(db, warlock.UserBucket)
+	usr, err := us.GetUser(email)
+	if err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	if !usr.Disabled {
+		t.Error("Expected the account to be locked")
+	}
+	if err = usr.MatchPassword("another-passphrase"); err != nil {
+		t.Errorf("Expected the new password to match actual %v", err)
+	}
+
+	if _, err = runCmd(t, db, "", "user", "delete", email); err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	if _, err = runCmd(t, db, "", "user", "delete", email); err == nil {
+		t.Error("Expected an error deleting a missing user")
+	}
+
+	// every change is in the audit log
+	events, err := warlock.NewAuditStore(db, warlock.AuditBucket).Events(email, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, ev := range events {
+		if !strings.HasPrefix(ev.Actor, "cli") {
+			t.Errorf("Expected the cli as actor actual %s", ev.Actor)
+		}
+		actions = append([]string{ev.Action}, actions...)
+	}
+	expect := "create update set_password disable delete"
+	if got := strings.Join(actions, " "); got != expect {
+		t.Errorf("Expected %s actual %s", expect, got)
+	}
+	if ev := events[len(events)-2]; ev.Detail != "first=Operator roles=ops" {
+		t.Errorf("Expected the changed fields actual %q", ev.Detail)
+	}
+
+	// usage goes to stdout like for every other command
+	out, _ = runCmd(t, db, "", "user", "list", "-nope")
+	if !strings.Contains(out, "-role") {
+		t.Errorf("Expected the usage actual %q", out)
+	}
+}
+
+func TestUserCommands_denyList(t *testing.T) {
+	dir := t.TempDir()
+	db := filepath.Join(dir, "cli.db")
+	deny := filepath.Join(dir, "deny.txt")
+	if err := os.WriteFile(deny, []byte("# common\ncorrect horse battery\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := filepath.Join(dir, "warlock.json")
+	data := `{"password_policy":{"min_length":8,"deny_list_file":"` + deny + `"}}`
+	if err := os.WriteFile(cfg, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	email := "ops@example.com"
+
+	if _, err := runCmd(t, db, "", "-config", cfg, "user", "create", "-email", email, "-first", "Ops",
+		"-last", "Team", "-password", "Correct Horse Battery"); err == nil {
+		t.Error("Expected the denied password to be rejected")
+	}
+	if _, err := runCmd(t, db, "", "-config", cfg, "user", "create", "-email", email, "-first", "Ops",
+		"-last", "Team", "-password", "a-long-passphrase"); err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	if _, err := runCmd(t, db, "correct horse battery\n", "-config", cfg, "user", "passwd", email); err == nil {
+		t.Error("Expected the denied password to be rejected")
+	}
+}
+
+func TestSessionsPurgeAndKeys(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "cli.db")
+	store := warlock.NewSessStore(db, warlock.SessionBucket, 60, &sessions.Options{MaxAge: 60}, []byte("a-secret"))
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, _ := store.New(req, "_wrk")
+	if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	out, err := runCmd(t, db, "", "sessions", "purge")
+	if err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	if !strings.Contains(out, "purged 0 sessions") {
+		t.Errorf("Expected live sessions to be kept actual %s", out)
+	}
+	out, err = runCmd(t, db, "", "sessions", "purge", "-all")
+	if err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	if !strings.Contains(out, "purged 1 sessions") {
+		t.Errorf("Expected purge summary actual %s", out)
+	}
+	out, err = runCmd(t, db, "", "-json", "keys", "generate")
+	if err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	var k warlock.KeyPair
+	if err = json.Unmarshal([]byte(out), &k); err != nil || k.Hash == "" || k.Block == "" {
+		t.Errorf("Expected a key pair actual %s %v", out, err)
+	}
+	out, err = runCmd(t, db, "", "-json", "schema", "migrate")
+	if err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	if !strings.Contains(out, `"sessions_migrated":0`) {
+		t.Errorf("Expected the migration summary actual %s", out)
+	}
+	out, err = runCmd(t, db, "", "schema", "status")
+	if err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	if !strings.Contains(out, "users applied: 1") {
+		t.Errorf("Expected the applied version actual %s", out)
+	}
+	backup := filepath.Join(t.TempDir(), "backup.db")
+	if _, err = runCmd(t, db, "", "db", "backup", backup); err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	if _, err = runCmd(t, db, "", "db", "restore", backup); err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	actor := "cli"
+	if u, err := user.Current(); err == nil {
+		actor += ":" + u.Username
+	}
+	found := false
+	events, _ := warlock.NewAuditStore(db, warlock.AuditBucket).Events(actor, 0)
+	for _, ev := range events {
+		found = found || (ev.Action == warlock.AuditRestore && ev.Detail == backup)
+	}
+	if !found {
+		t.Errorf("Expected the restore in the audit log actual %+v", events)
+	}
+	if _, err = runCmd(t, db, "garbage", "db", "restore", "-"); err == nil {
+		t.Error("Expected an error restoring garbage")
+	}
+	if _, err = runCmd(t, db, "", "user", "frobnicate"); err == nil {
+		t.Error("Expected an error for an unknown command")
+	}
+}
+
+func TestInviteCommands(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "cli.db")
+
+	if _, err := runCmd(t, db, "", "invite", "create", "-email", "new@example.com"); err == nil {
+		t.Error("Expected an error without -inviter")
+	}
+	out, err := runCmd(t, db, "", "-json", "invite", "create", "-inviter", "ops@example.com",
+		"-email", "new@example.com", "-roles", "staff", "-max-uses", "3", "-ttl", "1h")
+	if err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	var invs []warlock.PublicInvitation
+	if err = json.Unmarshal([]byte(out), &invs); err != nil {
+		t.Fatalf("Expected json actual %v", err)
+	}
+	if len(invs) != 1 || invs[0].MaxUses != 3 || invs[0].Roles[0] != "staff" {
+		t.Fatalf("Expected the invitation actual %+v", invs)
+	}
+
+	out, err = runCmd(t, db, "", "invite", "list", "-inviter", "ops@example.com")
+	if err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	if !strings.Contains(out, invs[0].Code) || !strings.Contains(out, "0/3") {
+		t.Errorf("Expected the invitation in the table actual %s", out)
+	}
+
+	if _, err = runCmd(t, db, "", "invite", "revoke", invs[0].Code); err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	if _, err = runCmd(t, db, "", "invite", "revoke", invs[0].Code); err != warlock.ErrInviteNotFound {
+		t.Errorf("Expected %v actual %v", warlock.ErrInviteNotFound, err)
+	}
+	if got := auditActions(t, db, "ops@example.com"); got != "invite revoke_invite" {
+		t.Errorf("Expected invite revoke_invite actual %s", got)
+	}
+}
+
+func TestOrgCommands(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "cli.db")
+	if _, err := runCmd(t, db, "", "user", "create", "-email", "ops@example.com", "-first", "Ops",
+		"-last", "Team", "-password", "a-long-passphrase"); err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+
+	out, err := runCmd(t, db, "", "-json", "org", "create", "-name", "Acme", "-owner", "owner@example.com")
+	if err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	var orgs []warlock.Organization
+	if err = json.Unmarshal([]byte(out), &orgs); err != nil || len(orgs) != 1 {
+		t.Fatalf("Expected one organization actual %s %v", out, err)
+	}
+	id := orgs[0].ID
+
+	if _, err = runCmd(t, db, "", "org", "add", id, "nobody@example.com"); err == nil {
+		t.Error("Expected an error for an unknown user")
+	}
+	if _, err = runCmd(t, db, "", "org", "add", id, "ops@example.com", "-roles", "admin"); err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	out, err = runCmd(t, db, "", "org", "members", id)
+	if err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	if !strings.Contains(out, "ops@example.com") || !strings.Contains(out, "owner@example.com") {
+		t.Errorf("Expected both members actual %s", out)
+	}
+	if out, _ = runCmd(t, db, "", "org", "list", "-user", "ops@example.com"); !strings.Contains(out, "Acme") {
+		t.Errorf("Expected Acme actual %s", out)
+	}
+	if _, err = runCmd(t, db, "", "org", "remove", id, "owner@example.com"); err != warlock.ErrLastOwner {
+		t.Errorf("Expected %v actual %v", warlock.ErrLastOwner, err)
+	}
+
+	// Deleting the user drops the membership
+	if _, err = runCmd(t, db, "", "user", "delete", "ops@example.com"); err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	if out, _ = runCmd(t, db, "", "org", "members", id); strings.Contains(out, "ops@example.com") {
+		t.Errorf("Expected no ops member actual %s", out)
+	}
+	if _, err = runCmd(t, db, "", "org", "delete", id); err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	if got := auditActions(t, db, "owner@example.com"); got != "join_org leave_org" {
+		t.Errorf("Expected join_org leave_org actual %s", got)
+	}
+	actor := "cli"
+	if u, err := user.Current(); err == nil {
+		actor += ":" + u.Username
+	}
+	if got := auditActions(t, db, actor); !strings.HasSuffix(got, "delete_org") {
+		t.Errorf("Expected delete_org actual %s", got)
+	}
+}
+
+func TestWebhookCommands(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "cli.db")
+	if _, err := runCmd(t, db, "", "webhooks", "list"); err == nil {
+		t.Error("Expected an error without webhooks")
+	}
+
+	var got []string
+	rs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get(warlock.WebhookEventHeader))
+	}))
+	defer rs.Close()
+	t.Setenv("WARLOCK_WEBHOOKS", `[{"url":"`+rs.URL+`","secret":"s"}]`)
+
+	if _, err := runCmd(t, db, "", "user", "create", "-email", "ops@example.com", "-first", "Ops",
+		"-last", "Team", "-password", "a-long-passphrase"); err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	if _, err := runCmd(t, db, "", "user", "passwd", "ops@example.com", "-password", "another-long-passphrase"); err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	out, err := runCmd(t, db, "", "webhooks", "list")
+	if err != nil {
+		t.Fatalf("Expected nil actual %v", err)
+	}
+	if !strings.Contains(out, warlock.EventUserCreated) || !strings.Contains(out, warlock.EventPasswordChanged) {
+		t.Errorf("Expected both events pending actual %s", out)
+	}
+	if out, err = runCmd(t, db, "", "webhooks", "deliver"); err != nil || !strings.Contains(out, "delivered 2") {
+		t.Errorf("Expected 2 deliveries actual %s %v", out, err)
+	}
+	if strings.Join(got, ",") != warlock.EventUserCreated+","+warlock.EventPasswordChanged {
+		t.Errorf("Expected created and password events actual %v", got)
+	}
+}
@@ -0,0 +1,324 @@
+package warlock
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/gorilla/sessions"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of environment variables overriding configuration values, the
+// rest of the name is the upper cased json key like WARLOCK_SESSION_MAX_AGE. Nested values
+// join the keys with an underscore, like WARLOCK_PASSWORD_POLICY_MIN_LENGTH, and lists are
+// given as json, like WARLOCK_KEYS='[{"hash":"..."}]'.
+const EnvPrefix = "WARLOCK_"
+
+// Supported values for Config.SessSameSite
+const (
+	SameSiteLax    = "lax"
+	SameSiteStrict = "strict"
+	SameSiteNone   = "none"
+)
+
+// minSecretLen is the shortest secret accepted outside of development mode
+const minSecretLen = 32
+
+// ConfigError lists every problem found while validating a configuration
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return "warlock: invalid config: " + strings.Join(e, "; ")
+}
+
+// Validate checks the configuration for insecure or nonsensical settings. Outside of
+// development mode the sample secret, short secrets and cookies allowed over plain http
+// are refused; in development mode they are only logged as warnings.
+func (c *Config) Validate() error {
+	errs, warnings := c.check()
+	for _, w := range warnings {
+		log.Println("warlock: WARNING: " + w + " (allowed because dev_mode is on, never use this in production)")
+	}
+	if len(errs) > 0 {
+		return ConfigError(errs)
+	}
+	return nil
+}
+
+// check returns the problems which are always fatal and the ones which are tolerated in
+// development mode
+func (c *Config) check() (errs, insecure []string) {
+	for i, k := range c.Keys {
+		h, b, err := k.Decode()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("keys[%d]: %v", i, err))
+			continue
+		}
+		if len(h) < minSecretLen {
+			insecure = append(insecure, fmt.Sprintf("keys[%d]: hash key is shorter than %d bytes", i, minSecretLen))
+		}
+		// the cookie store keeps the session values in the cookie itself, they would be
+		// readable by anyone without a block key
+		if b == nil && c.SessStore == SessCookie {
+			errs = append(errs, fmt.Sprintf("keys[%d]: block key is required by the cookie session store", i))
+		}
+	}
+	usesSecret := len(c.Keys) == 0 || (c.Secret != "" && c.Secret != defaultSecret)
+	switch {
+	case !usesSecret:
+	case c.Secret == "":
+		errs = append(errs, "no secret or keys configured")
+	case c.Secret == defaultSecret:
+		insecure = append(insecure, "the sample secret is used to sign cookies")
+	case len(c.Secret) < minSecretLen:
+		insecure = append(insecure, fmt.Sprintf("secret is shorter than %d bytes", minSecretLen))
+	}
+	if c.SessSecure != nil && !*c.SessSecure {
+		insecure = append(insecure, "session cookies are sent over plain http")
+	}
+	if c.SessHTTPOnly != nil && !*c.SessHTTPOnly {
+		insecure = append(insecure, "session cookies are readable by javascript")
+	}
+	switch c.SessSameSite {
+	case "", SameSiteLax, SameSiteStrict:
+	case SameSiteNone:
+		if !c.secureCookies() {
+			errs = append(errs, "session_same_site none requires secure cookies")
+		}
+	default:
+		errs = append(errs, "unknown session_same_site "+c.SessSameSite)
+	}
+	if c.SessMaxAge <= 0 {
+		errs = append(errs, fmt.Sprintf("session_max_age must be positive, got %d", c.SessMaxAge))
+	}
+	switch c.SessStore {
+	case "", SessBolt, SessMemory, SessCookie, SessFilesystem:
+	default:
+		errs = append(errs, "unknown session_store "+c.SessStore)
+	}
+	if (c.SessStore == "" || c.SessStore == SessBolt) && c.DB == "" {
+		errs = append(errs, "db is required by the bolt session store")
+	}
+	if c.HashCost < 0 {
+		errs = append(errs, fmt.Sprintf("hash_cost must be positive, got %d", c.HashCost))
+	} else if _, err := NewHasher(c.Hasher, c.HashCost); err != nil {
+		errs = append(errs, err.Error())
+	}
+	switch c.BreachAction {
+	case "", BreachReject, BreachWarn:
+	default:
+		errs = append(errs, "unknown breach_action "+c.BreachAction)
+	}
+	if p := c.PasswordPolicy; p != nil && p.MaxLength > 0 && p.MaxLength < p.MinLength {
+		errs = append(errs, "password_policy max_length is shorter than min_length")
+	}
+	if c.InviteMaxAge < 0 {
+		errs = append(errs, fmt.Sprintf("invite_max_age must be positive, got %d", c.InviteMaxAge))
+	}
+	if c.WebhookMaxAttempts < 0 {
+		errs = append(errs, fmt.Sprintf("webhook_max_attempts must be positive, got %d", c.WebhookMaxAttempts))
+	}
+	errs = append(errs, checkWebhooks(c.Webhooks)...)
+	if c.AdminPageSize < 0 {
+		errs = append(errs, fmt.Sprintf("admin_page_size must be positive, got %d", c.AdminPageSize))
+	}
+	if !c.DevMode {
+		errs = append(errs, insecure...)
+		insecure = nil
+	}
+	return errs, insecure
+}
+
+// cookieOptions returns the attributes shared by every cookie warlock sets, the session
+// cookie as well as the one expiring it on logout
+func (c *Config) cookieOptions() *sessions.Options {
+	opts := &sessions.Options{
+		Path:     c.SessPath,
+		Domain:   c.SessDomain,
+		MaxAge:   c.SessMaxAge,
+		Secure:   c.secureCookies(),
+		HttpOnly: c.SessHTTPOnly == nil || *c.SessHTTPOnly,
+	}
+	switch c.SessSameSite {
+	case "", SameSiteLax:
+		opts.SameSite = http.SameSiteLaxMode
+	case SameSiteStrict:
+		opts.SameSite = http.SameSiteStrictMode
+	case SameSiteNone:
+		opts.SameSite = http.SameSiteNoneMode
+	}
+	return opts
+}
+
+// secureCookies reports whether cookies must only be sent over https, they are unless
+// it is turned off explicitly or development mode is on
+func (c *Config) secureCookies() bool {
+	if c.SessSecure != nil {
+		return *c.SessSecure
+	}
+	return !c.DevMode
+}
+
+// LoadConfig reads the configuration file at path and applies overrides from WARLOCK_*
+// environment variables. Values in the file take precedence over the defaults and the
+// environment takes precedence over the file. The format is picked from the extension,
+// .json, .yaml, .yml or .toml, and keys unknown to Config are reported as errors. An empty
+// path loads the defaults and the environment only.
+func LoadConfig(path string) (*Config, error) {
+	c := defaultConfig()
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err = decodeConfig(c, filepath.Ext(path), data); err != nil {
+			return nil, fmt.Errorf("warlock: %s: %v", path, err)
+		}
+	}
+	if err := applyEnv(c, os.Environ()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// decodeConfig decodes data on top of c. Yaml and toml documents are converted to json
+// first so that Config only needs json tags.
+func decodeConfig(c *Config, ext string, data []byte) error {
+	switch strings.ToLower(ext) {
+	case ".json":
+	case ".yaml", ".yml":
+		var m map[string]interface{}
+		if err := yaml.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		data = b
+	case ".toml":
+		var m map[string]interface{}
+		if err := toml.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		data = b
+	default:
+		return fmt.Errorf("unknown config format %q, use .json, .yaml, .yml or .toml", ext)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(c)
+}
+
+// applyEnv sets the fields named by WARLOCK_* variables in env, variables which do not
+// name a field are reported as errors
+func applyEnv(c *Config, env []string) error {
+	setters := make(map[string]func(string) error)
+	envFields(func() reflect.Value { return reflect.ValueOf(c).Elem() }, reflect.TypeOf(*c), EnvPrefix, setters)
+	var unknown []string
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, EnvPrefix) {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			continue
+		}
+		name, value := kv[:i], kv[i+1:]
+		set, ok := setters[name]
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		if err := set(value); err != nil {
+			return fmt.Errorf("warlock: %s: %v", name, err)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return errors.New("warlock: unknown environment variables " + strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// envFields registers a setter for every field of the struct type t under its environment
+// variable name. The struct is reached through get so that nested struct pointers are only
+// allocated when one of their fields is set.
+func envFields(get func() reflect.Value, t reflect.Type, prefix string, setters map[string]func(string) error) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if sf.PkgPath != "" || tag == "" || tag == "-" {
+			continue
+		}
+		i, name := i, prefix+strings.ToUpper(tag)
+		field := func() reflect.Value { return get().Field(i) }
+		setters[name] = func(value string) error {
+			return setField(field(), value)
+		}
+		if sf.Type.Kind() == reflect.Ptr && sf.Type.Elem().Kind() == reflect.Struct {
+			elem := func() reflect.Value {
+				f := field()
+				if f.IsNil() {
+					f.Set(reflect.New(f.Type().Elem()))
+				}
+				return f.Elem()
+			}
+			envFields(elem, sf.Type.Elem(), name+"_", setters)
+		}
+	}
+}
+
+// setField parses value according to the kind of f, kinds without a plain text form like
+// slices and structs are parsed as json
+func setField(f reflect.Value, value string) error {
+	if f.Kind() == reflect.Ptr && f.Type().Elem().Kind() != reflect.Struct {
+		p := reflect.New(f.Type().Elem())
+		if err := setField(p.Elem(), value); err != nil {
+			return err
+		}
+		f.Set(p)
+		return nil
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		f.SetFloat(n)
+	default:
+		return json.Unmarshal([]byte(value), f.Addr().Interface())
+	}
+	return nil
+}
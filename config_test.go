@@ -0,0 +1,252 @@
+package warlock
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var goodSecret = "0123456789abcdef0123456789abcdef"
+
+func TestConfig_Validate(t *testing.T) {
+	insecure := false
+	short, _ := GenerateKeyPair()
+	goodKey, _ := GenerateKeyPair()
+	short.Hash = "c2hvcnQ="
+	sample := []struct {
+		cfg    *Config
+		ok     bool
+		reason string
+	}{
+		{&Config{}, false, "sample secret"},
+		{&Config{DevMode: true}, true, ""},
+		{&Config{Secret: goodSecret}, true, ""},
+		{&Config{Secret: "short"}, false, "shorter than"},
+		{&Config{Secret: goodSecret, SessSecure: &insecure}, false, "plain http"},
+		{&Config{Secret: goodSecret, SessSecure: &insecure, DevMode: true}, true, ""},
+		{&Config{Secret: goodSecret, SessMaxAge: -1}, false, "session_max_age"},
+		{&Config{Secret: goodSecret, SessStore: "redis"}, false, "session_store"},
+		{&Config{Secret: goodSecret, Hasher: "md5"}, false, "hasher"},
+		{&Config{Secret: goodSecret, HashCost: -1}, false, "hash_cost"},
+		{&Config{Secret: goodSecret, Hasher: HashScrypt, HashCost: 264}, false, "scrypt cost"},
+		{&Config{Secret: goodSecret, BreachAction: "ignore"}, false, "breach_action"},
+		{&Config{Keys: []KeyPair{short}}, false, "hash key"},
+		{&Config{Keys: []KeyPair{{Hash: goodKey.Hash}}}, true, ""},
+		{&Config{Keys: []KeyPair{{Hash: goodKey.Hash}}, SessStore: SessCookie, DevMode: true}, false, "block key is required"},
+		{&Config{Keys: []KeyPair{goodKey}, SessStore: SessCookie}, true, ""},
+		{&Config{Keys: []KeyPair{{Hash: "%%%"}}, DevMode: true}, false, "keys[0]"},
+		{&Config{Secret: goodSecret, Webhooks: []WebhookEndpoint{{URL: "https://crm.example.com/hook"}}}, false, "secret is required"},
+		{&Config{Secret: goodSecret, Webhooks: []WebhookEndpoint{{URL: "crm.example.com", Secret: "s"}}}, false, "webhooks[0]: url"},
+	}
+	for _, v := range sample {
+		c := NewConfig(v.cfg)
+		err := c.Validate()
+		if (err == nil) != v.ok {
+			t.Errorf("Expected ok=%v for %+v actual %v", v.ok, v.cfg, err)
+			continue
+		}
+		if err != nil && !strings.Contains(err.Error(), v.reason) {
+			t.Errorf("Expected %s to mention %s", err, v.reason)
+		}
+	}
+
+	// generated keys make the sample secret irrelevant
+	k, _ := GenerateKeyPair()
+	if err := NewConfig(&Config{Keys: []KeyPair{k}}).Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConfig_secureCookies(t *testing.T) {
+	c := NewConfig(&Config{Secret: goodSecret})
+	if !c.secureCookies() {
+		t.Errorf("Expected true actual %v", c.secureCookies())
+	}
+	c.DevMode = true
+	if c.secureCookies() {
+		t.Errorf("Expected false actual %v", c.secureCookies())
+	}
+}
+
+func TestYoungWarlock_defaultSecret(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected YoungWarlock to refuse the sample secret")
+		}
+	}()
+	YoungWarlock(&Config{DB: "warlock_test.db"})
+}
+
+func writeConfigFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := []string{
+		writeConfigFile(t, dir, "warlock.json", `{
+	"db": "chaos.db",
+	"session_max_age": 3600,
+	"dev_mode": true,
+	"password_policy": {"min_length": 12}
+}`),
+		writeConfigFile(t, dir, "warlock.yaml", `
+db: chaos.db
+session_max_age: 3600
+dev_mode: true
+password_policy:
+  min_length: 12
+`),
+		writeConfigFile(t, dir, "warlock.toml", `
+db = "chaos.db"
+session_max_age = 3600
+dev_mode = true
+
+[password_policy]
+min_length = 12
+`),
+	}
+	for _, f := range files {
+		c, err := LoadConfig(f)
+		if err != nil {
+			t.Errorf("%s: %v", f, err)
+			continue
+		}
+		if c.DB != "chaos.db" || c.SessMaxAge != 3600 || !c.DevMode {
+			t.Errorf("%s: Expected values from the file actual %+v", f, c)
+		}
+		if c.PasswordPolicy.MinLength != 12 {
+			t.Errorf("%s: Expected 12 actual %d", f, c.PasswordPolicy.MinLength)
+		}
+
+		// defaults fill the rest
+		if c.SessName != "_wrk" || c.PasswordPolicy.MaxLength != 128 {
+			t.Errorf("%s: Expected defaults to be kept actual %+v", f, c)
+		}
+	}
+
+	bad := []string{
+		writeConfigFile(t, dir, "unknown.json", `{"db": "chaos.db", "sesion_max_age": 10}`),
+		writeConfigFile(t, dir, "unknown.yml", "password_policy:\n  min_lenght: 3\n"),
+		writeConfigFile(t, dir, "unknown.toml", `datbase = "chaos.db"`),
+		writeConfigFile(t, dir, "warlock.ini", `db = chaos.db`),
+		filepath.Join(dir, "missing.json"),
+	}
+	for _, f := range bad {
+		if _, err := LoadConfig(f); err == nil {
+			t.Errorf("Expected an error loading %s", f)
+		}
+	}
+}
+
+func TestLoadConfig_env(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := writeConfigFile(t, dir, "warlock.json", `{"db": "chaos.db", "session_name": "_file"}`)
+	k, _ := GenerateKeyPair()
+	env := map[string]string{
+		"WARLOCK_SESSION_NAME":                  "_env",
+		"WARLOCK_SESSION_SECURE":                "false",
+		"WARLOCK_PASSWORD_POLICY_REQUIRE_UPPER": "true",
+		"WARLOCK_KEYS":                          `[{"hash":"` + k.Hash + `","block":"` + k.Block + `"}]`,
+	}
+	for key, v := range env {
+		os.Setenv(key, v)
+		defer os.Unsetenv(key)
+	}
+	c, err := LoadConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.DB != "chaos.db" {
+		t.Errorf("Expected chaos.db actual %s", c.DB)
+	}
+	if c.SessName != "_env" {
+		t.Errorf("Expected the environment to win actual %s", c.SessName)
+	}
+	if c.SessSecure == nil || *c.SessSecure {
+		t.Errorf("Expected session_secure to be false actual %v", c.SessSecure)
+	}
+	if !c.PasswordPolicy.RequireUpper {
+		t.Errorf("Expected true actual %v", c.PasswordPolicy.RequireUpper)
+	}
+	if len(c.Keys) != 1 || c.Keys[0] != k {
+		t.Errorf("Expected %v actual %v", k, c.Keys)
+	}
+
+	os.Setenv("WARLOCK_SESSION_MAXAGE", "10")
+	defer os.Unsetenv("WARLOCK_SESSION_MAXAGE")
+	if _, err = LoadConfig(f); err == nil || !strings.Contains(err.Error(), "WARLOCK_SESSION_MAXAGE") {
+		t.Errorf("Expected an error naming WARLOCK_SESSION_MAXAGE actual %v", err)
+	}
+	os.Unsetenv("WARLOCK_SESSION_MAXAGE")
+	os.Setenv("WARLOCK_SESSION_MAX_AGE", "ten")
+	defer os.Unsetenv("WARLOCK_SESSION_MAX_AGE")
+	if _, err = LoadConfig(f); err == nil {
+		t.Error("Expected an error parsing ten as a number")
+	}
+}
+
+func TestApplyEnv_nilPolicy(t *testing.T) {
+	c := &Config{}
+	if err := applyEnv(c, []string{"WARLOCK_DB=chaos.db"}); err != nil {
+		t.Fatal(err)
+	}
+	if c.PasswordPolicy != nil {
+		t.Errorf("Expected nil actual %v", c.PasswordPolicy)
+	}
+	if err := applyEnv(c, []string{"WARLOCK_PASSWORD_POLICY_MIN_LENGTH=4"}); err != nil {
+		t.Fatal(err)
+	}
+	if c.PasswordPolicy == nil || c.PasswordPolicy.MinLength != 4 {
+		t.Errorf("Expected min_length 4 actual %v", c.PasswordPolicy)
+	}
+}
+
+func TestConfig_cookieOptions(t *testing.T) {
+	c := NewConfig(&Config{Secret: goodSecret, SessDomain: "example.com"})
+	opts := c.cookieOptions()
+	if !opts.Secure || !opts.HttpOnly || opts.SameSite != http.SameSiteLaxMode {
+		t.Errorf("Expected secure defaults actual %+v", opts)
+	}
+	if opts.Domain != "example.com" || opts.Path != "/" || opts.MaxAge != 30 {
+		t.Errorf("Expected values from the config actual %+v", opts)
+	}
+	off := false
+	c = NewConfig(&Config{Secret: goodSecret, SessHTTPOnly: &off, SessSameSite: SameSiteStrict})
+	opts = c.cookieOptions()
+	if opts.HttpOnly || opts.SameSite != http.SameSiteStrictMode {
+		t.Errorf("Expected overrides actual %+v", opts)
+	}
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "javascript") {
+		t.Errorf("Expected an error about http only actual %v", err)
+	}
+
+	sample := []struct {
+		cfg    *Config
+		reason string
+	}{
+		{&Config{Secret: goodSecret, SessSameSite: "loose"}, "session_same_site"},
+		{&Config{DevMode: true, SessSameSite: SameSiteNone}, "requires secure"},
+	}
+	for _, v := range sample {
+		err := NewConfig(v.cfg).Validate()
+		if err == nil || !strings.Contains(err.Error(), v.reason) {
+			t.Errorf("Expected an error about %s actual %v", v.reason, err)
+		}
+	}
+}
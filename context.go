@@ -0,0 +1,73 @@
+package warlock
+
+import (
+	"context"
+
+	"github.com/gorilla/sessions"
+)
+
+// contextKey is unexported so that values stored by warlock can not collide with
+// keys defined by other packages
+type contextKey int
+
+const (
+	userKey contextKey = iota
+	sessionKey
+	orgKey
+	impersonatorKey
+)
+
+// WithUser returns a copy of ctx carrying usr
+func WithUser(ctx context.Context, usr *User) context.Context {
+	return context.WithValue(ctx, userKey, usr)
+}
+
+// CurrentUser returns the user stored in ctx by SessionMiddleware
+func CurrentUser(ctx context.Context) (*User, bool) {
+	usr, ok := ctx.Value(userKey).(*User)
+	return usr, ok && usr != nil
+}
+
+// WithSession returns a copy of ctx carrying the session of the current user
+func WithSession(ctx context.Context, ss *sessions.Session) context.Context {
+	return context.WithValue(ctx, sessionKey, ss)
+}
+
+// CurrentSession returns the session stored in ctx by SessionMiddleware
+func CurrentSession(ctx context.Context) (*sessions.Session, bool) {
+	ss, ok := ctx.Value(sessionKey).(*sessions.Session)
+	return ss, ok && ss != nil
+}
+
+// currentOrg is the organization stored in a context along with the membership of the user
+type currentOrg struct {
+	org *Organization
+	m   *Membership
+}
+
+// WithOrg returns a copy of ctx carrying the current organization and the membership of
+// the user in it
+func WithOrg(ctx context.Context, org *Organization, m *Membership) context.Context {
+	return context.WithValue(ctx, orgKey, currentOrg{org: org, m: m})
+}
+
+// CurrentOrg returns the organization and membership stored in ctx by SessionMiddleware
+func CurrentOrg(ctx context.Context) (*Organization, *Membership, bool) {
+	c, ok := ctx.Value(orgKey).(currentOrg)
+	if !ok || c.org == nil || c.m == nil {
+		return nil, nil, false
+	}
+	return c.org, c.m, true
+}
+
+// WithImpersonator returns a copy of ctx carrying the admin impersonating the current user
+func WithImpersonator(ctx context.Context, admin *User) context.Context {
+	return context.WithValue(ctx, impersonatorKey, admin)
+}
+
+// CurrentImpersonator returns the admin stored in ctx by SessionMiddleware when the current
+// user is being impersonated
+func CurrentImpersonator(ctx context.Context) (*User, bool) {
+	usr, ok := ctx.Value(impersonatorKey).(*User)
+	return usr, ok && usr != nil
+}
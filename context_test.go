@@ -0,0 +1,66 @@
+package warlock
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestContext_user(t *testing.T) {
+	ctx := context.Background()
+	if _, ok := CurrentUser(ctx); ok {
+		t.Errorf("Expected false actual %v", ok)
+	}
+	usr := &User{Email: "gernest@home.com"}
+	u, ok := CurrentUser(WithUser(ctx, usr))
+	if !ok {
+		t.Errorf("Expected true actual %v", ok)
+	}
+	if u != usr {
+		t.Errorf("Expected %v actual %v", usr, u)
+	}
+	if _, ok = CurrentUser(WithUser(ctx, nil)); ok {
+		t.Errorf("Expected false actual %v", ok)
+	}
+
+	// values stored under a plain string key must not leak in
+	ctx = context.WithValue(ctx, "user", usr)
+	if _, ok = CurrentUser(ctx); ok {
+		t.Errorf("Expected false actual %v", ok)
+	}
+}
+
+func TestContext_session(t *testing.T) {
+	ctx := context.Background()
+	if _, ok := CurrentSession(ctx); ok {
+		t.Errorf("Expected false actual %v", ok)
+	}
+	ss := sessions.NewSession(nil, "_wrk")
+	s, ok := CurrentSession(WithSession(ctx, ss))
+	if !ok {
+		t.Errorf("Expected true actual %v", ok)
+	}
+	if s != ss {
+		t.Errorf("Expected %v actual %v", ss, s)
+	}
+}
+
+func TestContext_org(t *testing.T) {
+	ctx := context.Background()
+	if _, _, ok := CurrentOrg(ctx); ok {
+		t.Errorf("Expected false actual %v", ok)
+	}
+	org := &Organization{ID: "1", Name: "acme"}
+	m := &Membership{OrgID: "1", Email: "gernest@home.com", Roles: []string{OrgRoleOwner}}
+	o, mm, ok := CurrentOrg(WithOrg(ctx, org, m))
+	if !ok {
+		t.Errorf("Expected true actual %v", ok)
+	}
+	if o != org || mm != m {
+		t.Errorf("Expected %v %v actual %v %v", org, m, o, mm)
+	}
+	if _, _, ok = CurrentOrg(WithOrg(ctx, org, nil)); ok {
+		t.Errorf("Expected false actual %v", ok)
+	}
+}
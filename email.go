@@ -0,0 +1,56 @@
+package warlock
+
+import (
+	"sort"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// NormalizeEmail returns the form emails are stored and looked up under, surrounding
+// whitespace is removed and the address is lower cased in Unicode NFC so "Me@Me.com" and
+// " me@me.com" are the same account.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(norm.NFC.String(strings.TrimSpace(email)))
+}
+
+// normalizeUser stores the email as typed in DisplayEmail, unless one is already set, and
+// normalizes Email
+func normalizeUser(usr *User) {
+	if usr.DisplayEmail == "" {
+		usr.DisplayEmail = strings.TrimSpace(usr.Email)
+	}
+	usr.Email = NormalizeEmail(usr.Email)
+}
+
+// EmailReport is the outcome of normalizing the emails of users stored before emails were
+// normalized
+type EmailReport struct {
+	// Renamed maps stored emails to their normalized form, the records are only moved
+	// when the migration is applied
+	Renamed map[string]string
+
+	// Collisions maps normalized emails to the stored emails sharing it, these accounts
+	// are left untouched and have to be merged or renamed by hand
+	Collisions map[string][]string
+}
+
+// planEmails works out which of the stored emails can be renamed and which collide
+func planEmails(stored []string) *EmailReport {
+	groups := make(map[string][]string)
+	for _, e := range stored {
+		n := NormalizeEmail(e)
+		groups[n] = append(groups[n], e)
+	}
+	r := &EmailReport{Renamed: make(map[string]string), Collisions: make(map[string][]string)}
+	for n, list := range groups {
+		switch {
+		case len(list) > 1:
+			sort.Strings(list)
+			r.Collisions[n] = list
+		case list[0] != n:
+			r.Renamed[list[0]] = n
+		}
+	}
+	return r
+}
@@ -0,0 +1,135 @@
+package warlock
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	sample := []struct {
+		email, normal string
+	}{
+		{"me@me.com", "me@me.com"},
+		{" Me@Me.COM\n", "me@me.com"},
+		{"Zé@me.com", "zé@me.com"},
+	}
+	for _, v := range sample {
+		if n := NormalizeEmail(v.email); n != v.normal {
+			t.Errorf("Expected %q actual %q", v.normal, n)
+		}
+	}
+}
+
+func TestUserStore_normalizedEmail(t *testing.T) {
+	ns := NewUserStore("normal.db", "account")
+	defer ns.store.DeleteDatabase()
+	usr := &User{Email: " Me@Me.com"}
+	if err := ns.CreateUser(usr); err != nil {
+		t.Fatal(err)
+	}
+	if usr.Email != "me@me.com" || usr.DisplayEmail != "Me@Me.com" {
+		t.Errorf("Expected me@me.com and Me@Me.com actual %s %s", usr.Email, usr.DisplayEmail)
+	}
+	if err := ns.CreateUser(&User{Email: "ME@me.com"}); err != ErrUserExists {
+		t.Errorf("Expected %v actual %v", ErrUserExists, err)
+	}
+	if _, err := ns.GetUser("mE@ME.com"); err != nil {
+		t.Errorf("Expected nil actual %v", err)
+	}
+	if !ns.Exist(&User{Email: "ME@ME.COM "}) {
+		t.Error("Expected true actual false")
+	}
+}
+
+func TestUserStore_NormalizeEmails(t *testing.T) {
+	ns := NewUserStore("normalize.db", "account")
+	defer ns.store.DeleteDatabase()
+	if err := ns.CreateUser(&User{Email: "ok@me.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// write the records back under their raw emails, like older versions did
+	db, err := bolt.Open("normalize.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("account"))
+		for i, e := range []string{"Alone@Me.com", "Twin@me.com", "twin@ME.com"} {
+			if err := b.Put([]byte(e), []byte(fmt.Sprintf(`{"ID":"%d","Email":%q}`, i, e))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := ns.NormalizeEmails(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Renamed["Alone@Me.com"] != "alone@me.com" || len(report.Renamed) != 1 {
+		t.Errorf("Expected one rename actual %v", report.Renamed)
+	}
+	if len(report.Collisions["twin@me.com"]) != 2 || len(report.Collisions) != 1 {
+		t.Errorf("Expected one collision actual %v", report.Collisions)
+	}
+	if _, err = ns.GetUser("alone@me.com"); err != ErrUserNotFound {
+		t.Errorf("Expected nothing to change actual %v", err)
+	}
+
+	if _, err = ns.NormalizeEmails(true); err != nil {
+		t.Fatal(err)
+	}
+	usr, err := ns.GetUser("alone@me.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usr.DisplayEmail != "Alone@Me.com" {
+		t.Errorf("Expected Alone@Me.com actual %s", usr.DisplayEmail)
+	}
+	if report, _ = ns.NormalizeEmails(false); len(report.Renamed) != 0 || len(report.Collisions) != 1 {
+		t.Errorf("Expected only the collision to remain actual %v", report)
+	}
+}
+
+func TestHandlers_normalizedEmail(t *testing.T) {
+	ts, client, _ := testServer(t)
+	defer ts.Close()
+	defer cleanUp("warlock_test.db")
+
+	body := `{"first_name":"young","last_name":"warlock","email":"%s","password":"open sesame 42","confirm_password":"open sesame 42"}`
+	res, m, err := postJSON(client, ts.URL+rPath, fmt.Sprintf(body, "Me@Me.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected %d actual %d", http.StatusCreated, res.StatusCode)
+	}
+	if u, _ := m["user"].(map[string]interface{}); u["email"] != "me@me.com" || u["display_email"] != "Me@Me.com" {
+		t.Errorf("Expected the normalized and display emails actual %v", m)
+	}
+	res, _, err = postJSON(client, ts.URL+rPath, fmt.Sprintf(body, "me@me.COM"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("Expected %d actual %d", http.StatusConflict, res.StatusCode)
+	}
+
+	client.Jar, _ = cookiejar.New(nil)
+	res, _, err = postJSON(client, ts.URL+lPath, `{"Email":" ME@me.com","Password":"open sesame 42"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected %d actual %d", http.StatusOK, res.StatusCode)
+	}
+}
@@ -1,28 +1,46 @@
 package warlock
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/gernest/render"
-	"github.com/gorilla/context"
 	"github.com/gorilla/sessions"
-	"github.com/monoculum/formam"
 )
 
 // Handlers contains set http facing auth methods
 type Handlers struct {
 	rendr  *render.Render
-	sess   Sess
-	ustore UserStore
+	sess   SessionStore
+	ustore UserStorer
+	hasher Hasher
+	breach *BreachList
 	cfg    *Config
+
+	auditLog AuditStorer
+	invites  InviteStore
+	orgs     OrgStore
+	hooks    hooks
+	webhooks *WebhookQueue
 }
 
-// YoungWarlock initialize and returns a ready to use handler it can be used without any arguments
+// YoungWarlock initialize and returns a ready to use handler. It needs a *Config with a
+// Secret or Keys to sign the session cookies, or with DevMode set which tolerates the
+// sample secret while developing. It also accepts render.Options, *render.Render, a
+// UserStorer, a SessionStore and an AuditStorer, users and the audit log are kept in bolt
+// when no store is given and the session backend is picked from Config.SessStore when no
+// SessionStore is given. It panics when the configuration does not pass Config.Validate,
+// or when the password deny list or breached passwords file can not be loaded.
 func YoungWarlock(args ...interface{}) *Handlers {
 	var opts render.Options
 	var cfg *Config
 	var rendr *render.Render
+	var ustore UserStorer
+	var sess SessionStore
+	var audit AuditStorer
 
 	for _, v := range args {
 		switch t := v.(type) {
@@ -32,54 +50,201 @@ func YoungWarlock(args ...interface{}) *Handlers {
 			cfg = t
 		case *render.Render:
 			rendr = t
-
+		case UserStorer:
+			ustore = t
+		case SessionStore:
+			sess = t
+		case AuditStorer:
+			audit = t
 		}
 	}
-	return warlock(opts, cfg, rendr)
+	return warlock(opts, cfg, rendr, ustore, sess, audit)
 }
 
-func warlock(opts render.Options, cfg *Config, r *render.Render) *Handlers {
+func warlock(opts render.Options, cfg *Config, r *render.Render, us UserStorer, ss SessionStore, as AuditStorer) *Handlers {
 	var rendr *render.Render
 	c := NewConfig(cfg)
-	opt := &sessions.Options{MaxAge: c.SessMaxAge, Path: c.SessPath}
+	if err := c.Validate(); err != nil {
+		panic(err)
+	}
+	opt := c.cookieOptions()
 	rendr = render.New(opts)
 	if r != nil {
 		rendr = r
 	}
+	hasher, err := NewHasher(c.Hasher, c.HashCost)
+	if err != nil {
+		panic(err)
+	}
+	if p := c.PasswordPolicy; p != nil && p.DenyListFile != "" {
+		if err = p.LoadDenyList(p.DenyListFile); err != nil {
+			panic(err)
+		}
+	}
+	c.PasswordPolicy = c.PasswordPolicy.ForHasher(hasher)
+	var breach *BreachList
+	if c.BreachFile != "" {
+		if breach, err = OpenBreachList(c.BreachFile); err != nil {
+			panic(err)
+		}
+	}
+	if us == nil {
+		us = NewUserStore(c.DB, UserBucket, hasher)
+	}
+	if ss == nil {
+		ss, err = newSessionStore(c, opt)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if as == nil {
+		as = NewAuditStore(c.DB, AuditBucket)
+	}
+
+	var webhooks *WebhookQueue
+	if len(c.Webhooks) > 0 {
+		webhooks = NewWebhookQueue(c.DB, WebhookBucket, c.Webhooks)
+		webhooks.MaxAttempts = c.WebhookMaxAttempts
+	}
 
 	return &Handlers{
 		rendr:  rendr,
-		sess:   NewSessStore(c.DB, "sessions", 100, opt, []byte(c.Secret)),
-		ustore: NewUserStore(c.DB, "warlock"),
+		sess:   ss,
+		ustore: us,
+		hasher: hasher,
+		breach: breach,
 		cfg:    c,
+
+		auditLog: as,
+		invites:  NewInviteStore(c.DB, InviteBucket),
+		orgs:     NewOrgStore(c.DB, OrgBucket),
+		webhooks: webhooks,
 	}
 }
 
-// Register is a http handler for registering new users
+// Register is a http handler for registering new users. Clients asking for json get json
+// responses instead of rendered templates and redirects. An invitation code is required
+// when Config.InviteOnly is set, it is read from the invite field or query parameter and
+// the roles of the invitation are granted to the new user, or within the organization of
+// the invitation when it was made for one. The BeforeRegister and AfterRegister hooks are
+// called around storing the user.
 func (h *Handlers) Register(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		h.rendr.HTML(w, http.StatusOK, h.cfg.RegisterTmpl, nil)
+		data := render.NewTemplateData()
+		data.Add("invite", r.URL.Query().Get("invite"))
+		data.Add("invite_only", h.cfg.InviteOnly)
+		h.rendr.HTML(w, http.StatusOK, h.cfg.RegisterTmpl, data)
 		return
 	}
 	if r.Method == "POST" {
-		r.ParseForm()
-		user := new(User)
+		asJSON := wantsJSON(r)
 		data := render.NewTemplateData()
-		if err := formam.Decode(r.Form, user); err != nil {
+		data.Add("invite_only", h.cfg.InviteOnly)
+		form := new(RegisterForm)
+		err := decodeRegister(r, form)
+		user := form.User()
+		code := form.Invite
+		if code == "" {
+			code = r.URL.Query().Get("invite")
+		}
+		data.Add("invite", code)
+		if err != nil {
+			if asJSON {
+				h.rendr.JSON(w, http.StatusBadRequest, apiResponse{Error: "malformed request"})
+				return
+			}
 			h.rendr.HTML(w, http.StatusInternalServerError, h.cfg.ServerErrTmpl, nil)
 			return
 		}
-		if v := user.Validate(); v != nil {
+		normalizeUser(user)
+		v := user.ValidateWith(h.cfg.PasswordPolicy)
+		warning := ""
+		if v == nil {
+			found, err := h.breached(user.Password)
+			switch {
+			case err != nil && h.cfg.BreachAction != BreachWarn:
+				v = map[string]string{"Password.breached": "could not be checked for data breaches, try again later"}
+			case found && h.cfg.BreachAction == BreachWarn:
+				warning = "Your password has appeared in a data breach, consider changing it"
+			case found:
+				v = map[string]string{"Password.breached": "has appeared in a data breach, choose another one"}
+			}
+		}
+		if v != nil {
+			if asJSON {
+				h.rendr.JSON(w, http.StatusUnprocessableEntity, apiResponse{Errors: v})
+				return
+			}
 			data.Add("errors", v)
 			h.rendr.HTML(w, http.StatusOK, h.cfg.RegisterTmpl, data)
 			return
 		}
 		if h.ustore.Exist(user) {
+			if asJSON {
+				h.rendr.JSON(w, http.StatusConflict, apiResponse{Error: "user already exist"})
+				return
+			}
 			data.Add("error", "user already exist")
 			h.rendr.HTML(w, http.StatusOK, h.cfg.RegisterTmpl, data)
 			return
 		}
-		if err := h.ustore.CreateUser(user); err != nil {
+		if err = runHooks(h.hooks.beforeRegister, r, user); err != nil {
+			if asJSON {
+				h.rendr.JSON(w, http.StatusForbidden, apiResponse{Error: err.Error()})
+				return
+			}
+			data.Add("error", err.Error())
+			h.rendr.HTML(w, http.StatusForbidden, h.cfg.RegisterTmpl, data)
+			return
+		}
+		var inv *Invitation
+		if code != "" || h.cfg.InviteOnly {
+			inv, err = h.invites.Consume(code, user.Email)
+			if err == nil && !h.grantable(inv) {
+				if rerr := h.invites.Release(inv.Code); rerr != nil {
+					log.Println(rerr)
+				}
+				err = ErrRoleNotGrantable
+			}
+			if err != nil {
+				msg := "a valid invitation is required to register"
+				if asJSON {
+					h.rendr.JSON(w, http.StatusForbidden, apiResponse{Error: msg})
+					return
+				}
+				data.Add("error", msg)
+				h.rendr.HTML(w, http.StatusForbidden, h.cfg.RegisterTmpl, data)
+				return
+			}
+			if inv.OrgID == "" {
+				for _, role := range inv.Roles {
+					user.Roles = addString(user.Roles, role)
+				}
+			}
+		}
+		if err = h.ustore.CreateUser(user); err != nil {
+			if inv != nil {
+				if rerr := h.invites.Release(inv.Code); rerr != nil {
+					log.Println(rerr)
+				}
+			}
+			if err == ErrUserExists || err == ErrUsernameExists {
+				msg := "user already exist"
+				if err == ErrUsernameExists {
+					msg = "username already taken"
+				}
+				if asJSON {
+					h.rendr.JSON(w, http.StatusConflict, apiResponse{Error: msg})
+					return
+				}
+				data.Add("error", msg)
+				h.rendr.HTML(w, http.StatusOK, h.cfg.RegisterTmpl, data)
+				return
+			}
+			if asJSON {
+				h.rendr.JSON(w, http.StatusInternalServerError, apiResponse{Error: "failed to create user"})
+				return
+			}
 			h.rendr.HTML(w, http.StatusInternalServerError, h.cfg.ServerErrTmpl, nil)
 			return
 		}
@@ -88,9 +253,30 @@ func (h *Handlers) Register(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			// TODO (gernest): log this error
 		}
-		ss.Values["user"] = user.Email
+		detail := ""
+		if inv != nil {
+			detail = "invited by " + inv.Inviter
+			if inv.OrgID != "" {
+				if _, err = h.joinOrg(inv, user.Email); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+		h.audit(user.Email, user.Email, AuditRegister, detail)
+		h.emit(EventUserCreated, user)
+		notify(h.hooks.afterRegister, r, user)
+		ss.Values[sessionUserKey] = user.Email
+		delete(ss.Values, sessionImpersonatorKey)
+		if asJSON {
+			ss.Save(r, w)
+			h.rendr.JSON(w, http.StatusCreated, apiResponse{User: user.Public(), Warning: warning})
+			return
+		}
 		flash := NewFlash()
 		flash.Success("Successfully created your account")
+		if warning != "" {
+			flash.Notice(warning)
+		}
 		flash.Add(ss)
 		ss.Save(r, w)
 		http.Redirect(w, r, h.cfg.RegRedir, http.StatusFound)
@@ -98,7 +284,9 @@ func (h *Handlers) Register(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Login login users
+// Login login users. Clients asking for json get json responses instead of rendered
+// templates and redirects, the session cookie is set in both cases. The BeforeLogin,
+// AfterLogin and OnLoginFailure hooks are called along the way.
 func (h *Handlers) Login(w http.ResponseWriter, r *http.Request) {
 	ss, err := h.sess.New(r, h.cfg.SessName)
 	if err != nil {
@@ -110,44 +298,113 @@ func (h *Handlers) Login(w http.ResponseWriter, r *http.Request) {
 		if f := flash.Get(ss); f != nil {
 			data.Add("flash", f.Data)
 		}
+		if next := r.URL.Query().Get("next"); safeRedirect(next) {
+			data.Add("next", next)
+		}
 		h.rendr.HTML(w, http.StatusOK, h.cfg.LoginTmpl, data)
 		return
 	}
 	if r.Method == "POST" {
+		asJSON := wantsJSON(r)
+		r.ParseForm()
+		next := r.Form.Get("next")
+		r.Form.Del("next")
 		if !ss.IsNew {
-			http.Redirect(w, r, h.cfg.LoginRedir, http.StatusFound)
+			if asJSON {
+				usr, _ := h.sessionUser(r)
+				if usr == nil {
+					h.rendr.JSON(w, http.StatusUnauthorized, apiResponse{Error: "invalid session"})
+					return
+				}
+				h.rendr.JSON(w, http.StatusOK, apiResponse{User: usr.Public()})
+				return
+			}
+			http.Redirect(w, r, h.loginRedirect(next), http.StatusFound)
 			return
 		}
-		r.ParseForm()
+		if safeRedirect(next) {
+			data.Add("next", next)
+		}
 		lg := new(LoginForm)
-		if err := formam.Decode(r.Form, lg); err != nil {
+		if err := decodeLogin(r, lg); err != nil {
+			if asJSON {
+				h.rendr.JSON(w, http.StatusBadRequest, apiResponse{Error: "malformed request"})
+				return
+			}
 			h.rendr.HTML(w, http.StatusInternalServerError, h.cfg.ServerErrTmpl, nil)
 			return
 		}
+		lg.Email = NormalizeEmail(lg.Email)
 		if v := lg.Validate(); v != nil {
+			if asJSON {
+				h.rendr.JSON(w, http.StatusUnprocessableEntity, apiResponse{Errors: v})
+				return
+			}
 			data.Add("errors", v)
 			h.rendr.HTML(w, http.StatusInternalServerError, h.cfg.LoginTmpl, data)
 			return
 		}
+		msg := "wrong email or password, correct and try again"
 		user, err := h.ustore.GetUser(lg.Email)
 		if err != nil {
-			flash.Error("wrong email or password, correct and try again")
+			notify(h.hooks.onLoginFailure, r, &User{Email: lg.Email})
+			if asJSON {
+				h.rendr.JSON(w, http.StatusUnauthorized, apiResponse{Error: msg})
+				return
+			}
+			flash.Error(msg)
 			data.Add("flash", flash.Data)
 			h.rendr.HTML(w, http.StatusInternalServerError, h.cfg.LoginTmpl, data)
 			return
 		}
 		if err = user.MatchPassword(lg.Password); err != nil {
-			flash.Error("wrong email or password, correct and try again")
+			h.audit("", user.Email, AuditLoginFailed, "wrong password")
+			notify(h.hooks.onLoginFailure, r, user)
+			if asJSON {
+				h.rendr.JSON(w, http.StatusUnauthorized, apiResponse{Error: msg})
+				return
+			}
+			flash.Error(msg)
+			data.Add("flash", flash.Data)
+			h.rendr.HTML(w, http.StatusOK, h.cfg.LoginTmpl, data)
+			return
+		}
+		locked := user.Disabled || user.ResetRequired
+		if locked {
+			msg = "your account is locked, contact support"
+			if user.ResetRequired {
+				msg = "a password reset is required, contact support"
+			}
+		} else if err = runHooks(h.hooks.beforeLogin, r, user); err != nil {
+			msg = err.Error()
+		}
+		if locked || err != nil {
+			h.audit("", user.Email, AuditLoginFailed, msg)
+			notify(h.hooks.onLoginFailure, r, user)
+			if asJSON {
+				h.rendr.JSON(w, http.StatusForbidden, apiResponse{Error: msg})
+				return
+			}
+			flash.Error(msg)
 			data.Add("flash", flash.Data)
 			h.rendr.HTML(w, http.StatusOK, h.cfg.LoginTmpl, data)
 			return
 		}
-		ss.Values["user"] = user.Email
+		h.rehash(user, lg.Password)
+		h.audit(user.Email, user.Email, AuditLogin, "")
+		ss.Values[sessionUserKey] = user.Email
+		delete(ss.Values, sessionImpersonatorKey)
 		err = ss.Save(r, w)
 		if err != nil {
 			// TODO (gernest): log this error
 		}
-		http.Redirect(w, r, h.cfg.LoginRedir, http.StatusFound)
+		h.emit(EventUserLogin, user)
+		notify(h.hooks.afterLogin, r, user)
+		if asJSON {
+			h.rendr.JSON(w, http.StatusOK, apiResponse{User: user.Public()})
+			return
+		}
+		http.Redirect(w, r, h.loginRedirect(next), http.StatusFound)
 		return
 	}
 
@@ -159,29 +416,193 @@ func (h *Handlers) Logout(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		// TODO (gernest): log this error
 	}
+	email, loggedIn := ss.Values[sessionUserKey].(string)
+	if loggedIn {
+		if admin, ok := ss.Values[sessionImpersonatorKey].(string); ok {
+			h.audit(admin, email, AuditStopImpersonate, "logout")
+			email = admin
+		}
+		h.audit(email, email, AuditLogout, "")
+	}
 	err = h.sess.Delete(r, w, ss)
 	if err != nil {
 		// TODO (gernest): log this error
 	}
+	if loggedIn && len(h.hooks.afterLogout) > 0 {
+		usr, err := h.ustore.GetUser(email)
+		if err != nil {
+			usr = &User{Email: email}
+		}
+		notify(h.hooks.afterLogout, r, usr)
+	}
+	if wantsJSON(r) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
 	http.Redirect(w, r, "/", http.StatusFound)
 	return
 }
 
-// SessionMiddleware checks for session and addss the user to context
+// breached reports whether pass appears in the breached passwords file. Lookup errors are
+// logged and returned so that callers rejecting breached passwords can fail closed.
+func (h *Handlers) breached(pass string) (bool, error) {
+	if h.breach == nil {
+		return false, nil
+	}
+	n, err := h.breach.Count(pass)
+	if err != nil {
+		log.Println(err)
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// rehash upgrades the stored hash of a user who just logged in when it was made with
+// another algorithm or a lower cost than the configured one
+func (h *Handlers) rehash(usr *User, pass string) {
+	if !h.hasher.NeedsRehash(usr.Password) {
+		return
+	}
+	p, err := h.hasher.Hash(pass)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	usr.Password = p
+	if err = h.ustore.UpdateUser(usr); err != nil {
+		log.Println(err)
+	}
+}
+
+// SessionMiddleware checks for session and adds the user, the session and the current
+// organization of the user to the request context, use CurrentUser, CurrentSession and
+// CurrentOrg to retrieve them
 func (h *Handlers) SessionMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ss, err := h.sess.New(r, h.cfg.SessName)
-		if err != nil {
-			// TODO (gernest): log this error
-		}
-		if !ss.IsNew {
-			email := ss.Values["user"].(string)
-			usr, err := h.ustore.GetUser(email)
-			if err == nil {
-				context.Set(r, "user", usr)
-			}
+		if usr, ss := h.sessionUser(r); usr != nil {
+			r = r.WithContext(h.sessionContext(r.Context(), usr, ss))
 			log.Println("sess found")
 		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// RequireLogin redirects anonymous users to the login page, the requested url is
+// passed along as the next parameter so Login can send the user back to it
+func (h *Handlers) RequireLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := CurrentUser(r.Context()); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		usr, ss := h.sessionUser(r)
+		if usr == nil {
+			q := url.Values{}
+			q.Set("next", r.URL.RequestURI())
+			http.Redirect(w, r, h.cfg.LoginPath+"?"+q.Encode(), http.StatusFound)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(h.sessionContext(r.Context(), usr, ss)))
+	})
+}
+
+// sessionContext returns a copy of ctx carrying the user, the session and the current
+// organization when the user belongs to one
+func (h *Handlers) sessionContext(ctx context.Context, usr *User, ss *sessions.Session) context.Context {
+	ctx = WithSession(WithUser(ctx, usr), ss)
+	if admin := h.impersonator(ss); admin != nil {
+		ctx = WithImpersonator(ctx, admin)
+	}
+	if org, m := h.sessionOrg(usr, ss); org != nil {
+		ctx = WithOrg(ctx, org, m)
+	}
+	return ctx
+}
+
+// sessionUser returns the user of the current session and the session itself, the user is
+// nil when there is no valid session, the account is locked or waits for a password reset.
+// Impersonation sessions are only honoured while they can not reach an admin account.
+func (h *Handlers) sessionUser(r *http.Request) (*User, *sessions.Session) {
+	ss, err := h.sess.New(r, h.cfg.SessName)
+	if err != nil || ss.IsNew {
+		return nil, nil
+	}
+	email, ok := ss.Values[sessionUserKey].(string)
+	if !ok {
+		return nil, nil
+	}
+	usr, err := h.ustore.GetUser(email)
+	if err != nil || usr.Disabled || usr.ResetRequired {
+		return nil, nil
+	}
+	if _, ok = ss.Values[sessionImpersonatorKey]; ok {
+		// the admin lost the role or the user became one since the impersonation started
+		if usr.HasRole(RoleAdmin) || h.impersonator(ss) == nil {
+			return nil, nil
+		}
+	}
+	return usr, ss
+}
+
+func (h *Handlers) loginRedirect(next string) string {
+	if safeRedirect(next) {
+		return next
+	}
+	return h.cfg.LoginRedir
+}
+
+// safeRedirect reports whether next is a local path which is safe to redirect to. Absolute
+// urls and scheme relative ones like //evil.com are rejected to avoid open redirects.
+func safeRedirect(next string) bool {
+	if next == "" || next[0] != '/' {
+		return false
+	}
+	if len(next) > 1 && next[1] == '/' {
+		return false
+	}
+	if strings.ContainsAny(next, "\\\r\n\t") {
+		return false
+	}
+	u, err := url.Parse(next)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "" && u.Host == "" && u.User == nil
+}
+
+// RequireRole allows only users with at least one of the given roles, it relies on
+// SessionMiddleware having put the user into the request context
+func (h *Handlers) RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return h.require(func(usr *User) bool {
+		return usr.HasRole(roles...)
+	})
+}
+
+// RequirePermission allows only users with all of the given permissions, it relies on
+// SessionMiddleware having put the user into the request context
+func (h *Handlers) RequirePermission(perms ...string) func(http.Handler) http.Handler {
+	return h.require(func(usr *User) bool {
+		return usr.HasPermission(perms...)
+	})
+}
+
+func (h *Handlers) require(allow func(*User) bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			usr, ok := CurrentUser(r.Context())
+			if !ok || !allow(usr) {
+				h.forbidden(w)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (h *Handlers) forbidden(w http.ResponseWriter) {
+	if h.cfg.ForbiddenTmpl == "" {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	h.rendr.HTML(w, http.StatusForbidden, h.cfg.ForbiddenTmpl, nil)
+}
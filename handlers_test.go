@@ -20,6 +20,15 @@ var (
 	lPath = "/auth/login"
 	rPath = "/auth/register"
 	oPath = "/auth/logout"
+	aPath = "/admin"
+	pPath = "/private"
+	dPath = "/admin/users"
+	iPath = "/auth/invite"
+	wPath = "/orgs/switch"
+	jPath = "/orgs/join"
+	gPath = "/org"
+	xPath = "/auth/impersonate/stop"
+	mPath = "/whoami"
 )
 
 func cleanUp(s string) {
@@ -44,7 +53,7 @@ func TestHandlers_Register(t *testing.T) {
 	}
 
 	// POST
-	vars := "FirstName=young&LastName=warlock&Email=me@me.com&Password=pass&ConfirmPassword=pass"
+	vars := "FirstName=young&LastName=warlock&Email=me@me.com&Password=open+sesame+42&ConfirmPassword=open+sesame+42"
 	v, err := url.ParseQuery(vars)
 	if err != nil {
 		t.Error(err)
@@ -81,7 +90,7 @@ func TestHandlers_Register(t *testing.T) {
 	}
 
 	// Failure to decode
-	vars2 := "firstName=young&LastName=warlock&Email=me@me.com&Password=pass&ConfirmPassword=pass"
+	vars2 := "FirstName[0]=young&LastName=warlock&Email=me@me.com&Password=pass&ConfirmPassword=pass"
 	v, err = url.ParseQuery(vars2)
 	if err != nil {
 		t.Error(err)
@@ -116,7 +125,7 @@ func TestHandlers_Register(t *testing.T) {
 	io.Copy(res, wv.Body)
 
 	if wv.StatusCode != http.StatusOK {
-		t.Errorf("Expected 200 actual %s", wv.StatusCode)
+		t.Errorf("Expected 200 actual %d", wv.StatusCode)
 	}
 	if !strings.Contains(res.String(), "should match password") {
 		t.Errorf("Expect %s to countain should match password", res.String())
@@ -124,6 +133,40 @@ func TestHandlers_Register(t *testing.T) {
 
 }
 
+func TestHandlers_RegisterPrivilegedFields(t *testing.T) {
+	ts, client, y := testServer(t)
+	defer ts.Close()
+	defer cleanUp("warlock_test.db")
+
+	vars := "FirstName=young&LastName=warlock&Email=me@me.com&Password=open+sesame+42&ConfirmPassword=open+sesame+42" +
+		"&Roles=admin&Roles[0]=admin&Permissions[0]=all&Verified=true&Disabled=false"
+	v, err := url.ParseQuery(vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := client.PostForm(ts.URL+rPath, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	body := `{"first_name":"young","last_name":"warlock","email":"you@me.com","password":"open sesame 42",` +
+		`"confirm_password":"open sesame 42","roles":["admin"],"verified":true}`
+	if _, _, err = postJSON(&http.Client{}, ts.URL+rPath, body); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, email := range []string{"me@me.com", "you@me.com"} {
+		usr, err := y.ustore.GetUser(email)
+		if err != nil {
+			t.Fatalf("Expected %s to be registered actual %v", email, err)
+		}
+		if len(usr.Roles) != 0 || len(usr.Permissions) != 0 || usr.Verified {
+			t.Errorf("Expected no roles, permissions or verified flag actual %+v", usr)
+		}
+	}
+}
+
 func TestHandlers_Login(t *testing.T) {
 	ts, client, y := testServer(t)
 	defer ts.Close()
@@ -176,7 +219,7 @@ func TestHandlers_Login(t *testing.T) {
 	}
 	defer wp.Body.Close()
 	if wp.StatusCode != http.StatusNotFound {
-		t.Errorf("Expected %d actual %s", http.StatusNotFound, wp.StatusCode)
+		t.Errorf("Expected %d actual %d", http.StatusNotFound, wp.StatusCode)
 	}
 
 	// Login
@@ -189,7 +232,7 @@ func TestHandlers_Login(t *testing.T) {
 		t.Error(err)
 	}
 	if wr.StatusCode != http.StatusNotFound {
-		t.Errorf("Expected d actual %d", http.StatusNotFound, wr.StatusCode)
+		t.Errorf("Expected %d actual %d", http.StatusNotFound, wr.StatusCode)
 	}
 
 	out, err := client.Get(fmt.Sprintf("%s%s", ts.URL, oPath))
@@ -203,9 +246,160 @@ func TestHandlers_Login(t *testing.T) {
 
 }
 
+func TestHandlers_RequireRole(t *testing.T) {
+	ts, client, y := testServer(t)
+	defer ts.Close()
+	defer cleanUp("warlock_test.db")
+	adminURL := fmt.Sprintf("%s%s", ts.URL, aPath)
+
+	// Anonymous
+	w, err := client.Get(adminURL)
+	if err != nil {
+		t.Error(err)
+	}
+	defer w.Body.Close()
+	if w.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected %d actual %d", http.StatusForbidden, w.StatusCode)
+	}
+
+	usr := new(User)
+	usr.Email = "me@me.com"
+	usr.Password = "pass"
+	y.ustore.CreateUser(usr)
+	v, err := url.ParseQuery("Email=me@me.com&Password=pass")
+	if err != nil {
+		t.Error(err)
+	}
+	wl, err := client.PostForm(fmt.Sprintf("%s%s", ts.URL, lPath), v)
+	if err != nil {
+		t.Error(err)
+	}
+	defer wl.Body.Close()
+
+	// Logged in without the role
+	wn, err := client.Get(adminURL)
+	if err != nil {
+		t.Error(err)
+	}
+	defer wn.Body.Close()
+	res := new(bytes.Buffer)
+	io.Copy(res, wn.Body)
+	if wn.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected %d actual %d", http.StatusForbidden, wn.StatusCode)
+	}
+	if !strings.Contains(res.String(), "forbidden") {
+		t.Errorf("Expected %s to contain forbidden", res.String())
+	}
+
+	// Logged in with the role
+	if err = GrantRole(y.ustore, usr.Email, RoleAdmin); err != nil {
+		t.Error(err)
+	}
+	wa, err := client.Get(adminURL)
+	if err != nil {
+		t.Error(err)
+	}
+	defer wa.Body.Close()
+	if wa.StatusCode != http.StatusOK {
+		t.Errorf("Expected %d actual %d", http.StatusOK, wa.StatusCode)
+	}
+}
+
+func TestHandlers_RequireLogin(t *testing.T) {
+	ts, client, y := testServer(t)
+	defer ts.Close()
+	defer cleanUp("warlock_test.db")
+
+	// Anonymous users are sent to login carrying the next parameter
+	w, err := client.Get(fmt.Sprintf("%s%s", ts.URL, pPath))
+	if err != nil {
+		t.Error(err)
+	}
+	defer w.Body.Close()
+	res := new(bytes.Buffer)
+	io.Copy(res, w.Body)
+	if w.Request.URL.Path != lPath {
+		t.Errorf("Expected %s actual %s", lPath, w.Request.URL.Path)
+	}
+	if w.Request.URL.Query().Get("next") != pPath {
+		t.Errorf("Expected %s actual %s", pPath, w.Request.URL.Query().Get("next"))
+	}
+	if !strings.Contains(res.String(), `value="/private"`) {
+		t.Errorf("Expected %s to contain the next parameter", res.String())
+	}
+
+	usr := new(User)
+	usr.Email = "me@me.com"
+	usr.Password = "pass"
+	y.ustore.CreateUser(usr)
+
+	// Open redirects are ignored
+	v, err := url.ParseQuery("Email=me@me.com&Password=pass&next=//evil.com")
+	if err != nil {
+		t.Error(err)
+	}
+	wo, err := client.PostForm(fmt.Sprintf("%s%s", ts.URL, lPath), v)
+	if err != nil {
+		t.Error(err)
+	}
+	defer wo.Body.Close()
+	if wo.Request.URL.Host != w.Request.URL.Host || wo.Request.URL.Path != "/" {
+		t.Errorf("Expected to be redirected to / actual %s", wo.Request.URL)
+	}
+
+	// Already logged in, goes back to next
+	v.Set("next", pPath)
+	wl, err := client.PostForm(fmt.Sprintf("%s%s", ts.URL, lPath), v)
+	if err != nil {
+		t.Error(err)
+	}
+	defer wl.Body.Close()
+	res.Reset()
+	io.Copy(res, wl.Body)
+	if wl.Request.URL.Path != pPath {
+		t.Errorf("Expected %s actual %s", pPath, wl.Request.URL.Path)
+	}
+	if res.String() != "private" {
+		t.Errorf("Expected private actual %s", res.String())
+	}
+}
+
+func TestSafeRedirect(t *testing.T) {
+	sample := []struct {
+		next string
+		safe bool
+	}{
+		{"/", true},
+		{"/private?tab=1", true},
+		{"", false},
+		{"private", false},
+		{"//evil.com", false},
+		{"/\\evil.com", false},
+		{"http://evil.com", false},
+		{"https://evil.com/private", false},
+		{"/\r\nLocation: http://evil.com", false},
+	}
+	for _, v := range sample {
+		if safeRedirect(v.next) != v.safe {
+			t.Errorf("Expected %v for %q actual %v", v.safe, v.next, !v.safe)
+		}
+	}
+}
+
+// copyRequest mimics routers which hand a shallow copy of the request to the next handler
+func copyRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(r.Context()))
+	})
+}
+
 func testServer(t *testing.T) (*httptest.Server, *http.Client, *Handlers) {
-	cfg := new(Config)
+	return testServerConfig(t, new(Config))
+}
+
+func testServerConfig(t *testing.T, cfg *Config) (*httptest.Server, *http.Client, *Handlers) {
 	cfg.DB = "warlock_test.db"
+	cfg.DevMode = true
 	opts := render.Options{Directory: "fixture"}
 
 	y := YoungWarlock(opts, cfg)
@@ -220,6 +414,35 @@ func testServer(t *testing.T) (*httptest.Server, *http.Client, *Handlers) {
 	h.HandleFunc("/auth/register", y.Register).Methods("GET", "POST")
 	h.HandleFunc("/auth/login", y.Login).Methods("GET", "POST")
 	h.HandleFunc("/auth/logout", y.Logout).Methods("GET", "POST")
+	h.HandleFunc("/auth/invite", y.Invite).Methods("GET", "POST")
+	h.HandleFunc("/orgs/switch", y.SwitchOrg).Methods("POST")
+	h.HandleFunc("/orgs/join", y.JoinOrg).Methods("POST")
+	h.HandleFunc("/auth/impersonate/stop", y.StopImpersonating).Methods("POST")
+	h.Handle("/whoami", y.SessionMiddleware(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			data := y.TemplateData(r)
+			if usr, ok := data["current_user"].(*PublicUser); ok {
+				fmt.Fprintf(w, "%s impersonating=%v", usr.Email, data["impersonating"])
+			}
+		},
+	)))
+	h.Handle("/org", y.SessionMiddleware(y.RequireOrgRole(OrgRoleOwner, OrgRoleAdmin)(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			org, _, _ := CurrentOrg(r.Context())
+			w.Write([]byte(org.Name))
+		},
+	))))
+	h.Handle("/admin", y.SessionMiddleware(copyRequest(y.RequireRole(RoleAdmin)(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		},
+	)))))
+	h.PathPrefix(dPath).Handler(y.Admin(dPath))
+	h.Handle("/private", y.RequireLogin(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("private"))
+		},
+	)))
 
 	ts := httptest.NewServer(h)
 	return ts, client, y
@@ -0,0 +1,337 @@
+package warlock
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	// ErrPasswordMismatch is returned when a password does not match the stored hash
+	ErrPasswordMismatch = errors.New("warlock: password does not match")
+
+	// ErrUnknownHash is returned for hashes which were not produced by any of the hashers
+	ErrUnknownHash = errors.New("warlock: unknown password hash format")
+)
+
+// Hasher hashes and verifies passwords. Hashes are self describing, bcrypt uses its own
+// modular crypt format and the others use the PHC string format, so that any supported
+// hash can be verified no matter which hasher is configured.
+type Hasher interface {
+	// Hash returns the encoded hash of the password
+	Hash(password string) (string, error)
+
+	// Verify returns nil if the password matches the hash
+	Verify(hash, password string) error
+
+	// NeedsRehash returns true when the hash was made with another algorithm or with
+	// weaker parameters than the hasher is configured with
+	NeedsRehash(hash string) bool
+}
+
+// Supported values for Config.Hasher
+const (
+	HashBcrypt   = "bcrypt"
+	HashScrypt   = "scrypt"
+	HashArgon2id = "argon2id"
+)
+
+// Bounds of the cost accepted by NewHasher for scrypt and argon2id
+const (
+	minScryptCost = 10
+	maxScryptCost = 20
+	minArgon2Cost = 1
+	maxArgon2Cost = 10
+)
+
+// NewHasher returns the hasher for the given algorithm, cost is the bcrypt cost, the log2
+// of the scrypt N parameter or the argon2id number of passes. Zero cost picks the default.
+// The cost is checked before it is used so that it can not wrap around, scrypt accepts
+// 10 to 20 and argon2id 1 to 10 passes.
+func NewHasher(algo string, cost int) (Hasher, error) {
+	switch algo {
+	case "", HashBcrypt:
+		h := NewBcryptHasher()
+		if cost == 0 {
+			return h, nil
+		}
+		if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("warlock: invalid bcrypt cost %d", cost)
+		}
+		h.Cost = cost
+		return h, nil
+	case HashScrypt:
+		h := NewScryptHasher()
+		if cost == 0 {
+			return h, nil
+		}
+		if cost < minScryptCost || cost > maxScryptCost {
+			return nil, fmt.Errorf("warlock: invalid scrypt cost %d", cost)
+		}
+		h.LogN = uint8(cost)
+		return h, nil
+	case HashArgon2id:
+		h := NewArgon2Hasher()
+		if cost == 0 {
+			return h, nil
+		}
+		if cost < minArgon2Cost || cost > maxArgon2Cost {
+			return nil, fmt.Errorf("warlock: invalid argon2id cost %d", cost)
+		}
+		h.Time = uint32(cost)
+		return h, nil
+	}
+	return nil, errors.New("warlock: unknown hasher " + algo)
+}
+
+// VerifyPassword checks the password against a hash produced by any of the hashers
+func VerifyPassword(hash, password string) error {
+	var h Hasher
+	switch {
+	case isBcrypt(hash):
+		h = &BcryptHasher{}
+	case strings.HasPrefix(hash, "$"+HashScrypt+"$"):
+		h = &ScryptHasher{}
+	case strings.HasPrefix(hash, "$"+HashArgon2id+"$"):
+		h = &Argon2Hasher{}
+	default:
+		return ErrUnknownHash
+	}
+	return h.Verify(hash, password)
+}
+
+// BcryptHasher hashes passwords with bcrypt
+type BcryptHasher struct {
+	Cost int
+}
+
+// NewBcryptHasher returns a bcrypt hasher using the bcrypt default cost
+func NewBcryptHasher() *BcryptHasher {
+	return &BcryptHasher{Cost: bcrypt.DefaultCost}
+}
+
+// Hash returns the bcrypt hash of the password
+func (b *BcryptHasher) Hash(password string) (string, error) {
+	p, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(p), nil
+}
+
+// Verify returns nil if the password matches the bcrypt hash
+func (b *BcryptHasher) Verify(hash, password string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return ErrPasswordMismatch
+	}
+	return err
+}
+
+// NeedsRehash returns true if hash is not a bcrypt hash of at least the configured cost
+func (b *BcryptHasher) NeedsRehash(hash string) bool {
+	if !isBcrypt(hash) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < b.Cost
+}
+
+func isBcrypt(hash string) bool {
+	for _, p := range []string{"$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(hash, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// ScryptHasher hashes passwords with scrypt, hashes are encoded as
+// $scrypt$ln=15,r=8,p=1$salt$key
+type ScryptHasher struct {
+	LogN    uint8
+	R       int
+	P       int
+	KeyLen  int
+	SaltLen int
+}
+
+// NewScryptHasher returns a scrypt hasher with the parameters recommended for interactive
+// logins
+func NewScryptHasher() *ScryptHasher {
+	return &ScryptHasher{LogN: 15, R: 8, P: 1, KeyLen: 32, SaltLen: 16}
+}
+
+// Hash returns the encoded scrypt hash of the password
+func (s *ScryptHasher) Hash(password string) (string, error) {
+	salt, err := newSalt(s.SaltLen)
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(password), salt, 1<<s.LogN, s.R, s.P, s.KeyLen)
+	if err != nil {
+		return "", err
+	}
+	params := fmt.Sprintf("ln=%d,r=%d,p=%d", s.LogN, s.R, s.P)
+	return encodePHC(HashScrypt, params, salt, key), nil
+}
+
+// Verify returns nil if the password matches the scrypt hash
+func (s *ScryptHasher) Verify(hash, password string) error {
+	p, err := s.decode(hash)
+	if err != nil {
+		return err
+	}
+	key, err := scrypt.Key([]byte(password), p.salt, 1<<p.LogN, p.R, p.P, len(p.key))
+	if err != nil {
+		return err
+	}
+	return compareKeys(key, p.key)
+}
+
+// NeedsRehash returns true if hash is not a scrypt hash with at least the configured
+// parameters
+func (s *ScryptHasher) NeedsRehash(hash string) bool {
+	p, err := s.decode(hash)
+	if err != nil {
+		return true
+	}
+	return p.LogN < s.LogN || p.R < s.R || p.P < s.P || len(p.key) < s.KeyLen
+}
+
+type scryptHash struct {
+	ScryptHasher
+	salt, key []byte
+}
+
+func (s *ScryptHasher) decode(hash string) (*scryptHash, error) {
+	params, salt, key, err := decodePHC(HashScrypt, hash)
+	if err != nil {
+		return nil, err
+	}
+	p := &scryptHash{salt: salt, key: key}
+	_, err = fmt.Sscanf(params, "ln=%d,r=%d,p=%d", &p.LogN, &p.R, &p.P)
+	if err != nil || p.LogN < 1 || p.LogN > 30 {
+		return nil, ErrUnknownHash
+	}
+	return p, nil
+}
+
+// Argon2Hasher hashes passwords with argon2id, hashes are encoded as
+// $argon2id$v=19$m=65536,t=3,p=2$salt$key
+type Argon2Hasher struct {
+	Time    uint32
+	Memory  uint32 // in KiB
+	Threads uint8
+	KeyLen  uint32
+	SaltLen int
+}
+
+// NewArgon2Hasher returns an argon2id hasher with the parameters recommended by RFC 9106
+// for memory constrained environments
+func NewArgon2Hasher() *Argon2Hasher {
+	return &Argon2Hasher{Time: 3, Memory: 64 * 1024, Threads: 2, KeyLen: 32, SaltLen: 16}
+}
+
+// Hash returns the encoded argon2id hash of the password
+func (a *Argon2Hasher) Hash(password string) (string, error) {
+	salt, err := newSalt(a.SaltLen)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, a.Time, a.Memory, a.Threads, a.KeyLen)
+	params := fmt.Sprintf("v=%d$m=%d,t=%d,p=%d", argon2.Version, a.Memory, a.Time, a.Threads)
+	return encodePHC(HashArgon2id, params, salt, key), nil
+}
+
+// Verify returns nil if the password matches the argon2id hash
+func (a *Argon2Hasher) Verify(hash, password string) error {
+	p, err := a.decode(hash)
+	if err != nil {
+		return err
+	}
+	key := argon2.IDKey([]byte(password), p.salt, p.Time, p.Memory, p.Threads, uint32(len(p.key)))
+	return compareKeys(key, p.key)
+}
+
+// NeedsRehash returns true if hash is not an argon2id hash with at least the configured
+// parameters
+func (a *Argon2Hasher) NeedsRehash(hash string) bool {
+	p, err := a.decode(hash)
+	if err != nil {
+		return true
+	}
+	return p.Time < a.Time || p.Memory < a.Memory || p.Threads < a.Threads || uint32(len(p.key)) < a.KeyLen
+}
+
+type argon2Hash struct {
+	Argon2Hasher
+	salt, key []byte
+}
+
+func (a *Argon2Hasher) decode(hash string) (*argon2Hash, error) {
+	params, salt, key, err := decodePHC(HashArgon2id, hash)
+	if err != nil {
+		return nil, err
+	}
+	p := &argon2Hash{salt: salt, key: key}
+	var version int
+	_, err = fmt.Sscanf(params, "v=%d$m=%d,t=%d,p=%d", &version, &p.Memory, &p.Time, &p.Threads)
+	if err != nil || version != argon2.Version || p.Time < 1 || p.Threads < 1 {
+		return nil, ErrUnknownHash
+	}
+	return p, nil
+}
+
+// encodePHC formats a hash as $id$params$salt$key using unpadded base64
+func encodePHC(id, params string, salt, key []byte) string {
+	return strings.Join([]string{
+		"",
+		id,
+		params,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	}, "$")
+}
+
+// decodePHC splits a PHC string produced by encodePHC, params may contain a $ separated
+// version like argon2id does
+func decodePHC(id, hash string) (params string, salt, key []byte, err error) {
+	if !strings.HasPrefix(hash, "$"+id+"$") {
+		return "", nil, nil, ErrUnknownHash
+	}
+	parts := strings.Split(hash[len(id)+2:], "$")
+	if len(parts) < 3 {
+		return "", nil, nil, ErrUnknownHash
+	}
+	n := len(parts)
+	salt, err = base64.RawStdEncoding.DecodeString(parts[n-2])
+	if err != nil {
+		return "", nil, nil, ErrUnknownHash
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[n-1])
+	if err != nil || len(key) == 0 {
+		return "", nil, nil, ErrUnknownHash
+	}
+	return strings.Join(parts[:n-2], "$"), salt, key, nil
+}
+
+func newSalt(n int) ([]byte, error) {
+	salt := make([]byte, n)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+func compareKeys(a, b []byte) error {
+	if subtle.ConstantTimeCompare(a, b) != 1 {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
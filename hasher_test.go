@@ -0,0 +1,156 @@
+package warlock
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// cheap parameters, these tests are about encoding and not strength
+func testHashers() []Hasher {
+	return []Hasher{
+		&BcryptHasher{Cost: bcrypt.MinCost},
+		&ScryptHasher{LogN: 4, R: 8, P: 1, KeyLen: 32, SaltLen: 16},
+		&Argon2Hasher{Time: 1, Memory: 64, Threads: 1, KeyLen: 32, SaltLen: 16},
+	}
+}
+
+func TestHasher(t *testing.T) {
+	for _, h := range testHashers() {
+		hash, err := h.Hash("correct horse battery staple")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = h.Verify(hash, "correct horse battery staple"); err != nil {
+			t.Errorf("%T: %v", h, err)
+		}
+		if err = h.Verify(hash, "wrong"); err != ErrPasswordMismatch {
+			t.Errorf("%T: Expected %v actual %v", h, ErrPasswordMismatch, err)
+		}
+		if err = VerifyPassword(hash, "correct horse battery staple"); err != nil {
+			t.Errorf("%T: %v", h, err)
+		}
+		if h.NeedsRehash(hash) {
+			t.Errorf("%T: Expected false actual true for %s", h, hash)
+		}
+		again, err := h.Hash("correct horse battery staple")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again == hash {
+			t.Errorf("%T: Expected hashes to be salted", h)
+		}
+	}
+}
+
+func TestHasher_phc(t *testing.T) {
+	h := testHashers()
+	s, err := h[1].Hash("pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(s, "$scrypt$ln=4,r=8,p=1$") {
+		t.Errorf("Expected a PHC scrypt hash actual %s", s)
+	}
+	a, err := h[2].Hash("pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(a, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("Expected a PHC argon2id hash actual %s", a)
+	}
+	for _, v := range []string{"", "plain", "$argon2id$v=19$m=64,t=1,p=1$@@$@@", "$scrypt$ln=4$c2FsdA$a2V5"} {
+		if err = VerifyPassword(v, "pass"); err != ErrUnknownHash {
+			t.Errorf("Expected %v for %q actual %v", ErrUnknownHash, v, err)
+		}
+	}
+}
+
+func TestHasher_needsRehash(t *testing.T) {
+	h := testHashers()
+	weak, err := h[0].Hash("pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	strong := &BcryptHasher{Cost: bcrypt.MinCost + 1}
+	if !strong.NeedsRehash(weak) {
+		t.Errorf("Expected true actual false")
+	}
+	if !h[1].NeedsRehash(weak) || !h[2].NeedsRehash(weak) {
+		t.Errorf("Expected a bcrypt hash to need rehashing with other algorithms")
+	}
+	a, err := h[2].Hash("pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	more := &Argon2Hasher{Time: 1, Memory: 128, Threads: 1, KeyLen: 32, SaltLen: 16}
+	if !more.NeedsRehash(a) {
+		t.Errorf("Expected true actual false")
+	}
+}
+
+func TestNewHasher(t *testing.T) {
+	sample := []struct {
+		algo string
+		cost int
+		ok   bool
+	}{
+		{"", 0, true},
+		{HashBcrypt, 12, true},
+		{HashBcrypt, 100, false},
+		{HashScrypt, 16, true},
+		{HashScrypt, 64, false},
+		{HashScrypt, 264, false},
+		{HashScrypt, 4, false},
+		{HashArgon2id, 4, true},
+		{HashArgon2id, -1, false},
+		{HashArgon2id, 1 << 32, false},
+		{HashBcrypt, -1, false},
+		{"md5", 0, false},
+	}
+	for _, v := range sample {
+		_, err := NewHasher(v.algo, v.cost)
+		if (err == nil) != v.ok {
+			t.Errorf("Expected %v for %s %d actual %v", v.ok, v.algo, v.cost, err)
+		}
+	}
+}
+
+func TestHandlers_LoginRehash(t *testing.T) {
+	ts, client, y := testServer(t)
+	defer ts.Close()
+	defer cleanUp("warlock_test.db")
+
+	// an account created back when the cost was lower
+	old := NewUserStore("warlock_test.db", "warlock", &BcryptHasher{Cost: bcrypt.MinCost})
+	usr := &User{Email: "me@me.com", Password: "pass"}
+	if err := old.CreateUser(usr); err != nil {
+		t.Fatal(err)
+	}
+	v, err := url.ParseQuery("Email=me@me.com&Password=pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := client.PostForm(fmt.Sprintf("%s%s", ts.URL, lPath), v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Body.Close()
+	u, err := y.ustore.GetUser(usr.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cost, err := bcrypt.Cost([]byte(u.Password))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost != bcrypt.DefaultCost {
+		t.Errorf("Expected %d actual %d", bcrypt.DefaultCost, cost)
+	}
+	if err = u.MatchPassword("pass"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,76 @@
+package warlock
+
+import (
+	"log"
+	"net/http"
+)
+
+// HookFunc is called by the handlers on authentication events with the request and the
+// user concerned. Errors returned by the Before hooks veto the action and their message is
+// shown to the client, errors of the other hooks are only logged.
+type HookFunc func(r *http.Request, usr *User) error
+
+// hooks holds the callbacks registered on Handlers, they are meant to be registered before
+// the handlers start serving
+type hooks struct {
+	beforeRegister []HookFunc
+	afterRegister  []HookFunc
+	beforeLogin    []HookFunc
+	afterLogin     []HookFunc
+	afterLogout    []HookFunc
+	onLoginFailure []HookFunc
+}
+
+// BeforeRegister registers fn to be called with new users once their details are valid
+// and before they are stored, changes made to the user are kept. Returning an error
+// rejects the registration, like for emails of blocked domains.
+func (h *Handlers) BeforeRegister(fn HookFunc) {
+	h.hooks.beforeRegister = append(h.hooks.beforeRegister, fn)
+}
+
+// AfterRegister registers fn to be called with new users once they are stored, like to
+// provision their resources
+func (h *Handlers) AfterRegister(fn HookFunc) {
+	h.hooks.afterRegister = append(h.hooks.afterRegister, fn)
+}
+
+// BeforeLogin registers fn to be called with users whose credentials are correct, before
+// the session is started. Returning an error refuses the login.
+func (h *Handlers) BeforeLogin(fn HookFunc) {
+	h.hooks.beforeLogin = append(h.hooks.beforeLogin, fn)
+}
+
+// AfterLogin registers fn to be called with users once they are logged in
+func (h *Handlers) AfterLogin(fn HookFunc) {
+	h.hooks.afterLogin = append(h.hooks.afterLogin, fn)
+}
+
+// AfterLogout registers fn to be called with users once their session is ended
+func (h *Handlers) AfterLogout(fn HookFunc) {
+	h.hooks.afterLogout = append(h.hooks.afterLogout, fn)
+}
+
+// OnLoginFailure registers fn to be called on failed logins. For unknown emails the user
+// only carries the email which was tried.
+func (h *Handlers) OnLoginFailure(fn HookFunc) {
+	h.hooks.onLoginFailure = append(h.hooks.onLoginFailure, fn)
+}
+
+// runHooks calls the hooks in the order they were registered and stops at the first error
+func runHooks(list []HookFunc, r *http.Request, usr *User) error {
+	for _, fn := range list {
+		if err := fn(r, usr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notify calls every hook, errors are logged since the event already happened
+func notify(list []HookFunc, r *http.Request, usr *User) {
+	for _, fn := range list {
+		if err := fn(r, usr); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package warlock
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHandlers_Hooks(t *testing.T) {
+	ts, client, y := testServer(t)
+	defer ts.Close()
+	defer cleanUp("warlock_test.db")
+
+	var events []string
+	record := func(name string) HookFunc {
+		return func(r *http.Request, usr *User) error {
+			events = append(events, name+" "+usr.Email)
+			return nil
+		}
+	}
+	y.BeforeRegister(func(r *http.Request, usr *User) error {
+		if strings.HasSuffix(usr.Email, "@blocked.com") {
+			return errors.New("this domain is not allowed")
+		}
+		usr.Roles = append(usr.Roles, "trial")
+		return nil
+	})
+	y.AfterRegister(record("after_register"))
+	y.BeforeLogin(func(r *http.Request, usr *User) error {
+		if usr.FirstName == "banned" {
+			return errors.New("come back later")
+		}
+		return nil
+	})
+	y.AfterLogin(record("after_login"))
+	y.AfterLogout(record("after_logout"))
+	y.OnLoginFailure(record("login_failure"))
+
+	register := func(email, first string) int {
+		res, err := client.PostForm(ts.URL+rPath, url.Values{
+			"FirstName": {first}, "LastName": {"warlock"}, "Email": {email},
+			"Password": {"open sesame 42"}, "ConfirmPassword": {"open sesame 42"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	login := func(email, pass string) {
+		res, err := client.PostForm(ts.URL+lPath, url.Values{"Email": {email}, "Password": {pass}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	logout := func() {
+		res, err := client.PostForm(ts.URL+oPath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	// Veto
+	if code := register("eve@blocked.com", "eve"); code != http.StatusForbidden {
+		t.Errorf("Expected %d actual %d", http.StatusForbidden, code)
+	}
+	if _, err := y.ustore.GetUser("eve@blocked.com"); err == nil {
+		t.Error("Expected no user to be created")
+	}
+
+	register("me@me.com", "young")
+	usr, err := y.ustore.GetUser("me@me.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !usr.HasRole("trial") {
+		t.Errorf("Expected [trial] actual %v", usr.Roles)
+	}
+	logout()
+	login("me@me.com", "wrong")
+	login("nobody@me.com", "wrong")
+	login("me@me.com", "open sesame 42")
+	logout()
+
+	register("banned@me.com", "banned")
+	logout()
+	login("banned@me.com", "open sesame 42")
+
+	expect := []string{
+		"after_register me@me.com",
+		"after_logout me@me.com",
+		"login_failure me@me.com",
+		"login_failure nobody@me.com",
+		"after_login me@me.com",
+		"after_logout me@me.com",
+		"after_register banned@me.com",
+		"after_logout banned@me.com",
+		"login_failure banned@me.com",
+	}
+	if strings.Join(events, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("Expected %v actual %v", expect, events)
+	}
+}
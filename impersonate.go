@@ -0,0 +1,128 @@
+package warlock
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/gernest/render"
+	"github.com/gorilla/sessions"
+)
+
+// impersonate switches the session of the admin to the user given by the email form value.
+// The admin is kept in the session so StopImpersonating can switch back, other admins and
+// locked accounts can not be impersonated.
+func (a *admin) impersonate(w http.ResponseWriter, r *http.Request) {
+	me, _ := CurrentUser(r.Context())
+	usr, err := a.h.ustore.GetUser(r.FormValue("email"))
+	if err != nil {
+		a.h.rendr.HTML(w, http.StatusNotFound, a.h.cfg.NotFoundTmpl, nil)
+		return
+	}
+	back := a.prefix + "/user?" + url.Values{"email": {usr.Email}}.Encode()
+	flash := NewFlash()
+	switch {
+	case usr.Email == me.Email:
+		flash.Error("you can not impersonate your own account")
+	case usr.HasRole(RoleAdmin):
+		flash.Error("admins can not be impersonated")
+	case usr.Disabled || usr.ResetRequired:
+		flash.Error("locked accounts can not be impersonated")
+	}
+	ss, ok := CurrentSession(r.Context())
+	if len(flash.Data) > 0 || !ok {
+		a.redirect(w, r, flash, back)
+		return
+	}
+	ss.Values[sessionImpersonatorKey] = me.Email
+	ss.Values[sessionUserKey] = usr.Email
+	delete(ss.Values, sessionOrgKey)
+	if err = ss.Save(r, w); err != nil {
+		log.Println(err)
+		a.h.rendr.HTML(w, http.StatusInternalServerError, a.h.cfg.ServerErrTmpl, nil)
+		return
+	}
+	a.h.audit(me.Email, usr.Email, AuditImpersonate, "")
+	http.Redirect(w, r, a.h.cfg.LoginRedir, http.StatusFound)
+}
+
+// StopImpersonating is a http handler switching an impersonation session back to the admin
+// who started it, who is sent to the next value or the home page. It is meant to be
+// mounted at Config.StopImpersonatePath which the banner of TemplateData posts to.
+func (h *Handlers) StopImpersonating(w http.ResponseWriter, r *http.Request) {
+	asJSON := wantsJSON(r)
+	ss, err := h.sess.New(r, h.cfg.SessName)
+	if err != nil || ss.IsNew {
+		h.notImpersonating(w, r, asJSON)
+		return
+	}
+	admin, ok := ss.Values[sessionImpersonatorKey].(string)
+	if !ok {
+		h.notImpersonating(w, r, asJSON)
+		return
+	}
+	email, _ := ss.Values[sessionUserKey].(string)
+	ss.Values[sessionUserKey] = admin
+	delete(ss.Values, sessionImpersonatorKey)
+	delete(ss.Values, sessionOrgKey)
+	if err = ss.Save(r, w); err != nil {
+		log.Println(err)
+	}
+	h.audit(admin, email, AuditStopImpersonate, "")
+	if asJSON {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	next := r.FormValue("next")
+	if !safeRedirect(next) {
+		next = "/"
+	}
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+func (h *Handlers) notImpersonating(w http.ResponseWriter, r *http.Request, asJSON bool) {
+	if asJSON {
+		h.rendr.JSON(w, http.StatusBadRequest, apiResponse{Error: "not impersonating"})
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// impersonator returns the admin impersonating the user of the session, it is nil when
+// there is none or the admin is no longer allowed to
+func (h *Handlers) impersonator(ss *sessions.Session) *User {
+	email, ok := ss.Values[sessionImpersonatorKey].(string)
+	if !ok {
+		return nil
+	}
+	admin, err := h.ustore.GetUser(email)
+	if err != nil || admin.Disabled || !admin.HasRole(RoleAdmin) {
+		return nil
+	}
+	return admin
+}
+
+// TemplateData returns template data describing the current user for application pages.
+// It holds current_user when someone is logged in, and impersonating along with the
+// impersonator and stop_impersonate_path when an admin impersonates the user, so layouts
+// can show a banner with a button to stop.
+func (h *Handlers) TemplateData(r *http.Request) render.TemplateData {
+	data := render.NewTemplateData()
+	usr, ok := CurrentUser(r.Context())
+	admin, _ := CurrentImpersonator(r.Context())
+	if !ok {
+		var ss *sessions.Session
+		if usr, ss = h.sessionUser(r); usr != nil {
+			admin = h.impersonator(ss)
+		}
+	}
+	if usr != nil {
+		data.Add("current_user", usr.Public())
+	}
+	data.Add("impersonating", admin != nil)
+	if admin != nil {
+		data.Add("impersonator", admin.Public())
+		data.Add("stop_impersonate_path", h.cfg.StopImpersonatePath)
+	}
+	return data
+}
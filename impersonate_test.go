@@ -0,0 +1,96 @@
+package warlock
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHandlers_Impersonate(t *testing.T) {
+	ts, client, y := testServer(t)
+	defer ts.Close()
+	defer cleanUp("warlock_test.db")
+
+	for _, e := range []string{"admin@me.com", "root@me.com", "bob@me.com"} {
+		usr := &User{Email: e, FirstName: "x", Password: "pass"}
+		if e != "bob@me.com" {
+			usr.Roles = []string{RoleAdmin}
+		}
+		if err := y.ustore.CreateUser(usr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(res *http.Response, err error) (int, string) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		buf := new(bytes.Buffer)
+		io.Copy(buf, res.Body)
+		return res.StatusCode, buf.String()
+	}
+	whoami := func() string {
+		_, body := read(client.Get(ts.URL + mPath))
+		return body
+	}
+	impersonate := func(email string) string {
+		token := adminToken(t, client, ts.URL)
+		_, body := read(client.PostForm(ts.URL+dPath+"/user/impersonate", url.Values{"email": {email}, "csrf_token": {token}}))
+		return body
+	}
+
+	read(client.PostForm(ts.URL+lPath, url.Values{"Email": {"admin@me.com"}, "Password": {"pass"}}))
+	if body := whoami(); body != "admin@me.com impersonating=false" {
+		t.Errorf("Expected admin actual %s", body)
+	}
+
+	// Other admins are off limits
+	if body := impersonate("root@me.com"); !strings.Contains(body, "admins can not be impersonated") {
+		t.Errorf("Expected an error actual %s", body)
+	}
+	if body := whoami(); body != "admin@me.com impersonating=false" {
+		t.Errorf("Expected admin actual %s", body)
+	}
+
+	impersonate("bob@me.com")
+	if body := whoami(); body != "bob@me.com impersonating=true" {
+		t.Errorf("Expected bob actual %s", body)
+	}
+	// The dashboard is out of reach while impersonating
+	if code, _ := read(client.Get(ts.URL + dPath + "/")); code != http.StatusForbidden {
+		t.Errorf("Expected %d actual %d", http.StatusForbidden, code)
+	}
+
+	// Granting bob the admin role ends the impersonation
+	if err := GrantRole(y.ustore, "bob@me.com", RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if body := whoami(); body != "" {
+		t.Errorf("Expected nobody actual %s", body)
+	}
+	if err := RevokeRole(y.ustore, "bob@me.com", RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+
+	read(client.PostForm(ts.URL+xPath, nil))
+	if body := whoami(); body != "admin@me.com impersonating=false" {
+		t.Errorf("Expected admin actual %s", body)
+	}
+
+	events, err := y.auditLog.Events("bob@me.com", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, ev := range events {
+		if ev.Actor == "admin@me.com" {
+			actions = append(actions, ev.Action)
+		}
+	}
+	if strings.Join(actions, ",") != AuditStopImpersonate+","+AuditImpersonate {
+		t.Errorf("Expected start and stop events actual %v", actions)
+	}
+}
@@ -0,0 +1,341 @@
+package warlock
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gernest/render"
+)
+
+// InviteBucket is the bucket used by YoungWarlock for invitations
+const InviteBucket = "invitations"
+
+var (
+	// ErrInviteNotFound is returned for unknown invitation codes
+	ErrInviteNotFound = errors.New("warlock: invitation not found")
+
+	// ErrInviteExpired is returned for invitations past their expiry
+	ErrInviteExpired = errors.New("warlock: invitation expired")
+
+	// ErrInviteUsedUp is returned for invitations which reached their maximum uses
+	ErrInviteUsedUp = errors.New("warlock: invitation used up")
+
+	// ErrInviteEmail is returned when the invitation was made for another email
+	ErrInviteEmail = errors.New("warlock: invitation is for another email")
+)
+
+// Invitation lets people register when Config.InviteOnly is set. Email restricts it to one
+// address when it is set, and Roles are granted to the users who sign up with it. With
+// OrgID set the invitation is to join that organization and Roles apply within it, else
+// they are added to the roles the user got from BeforeRegister hooks.
+// Trusted invitations are made with the command line tool, their roles are granted
+// without checking the inviter still holds the right to grant them.
+type Invitation struct {
+	Code      string
+	Inviter   string
+	Email     string
+	OrgID     string
+	Roles     []string
+	MaxUses   int
+	Uses      int
+	Trusted   bool
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+// Link returns the registration url carrying the invitation code
+func (inv *Invitation) Link(registerPath string) string {
+	return registerPath + "?" + url.Values{"invite": {inv.Code}}.Encode()
+}
+
+// valid checks the invitation can be used by email
+func (inv *Invitation) valid(email string) error {
+	switch {
+	case time.Now().After(inv.ExpiresAt):
+		return ErrInviteExpired
+	case inv.MaxUses > 0 && inv.Uses >= inv.MaxUses:
+		return ErrInviteUsedUp
+	case inv.Email != "" && inv.Email != NormalizeEmail(email):
+		return ErrInviteEmail
+	}
+	return nil
+}
+
+// InviteStore keeps invitations in bolt
+type InviteStore struct {
+	db     string
+	bucket string
+}
+
+// NewInviteStore creates a bolt backed invitation store
+func NewInviteStore(db, bucket string) InviteStore {
+	return InviteStore{db: db, bucket: bucket}
+}
+
+// Create stores a new invitation valid for ttl, a random code is assigned to it
+func (s InviteStore) Create(inv *Invitation, ttl time.Duration) error {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	inv.Code = strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+	inv.Email = NormalizeEmail(inv.Email)
+	inv.Uses = 0
+	inv.CreatedAt = time.Now()
+	inv.ExpiresAt = inv.CreatedAt.Add(ttl)
+	return s.update(func(b *bolt.Bucket) error {
+		return putInvite(b, inv)
+	})
+}
+
+// Get returns the invitation with the given code
+func (s InviteStore) Get(code string) (*Invitation, error) {
+	inv := new(Invitation)
+	err := s.view(func(b *bolt.Bucket) error {
+		return getInvite(b, code, inv)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// List returns the invitations made by inviter, or every invitation when inviter is
+// empty, newest first
+func (s InviteStore) List(inviter string) ([]*Invitation, error) {
+	var list []*Invitation
+	err := s.view(func(b *bolt.Bucket) error {
+		return b.ForEach(func(k, v []byte) error {
+			inv := new(Invitation)
+			if err := json.Unmarshal(v, inv); err != nil {
+				return err
+			}
+			if inviter == "" || inv.Inviter == inviter {
+				list = append(list, inv)
+			}
+			return nil
+		})
+	})
+	if err == ErrInviteNotFound {
+		return nil, nil
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.After(list[j].CreatedAt)
+	})
+	return list, err
+}
+
+// Delete revokes the invitation with the given code
+func (s InviteStore) Delete(code string) error {
+	return s.update(func(b *bolt.Bucket) error {
+		if b.Get([]byte(code)) == nil {
+			return ErrInviteNotFound
+		}
+		return b.Delete([]byte(code))
+	})
+}
+
+// Consume checks the invitation can be used by email and counts one use of it, the
+// check and the count happen in one transaction so concurrent signups can not exceed
+// MaxUses
+func (s InviteStore) Consume(code, email string) (*Invitation, error) {
+	inv := new(Invitation)
+	err := s.update(func(b *bolt.Bucket) error {
+		if err := getInvite(b, code, inv); err != nil {
+			return err
+		}
+		if err := inv.valid(email); err != nil {
+			return err
+		}
+		inv.Uses++
+		return putInvite(b, inv)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// Release gives back a use taken by Consume, for signups which failed after it
+func (s InviteStore) Release(code string) error {
+	return s.update(func(b *bolt.Bucket) error {
+		inv := new(Invitation)
+		if err := getInvite(b, code, inv); err != nil {
+			return err
+		}
+		if inv.Uses > 0 {
+			inv.Uses--
+		}
+		return putInvite(b, inv)
+	})
+}
+
+func (s InviteStore) update(fn func(*bolt.Bucket) error) error {
+	db, err := bolt.Open(s.db, 0600, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(s.bucket))
+		if err != nil {
+			return err
+		}
+		return fn(b)
+	})
+}
+
+// view runs fn in a read-only transaction, there are no invitations until the bucket exists
+func (s InviteStore) view(fn func(*bolt.Bucket) error) error {
+	db, err := bolt.Open(s.db, 0600, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(s.bucket))
+		if b == nil {
+			return ErrInviteNotFound
+		}
+		return fn(b)
+	})
+}
+
+func getInvite(b *bolt.Bucket, code string, inv *Invitation) error {
+	data := b.Get([]byte(code))
+	if data == nil {
+		return ErrInviteNotFound
+	}
+	return json.Unmarshal(data, inv)
+}
+
+func putInvite(b *bolt.Bucket, inv *Invitation) error {
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(inv.Code), data)
+}
+
+// Invite lets logged in users invite people. A GET renders Config.InviteTmpl with the
+// invitations made by the user, a POST creates one from the email, max_uses and roles
+// values, roles being a comma separated list only admins may set. Owners and admins of an
+// organization invite to it with the org value, roles then apply within the organization
+// and can not be above the roles of the inviter, see Membership.CanGrant. Clients asking for json
+// get the invitation with its link, anonymous users are sent to the login page.
+func (h *Handlers) Invite(w http.ResponseWriter, r *http.Request) {
+	asJSON := wantsJSON(r)
+	usr, _ := h.sessionUser(r)
+	if usr == nil {
+		if asJSON {
+			h.rendr.JSON(w, http.StatusUnauthorized, apiResponse{Error: "login required"})
+			return
+		}
+		q := url.Values{"next": {r.URL.RequestURI()}}
+		http.Redirect(w, r, h.cfg.LoginPath+"?"+q.Encode(), http.StatusFound)
+		return
+	}
+	data := render.NewTemplateData()
+	if r.Method == "POST" {
+		req := struct {
+			Email   string   `json:"email"`
+			Org     string   `json:"org"`
+			MaxUses int      `json:"max_uses"`
+			Roles   []string `json:"roles"`
+		}{}
+		if hasJSONBody(r) {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				h.rendr.JSON(w, http.StatusBadRequest, apiResponse{Error: "malformed request"})
+				return
+			}
+		} else {
+			req.Email = r.FormValue("email")
+			req.Org = r.FormValue("org")
+			req.MaxUses, _ = strconv.Atoi(r.FormValue("max_uses"))
+			for _, role := range strings.Split(r.FormValue("roles"), ",") {
+				if role = strings.TrimSpace(role); role != "" {
+					req.Roles = append(req.Roles, role)
+				}
+			}
+		}
+		msg := ""
+		if req.Org != "" {
+			m, err := h.orgs.Member(req.Org, usr.Email)
+			if err != nil || !m.HasRole(OrgRoleOwner, OrgRoleAdmin) {
+				msg = "only organization admins can invite to it"
+			} else {
+				for _, role := range req.Roles {
+					if !m.CanGrant(role) {
+						msg = "you can not grant the " + role + " role"
+						break
+					}
+				}
+			}
+		} else if len(req.Roles) > 0 && !usr.HasRole(RoleAdmin) {
+			msg = "only admins can grant roles"
+		}
+		if msg != "" {
+			if asJSON {
+				h.rendr.JSON(w, http.StatusForbidden, apiResponse{Error: msg})
+				return
+			}
+			h.forbidden(w)
+			return
+		}
+		if req.MaxUses <= 0 {
+			req.MaxUses = 1
+		}
+		inv := &Invitation{
+			Inviter: usr.Email,
+			Email:   req.Email,
+			OrgID:   req.Org,
+			Roles:   req.Roles,
+			MaxUses: req.MaxUses,
+		}
+		if err := h.invites.Create(inv, time.Duration(h.cfg.InviteMaxAge)*time.Second); err != nil {
+			log.Println(err)
+			if asJSON {
+				h.rendr.JSON(w, http.StatusInternalServerError, apiResponse{Error: "failed to create invitation"})
+				return
+			}
+			h.rendr.HTML(w, http.StatusInternalServerError, h.cfg.ServerErrTmpl, nil)
+			return
+		}
+		h.audit(usr.Email, usr.Email, AuditInvite, inv.Email)
+		if asJSON {
+			h.rendr.JSON(w, http.StatusCreated, apiResponse{Invitation: inv.Public(h.cfg.RegisterPath)})
+			return
+		}
+		data.Add("created", inv.Public(h.cfg.RegisterPath))
+	}
+	list, err := h.invites.List(usr.Email)
+	if err != nil {
+		log.Println(err)
+	}
+	var public []*PublicInvitation
+	for _, inv := range list {
+		public = append(public, inv.Public(h.cfg.RegisterPath))
+	}
+	data.Add("invitations", public)
+	h.rendr.HTML(w, http.StatusOK, h.cfg.InviteTmpl, data)
+}
+
+// grantable checks the inviter of inv may still grant its global roles, they may have
+// been demoted or deleted since inviting. Organization roles are checked by joinOrg.
+func (h *Handlers) grantable(inv *Invitation) bool {
+	if inv.OrgID != "" || len(inv.Roles) == 0 || inv.Trusted {
+		return true
+	}
+	inviter, err := h.ustore.GetUser(inv.Inviter)
+	return err == nil && inviter.HasRole(RoleAdmin)
+}
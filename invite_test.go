@@ -0,0 +1,193 @@
+package warlock
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInviteStore(t *testing.T) {
+	defer cleanUp("warlock_test.db")
+	s := NewInviteStore("warlock_test.db", InviteBucket)
+
+	if _, err := s.Consume("nope", "a@me.com"); err != ErrInviteNotFound {
+		t.Errorf("Expected %v actual %v", ErrInviteNotFound, err)
+	}
+
+	inv := &Invitation{Inviter: "admin@me.com", MaxUses: 2, Roles: []string{"staff"}}
+	if err := s.Create(inv, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if inv.Code == "" {
+		t.Error("Expected a code")
+	}
+	for _, e := range []string{"a@me.com", "b@me.com"} {
+		got, err := s.Consume(inv.Code, e)
+		if err != nil {
+			t.Fatalf("Expected nil actual %v", err)
+		}
+		if len(got.Roles) != 1 || got.Roles[0] != "staff" {
+			t.Errorf("Expected [staff] actual %v", got.Roles)
+		}
+	}
+	if _, err := s.Consume(inv.Code, "c@me.com"); err != ErrInviteUsedUp {
+		t.Errorf("Expected %v actual %v", ErrInviteUsedUp, err)
+	}
+	if err := s.Release(inv.Code); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Consume(inv.Code, "c@me.com"); err != nil {
+		t.Errorf("Expected nil actual %v", err)
+	}
+
+	// Restricted to one email
+	only := &Invitation{Inviter: "admin@me.com", Email: "Bob@Me.com", MaxUses: 1}
+	if err := s.Create(only, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Consume(only.Code, "eve@me.com"); err != ErrInviteEmail {
+		t.Errorf("Expected %v actual %v", ErrInviteEmail, err)
+	}
+	if _, err := s.Consume(only.Code, "BOB@me.com"); err != nil {
+		t.Errorf("Expected nil actual %v", err)
+	}
+
+	// Expired
+	old := &Invitation{Inviter: "other@me.com", MaxUses: 1}
+	if err := s.Create(old, -time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Consume(old.Code, "a@me.com"); err != ErrInviteExpired {
+		t.Errorf("Expected %v actual %v", ErrInviteExpired, err)
+	}
+
+	list, err := s.List("admin@me.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Code != only.Code {
+		t.Errorf("Expected 2 invitations newest first actual %+v", list)
+	}
+	if err = s.Delete(old.Code); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Get(old.Code); err != ErrInviteNotFound {
+		t.Errorf("Expected %v actual %v", ErrInviteNotFound, err)
+	}
+}
+
+func TestHandlers_InviteOnly(t *testing.T) {
+	ts, client, y := testServerConfig(t, &Config{InviteOnly: true})
+	defer ts.Close()
+	defer cleanUp("warlock_test.db")
+
+	register := func(v url.Values) (int, string) {
+		res, err := client.PostForm(ts.URL+rPath, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		buf := new(bytes.Buffer)
+		io.Copy(buf, res.Body)
+		return res.StatusCode, buf.String()
+	}
+	form := func(email, invite string) url.Values {
+		return url.Values{
+			"FirstName": {"young"}, "LastName": {"warlock"}, "Email": {email},
+			"Password": {"open sesame 42"}, "ConfirmPassword": {"open sesame 42"},
+			"invite": {invite},
+		}
+	}
+
+	// Without an invitation
+	if code, body := register(form("me@me.com", "")); code != http.StatusForbidden {
+		t.Errorf("Expected %d actual %d %s", http.StatusForbidden, code, body)
+	}
+	if code, _ := register(form("me@me.com", "bogus")); code != http.StatusForbidden {
+		t.Errorf("Expected %d actual %d", http.StatusForbidden, code)
+	}
+	if _, err := y.ustore.GetUser("me@me.com"); err == nil {
+		t.Error("Expected no user to be created")
+	}
+
+	// Anonymous users can not invite
+	res, err := client.Get(ts.URL + iPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.Request.URL.Path != lPath {
+		t.Errorf("Expected a redirect to %s actual %s", lPath, res.Request.URL.Path)
+	}
+
+	// An admin invites with a role
+	admin := &User{Email: "admin@me.com", FirstName: "admin", Password: "pass", Roles: []string{RoleAdmin}}
+	if err = y.ustore.CreateUser(admin); err != nil {
+		t.Fatal(err)
+	}
+	res, err = client.PostForm(ts.URL+lPath, url.Values{"Email": {"admin@me.com"}, "Password": {"pass"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	invite := func(email string) *PublicInvitation {
+		req, _ := http.NewRequest("POST", ts.URL+iPath, strings.NewReader(`{"email":"`+email+`","roles":["staff"]}`))
+		req.Header.Set("Content-Type", "application/json")
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body apiResponse
+		json.NewDecoder(res.Body).Decode(&body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusCreated || body.Invitation == nil {
+			t.Fatalf("Expected %d actual %d %+v", http.StatusCreated, res.StatusCode, body)
+		}
+		return body.Invitation
+	}
+	created := invite("me@me.com")
+	if !strings.HasPrefix(created.Link, rPath+"?invite=") {
+		t.Errorf("Expected a register link actual %s", created.Link)
+	}
+	code := created.Code
+	later := invite("later@me.com").Code
+
+	// A client sent role is ignored, the invitation adds its own to those of hooks
+	y.BeforeRegister(func(r *http.Request, usr *User) error {
+		usr.Roles = append(usr.Roles, "beta")
+		return nil
+	})
+	v := form("me@me.com", code)
+	v.Set("Roles", RoleAdmin)
+	if status, page := register(v); status != http.StatusOK {
+		t.Errorf("Expected %d actual %d %s", http.StatusOK, status, page)
+	}
+	usr, err := y.ustore.GetUser("me@me.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usr.HasRole(RoleAdmin) || !usr.HasRole("staff") || !usr.HasRole("beta") {
+		t.Errorf("Expected [beta staff] actual %v", usr.Roles)
+	}
+
+	// Used up
+	if status, _ := register(form("you@me.com", code)); status != http.StatusForbidden {
+		t.Errorf("Expected %d actual %d", http.StatusForbidden, status)
+	}
+
+	// Roles are checked again on registering, the inviter may have been demoted since
+	if err = RevokeRole(y.ustore, "admin@me.com", RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := register(form("later@me.com", later)); status != http.StatusForbidden {
+		t.Errorf("Expected %d actual %d", http.StatusForbidden, status)
+	}
+	if _, err = y.ustore.GetUser("later@me.com"); err == nil {
+		t.Error("Expected no user to be created")
+	}
+}
@@ -0,0 +1,98 @@
+package warlock
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/gorilla/securecookie"
+)
+
+// defaultSecret is the sample secret shipped with the default configuration
+const defaultSecret = "My-top-secre"
+
+// KeyPair is a base64 encoded pair of keys used for session cookies. The hash key signs
+// the cookie and the block key, when present, encrypts it with AES. The block key is
+// required with the cookie session store, which keeps the session values in the cookie.
+type KeyPair struct {
+	Hash  string `json:"hash"`
+	Block string `json:"block"`
+}
+
+// GenerateKeyPair returns a new pair with a 64 bytes hash key and a 32 bytes block key
+func GenerateKeyPair() (KeyPair, error) {
+	h := securecookie.GenerateRandomKey(64)
+	b := securecookie.GenerateRandomKey(32)
+	if h == nil || b == nil {
+		return KeyPair{}, errors.New("warlock: failed to generate keys")
+	}
+	return KeyPair{
+		Hash:  base64.StdEncoding.EncodeToString(h),
+		Block: base64.StdEncoding.EncodeToString(b),
+	}, nil
+}
+
+// RotateKeys puts a freshly generated pair in front of keys, so new cookies use it while
+// cookies made with the older pairs still decode. Only the keep newest pairs are returned,
+// the rest are retired; keep less than 1 keeps all of them.
+func RotateKeys(keys []KeyPair, keep int) ([]KeyPair, error) {
+	k, err := GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	out := append([]KeyPair{k}, keys...)
+	if keep > 0 && len(out) > keep {
+		out = out[:keep]
+	}
+	return out, nil
+}
+
+// Decode returns the raw hash and block keys, the block key is nil when it is not set
+func (k KeyPair) Decode() (hash, block []byte, err error) {
+	hash, err = base64.StdEncoding.DecodeString(k.Hash)
+	if err != nil {
+		return nil, nil, fmt.Errorf("warlock: invalid hash key: %v", err)
+	}
+	if len(hash) == 0 {
+		return nil, nil, errors.New("warlock: empty hash key")
+	}
+	if k.Block == "" {
+		return hash, nil, nil
+	}
+	block, err = base64.StdEncoding.DecodeString(k.Block)
+	if err != nil {
+		return nil, nil, fmt.Errorf("warlock: invalid block key: %v", err)
+	}
+	switch len(block) {
+	case 16, 24, 32:
+	default:
+		return nil, nil, fmt.Errorf("warlock: block key must be 16, 24 or 32 bytes, got %d", len(block))
+	}
+	return hash, block, nil
+}
+
+// keyPairs returns the hash and block keys for the session codecs ordered from the newest,
+// which is used to encode, to the oldest. Secret comes last so cookies made before the
+// keys were configured keep working, unless it is the sample secret. Secret is only used
+// to encrypt when encrypt is set.
+func (c *Config) keyPairs(encrypt bool) ([][]byte, error) {
+	var pairs [][]byte
+	for _, k := range c.Keys {
+		h, b, err := k.Decode()
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, h, b)
+	}
+	if c.Secret == "" || (len(pairs) > 0 && c.Secret == defaultSecret) {
+		if len(pairs) == 0 {
+			return nil, errors.New("warlock: no session keys configured")
+		}
+		return pairs, nil
+	}
+	secret := []byte(c.Secret)
+	if encrypt {
+		return append(pairs, secret, blockKey(secret)), nil
+	}
+	return append(pairs, secret, nil), nil
+}
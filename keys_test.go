@@ -0,0 +1,126 @@
+package warlock
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+func TestGenerateKeyPair(t *testing.T) {
+	k, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, b, err := k.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h) != 64 || len(b) != 32 {
+		t.Errorf("Expected 64 and 32 bytes keys actual %d and %d", len(h), len(b))
+	}
+	for _, v := range []KeyPair{{}, {Hash: "%%%"}, {Hash: k.Hash, Block: "c2hvcnQ="}} {
+		if _, _, err = v.Decode(); err == nil {
+			t.Errorf("Expected an error decoding %v", v)
+		}
+	}
+}
+
+func TestRotateKeys(t *testing.T) {
+	var keys []KeyPair
+	var err error
+	for i := 0; i < 4; i++ {
+		prev := keys
+		keys, err = RotateKeys(keys, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(prev) > 0 && keys[1] != prev[0] {
+			t.Errorf("Expected the previous newest key to come second")
+		}
+	}
+	if len(keys) != 3 {
+		t.Errorf("Expected 3 actual %d", len(keys))
+	}
+}
+
+func TestConfig_keyPairs(t *testing.T) {
+	k, _ := GenerateKeyPair()
+	c := NewConfig(&Config{Keys: []KeyPair{k}})
+	pairs, err := c.keyPairs(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the sample secret must never be accepted once real keys are configured
+	if len(pairs) != 2 {
+		t.Errorf("Expected 2 actual %d", len(pairs))
+	}
+	c.Secret = "an-older-secret"
+	pairs, err = c.keyPairs(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 4 || string(pairs[2]) != c.Secret || pairs[3] != nil {
+		t.Errorf("Expected the secret to come last actual %v", pairs)
+	}
+	if _, err = (&Config{}).keyPairs(false); err == nil {
+		t.Error("Expected an error without keys")
+	}
+}
+
+func TestSess_rotation(t *testing.T) {
+	old, _ := GenerateKeyPair()
+	opts := &sessions.Options{MaxAge: maxAge, Path: sPath}
+	c := NewConfig(&Config{DB: dbName, Keys: []KeyPair{old}, SessStore: SessMemory})
+	store, err := newSessionStore(c, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", testURL, nil)
+	s, _ := store.New(req, cName)
+	s.Values["user"] = "gernest"
+	w := httptest.NewRecorder()
+	if err = s.Save(req, w); err != nil {
+		t.Fatal(err)
+	}
+	oldCookie := w.Result().Cookies()[0]
+
+	// rotate, the old cookie keeps working
+	mem := store.(MemSess)
+	c.Keys, err = RotateKeys(c.Keys, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := c.keyPairs(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem.codecs = securecookie.CodecsFromPairs(keys...)
+	req, _ = http.NewRequest("GET", testURL, nil)
+	req.AddCookie(oldCookie)
+	ss, err := mem.New(req, cName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ss.Values["user"] != "gernest" {
+		t.Errorf("Expected gernest actual %v", ss.Values["user"])
+	}
+
+	// new cookies use the newest key
+	w = httptest.NewRecorder()
+	if err = ss.Save(req, w); err != nil {
+		t.Fatal(err)
+	}
+	newCookie := w.Result().Cookies()[0]
+	var id string
+	if err = securecookie.DecodeMulti(cName, newCookie.Value, &id, securecookie.CodecsFromPairs(keys[:2]...)...); err != nil {
+		t.Errorf("Expected the newest key to decode the cookie: %v", err)
+	}
+	oh, ob, _ := old.Decode()
+	if err = securecookie.DecodeMulti(cName, newCookie.Value, &id, securecookie.CodecsFromPairs(oh, ob)...); err == nil {
+		t.Error("Expected the retired key not to decode a new cookie")
+	}
+}
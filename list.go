@@ -0,0 +1,106 @@
+package warlock
+
+import (
+	"strings"
+	"time"
+)
+
+// DefaultListLimit is the page size used by List when ListOptions.Limit is not set
+const DefaultListLimit = 50
+
+// ListOptions selects the users returned by List, the zero value pages through everyone.
+// Users are always ordered by email.
+type ListOptions struct {
+	// Cursor is the Next value of the previous page, the page starts after it
+	Cursor string
+
+	// Limit is the number of users in a page
+	Limit int
+
+	// CreatedAfter and CreatedBefore bound the creation time when they are set
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+
+	// Verified and Disabled match the flags of the user when they are set
+	Verified *bool
+	Disabled *bool
+
+	// Role keeps the users granted the role
+	Role string
+
+	// Prefix keeps the users whose email starts with it
+	Prefix string
+
+	// Search keeps the users whose email, first or last name contain it, ignoring case
+	Search string
+}
+
+// UserPage is a page of users returned by List
+type UserPage struct {
+	Users []*User
+
+	// Next is the cursor of the following page, it is empty on the last page
+	Next string
+}
+
+func (o ListOptions) limit() int {
+	if o.Limit <= 0 {
+		return DefaultListLimit
+	}
+	return o.Limit
+}
+
+// start is the first email the listing may return, the cursor itself is skipped
+func (o ListOptions) start() string {
+	if o.Cursor > o.Prefix {
+		return o.Cursor
+	}
+	return o.Prefix
+}
+
+// match reports whether usr passes the filters, the cursor and prefix are left to callers
+// which can use them to seek
+func (o ListOptions) match(usr *User) bool {
+	switch {
+	case !o.CreatedAfter.IsZero() && !usr.CreatedAt.After(o.CreatedAfter):
+		return false
+	case !o.CreatedBefore.IsZero() && !usr.CreatedAt.Before(o.CreatedBefore):
+		return false
+	case o.Verified != nil && usr.Verified != *o.Verified:
+		return false
+	case o.Disabled != nil && usr.Disabled != *o.Disabled:
+		return false
+	case o.Role != "" && !usr.HasRole(o.Role):
+		return false
+	}
+	return matchUser(usr, o.Search)
+}
+
+// pager collects the matching users of a listing walked in email order
+type pager struct {
+	opts ListOptions
+	page UserPage
+}
+
+// add offers the next user and reports whether the page is full, one user past the limit
+// is needed to know there is a next page
+func (p *pager) add(usr *User) bool {
+	if usr.Email <= p.opts.Cursor && p.opts.Cursor != "" {
+		return false
+	}
+	if !strings.HasPrefix(usr.Email, p.opts.Prefix) || !p.opts.match(usr) {
+		return false
+	}
+	if len(p.page.Users) == p.opts.limit() {
+		p.page.Next = p.page.Users[len(p.page.Users)-1].Email
+		return true
+	}
+	p.page.Users = append(p.page.Users, usr)
+	return false
+}
+
+// pastPrefix reports whether email sorts after every email carrying the prefix, listings
+// walked in email order can stop there
+func (o ListOptions) pastPrefix(email string) bool {
+	return o.Prefix != "" && !strings.HasPrefix(email, o.Prefix) && email > o.Prefix
+}
@@ -0,0 +1,197 @@
+package warlock
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// MemUserStore keeps users in memory, it is meant for tests and throwaway deployments
+type MemUserStore struct {
+	mu     sync.RWMutex
+	users  map[string][]byte
+	hasher Hasher
+}
+
+// NewMemUserStore returns an empty in memory user store, passwords are hashed with the
+// given hasher or with bcrypt at the default cost when none is given.
+func NewMemUserStore(h ...Hasher) *MemUserStore {
+	return &MemUserStore{users: make(map[string][]byte), hasher: pickHasher(h)}
+}
+
+// CreateUser creates a new user, the normalized email is used as the key.
+func (ms *MemUserStore) CreateUser(usr *User) error {
+	normalizeUser(usr)
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.users[usr.Email]; ok {
+		return ErrUserExists
+	}
+	if ms.usernameTaken(usr) {
+		return ErrUsernameExists
+	}
+	if err := prepareUser(usr, ms.hasher); err != nil {
+		return err
+	}
+	return ms.put(usr)
+}
+
+// GetUser retrives a user given a valid email address
+func (ms *MemUserStore) GetUser(email string) (*User, error) {
+	key := NormalizeEmail(email)
+	ms.mu.RLock()
+	data, ok := ms.users[key]
+	ms.mu.RUnlock()
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	usr := new(User)
+	if err := unmarshalUser(data, usr); err != nil {
+		return nil, err
+	}
+	if outdated(KindUser, data) {
+		ms.writeBack(key, data)
+	}
+	return usr, nil
+}
+
+// writeBack stores the upgraded form of a record read at an older schema version, unless
+// it changed since it was read
+func (ms *MemUserStore) writeBack(key string, stale []byte) {
+	out, changed, err := upgrade(KindUser, stale)
+	if err != nil || !changed {
+		return
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if bytes.Equal(ms.users[key], stale) {
+		ms.users[key] = out
+	}
+}
+
+// UpdateUser updates user
+func (ms *MemUserStore) UpdateUser(usr *User) error {
+	usr.Email = NormalizeEmail(usr.Email)
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.users[usr.Email]; !ok {
+		return ErrUserNotFound
+	}
+	if ms.usernameTaken(usr) {
+		return ErrUsernameExists
+	}
+	usr.UpdatedAt = time.Now()
+	return ms.put(usr)
+}
+
+// Exist checks if a give user already exists
+func (ms *MemUserStore) Exist(usr *User) bool {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	_, ok := ms.users[NormalizeEmail(usr.Email)]
+	return ok
+}
+
+// DeleteUser removes the user with the given email
+func (ms *MemUserStore) DeleteUser(email string) error {
+	email = NormalizeEmail(email)
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.users[email]; !ok {
+		return ErrUserNotFound
+	}
+	delete(ms.users, email)
+	return nil
+}
+
+// ListUsers returns all users ordered by email
+func (ms *MemUserStore) ListUsers() ([]*User, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	var users []*User
+	for _, data := range ms.users {
+		usr := new(User)
+		if err := unmarshalUser(data, usr); err != nil {
+			return nil, err
+		}
+		users = append(users, usr)
+	}
+	sortUsers(users)
+	return users, nil
+}
+
+// List returns a page of the users matching the options
+func (ms *MemUserStore) List(opts ListOptions) (*UserPage, error) {
+	users, err := ms.ListUsers()
+	if err != nil {
+		return nil, err
+	}
+	p := &pager{opts: opts}
+	for _, usr := range users {
+		if p.add(usr) {
+			break
+		}
+	}
+	return &p.page, nil
+}
+
+// GetUserByID retrives a user given its ID
+func (ms *MemUserStore) GetUserByID(id string) (*User, error) {
+	return ms.find(func(usr *User) bool { return usr.ID == id })
+}
+
+// GetUserByUsername retrives a user given its username, ignoring case
+func (ms *MemUserStore) GetUserByUsername(username string) (*User, error) {
+	key := usernameKey(username)
+	return ms.find(func(usr *User) bool { return usr.Username != "" && usernameKey(usr.Username) == key })
+}
+
+// find returns the first user matching, there are no indexes so every user is decoded
+func (ms *MemUserStore) find(match func(*User) bool) (*User, error) {
+	ms.mu.RLock()
+	for key, data := range ms.users {
+		usr := new(User)
+		if err := unmarshalUser(data, usr); err != nil {
+			ms.mu.RUnlock()
+			return nil, err
+		}
+		if match(usr) {
+			ms.mu.RUnlock()
+			if outdated(KindUser, data) {
+				ms.writeBack(key, data)
+			}
+			return usr, nil
+		}
+	}
+	ms.mu.RUnlock()
+	return nil, ErrUserNotFound
+}
+
+// usernameTaken reports whether another user has the username of usr, the lock must be held
+func (ms *MemUserStore) usernameTaken(usr *User) bool {
+	if usr.Username == "" {
+		return false
+	}
+	key := usernameKey(usr.Username)
+	for email, data := range ms.users {
+		other := new(User)
+		if email == usr.Email || json.Unmarshal(data, other) != nil {
+			continue
+		}
+		if other.Username != "" && usernameKey(other.Username) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// put stores the encoded user so callers never share memory with the store
+func (ms *MemUserStore) put(usr *User) error {
+	data, err := marshalUser(usr)
+	if err != nil {
+		return err
+	}
+	ms.users[usr.Email] = data
+	return nil
+}
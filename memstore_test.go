@@ -0,0 +1,28 @@
+package warlock
+
+import "testing"
+
+func TestMemUserStore(t *testing.T) {
+	testUserStorer(t, NewMemUserStore())
+}
+
+func TestMemUserStore_update(t *testing.T) {
+	ms := NewMemUserStore()
+	if err := ms.UpdateUser(&User{Email: "gernest@home.com"}); err != ErrUserNotFound {
+		t.Errorf("Expected %v actual %v", ErrUserNotFound, err)
+	}
+	usr := &User{Email: "gernest@home.com", Roles: []string{RoleAdmin}}
+	if err := ms.CreateUser(usr); err != nil {
+		t.Fatal(err)
+	}
+
+	// changes are not visible until they are saved
+	usr.Roles[0] = "staff"
+	u, err := ms.GetUser(usr.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.HasRole(RoleAdmin) {
+		t.Errorf("Expected %s actual %v", RoleAdmin, u.Roles)
+	}
+}
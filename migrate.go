@@ -0,0 +1,212 @@
+package warlock
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+)
+
+// Kinds of stored records which carry a schema version
+const (
+	KindUser    = "user"
+	KindSession = "session"
+)
+
+// MetaBucket keeps the schema version applied to each bucket by the bulk migrations
+const MetaBucket = "warlock_meta"
+
+// schemaKey is the json key holding the schema version of a stored record, records
+// written before versions existed have none and are at version 0
+const schemaKey = "schema_version"
+
+// MigrationFunc upgrades a stored record by one version. It works on the decoded json so
+// fields which are no longer in the Go struct can still be read.
+type MigrationFunc func(rec map[string]interface{}) error
+
+var migrations = map[string][]MigrationFunc{
+	KindUser: {
+		// 0 -> 1: the address as typed used to be the only email
+		func(rec map[string]interface{}) error {
+			if s, _ := rec["DisplayEmail"].(string); s == "" {
+				rec["DisplayEmail"] = rec["Email"]
+			}
+			return nil
+		},
+	},
+	KindSession: {
+		// 0 -> 1: only the version is added
+		func(rec map[string]interface{}) error { return nil },
+	},
+}
+
+// RegisterMigration adds the next migration of the kind and returns the version records
+// are upgraded to, it is meant to be called from init functions. Stored records are
+// upgraded by the bulk Migrate methods of the stores, and when they are read, users
+// fetched one at a time are then written back upgraded.
+func RegisterMigration(kind string, up MigrationFunc) int {
+	migrations[kind] = append(migrations[kind], up)
+	return len(migrations[kind])
+}
+
+// SchemaVersion returns the version records of the kind are written with
+func SchemaVersion(kind string) int {
+	return len(migrations[kind])
+}
+
+// upgrade runs the pending migrations of a stored record and reports whether it changed.
+// Records written by a newer version are refused rather than silently losing fields.
+func upgrade(kind string, data []byte) ([]byte, bool, error) {
+	var peek struct {
+		V int `json:"schema_version"`
+	}
+	if err := json.Unmarshal(data, &peek); err != nil {
+		return nil, false, err
+	}
+	current := SchemaVersion(kind)
+	if peek.V == current {
+		return data, false, nil
+	}
+	if peek.V > current {
+		return nil, false, fmt.Errorf("warlock: %s record has schema version %d, this build knows up to %d", kind, peek.V, current)
+	}
+	rec := make(map[string]interface{})
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, false, err
+	}
+	for v := peek.V; v < current; v++ {
+		if err := migrations[kind][v](rec); err != nil {
+			return nil, false, fmt.Errorf("warlock: migrating %s record to version %d: %v", kind, v+1, err)
+		}
+	}
+	rec[schemaKey] = current
+	out, err := json.Marshal(rec)
+	if err != nil {
+		return nil, false, err
+	}
+	return out, true, nil
+}
+
+// outdated reports whether a stored record of the kind was written at an older schema
+// version, stores use it to write back the records they upgraded on read
+func outdated(kind string, data []byte) bool {
+	var peek struct {
+		V int `json:"schema_version"`
+	}
+	return json.Unmarshal(data, &peek) == nil && peek.V < SchemaVersion(kind)
+}
+
+// unmarshalUser decodes a stored user, upgrading it to the current schema
+func unmarshalUser(data []byte, usr *User) error {
+	data, _, err := upgrade(KindUser, data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, usr)
+}
+
+// marshalUser encodes a user with the current schema version
+func marshalUser(usr *User) ([]byte, error) {
+	usr.SchemaVersion = SchemaVersion(KindUser)
+	return json.Marshal(usr)
+}
+
+// unmarshalSession decodes a stored bolt session, upgrading it to the current schema
+func unmarshalSession(data []byte, v *sessionValue) error {
+	data, _, err := upgrade(KindSession, data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// migrateBucket upgrades every record of the bucket and stores the applied version in
+// the meta bucket, it returns how many records were rewritten
+func migrateBucket(db, bucket, kind string) (int, error) {
+	conn, err := bolt.Open(db, 0600, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	n := 0
+	err = conn.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		changed := make(map[string][]byte)
+		err = b.ForEach(func(k, v []byte) error {
+			out, ok, err := upgrade(kind, v)
+			if err != nil {
+				return fmt.Errorf("%s: %v", k, err)
+			}
+			if ok {
+				changed[string(k)] = out
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// bolt does not allow changing a bucket while iterating over it
+		for k, v := range changed {
+			if err = b.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		n = len(changed)
+		meta, err := tx.CreateBucketIfNotExists([]byte(MetaBucket))
+		if err != nil {
+			return err
+		}
+		return meta.Put([]byte(bucket), []byte(strconv.Itoa(SchemaVersion(kind))))
+	})
+	return n, err
+}
+
+// appliedVersion returns the schema version the last bulk migration left the bucket at,
+// it is 0 when the bucket was never migrated
+func appliedVersion(db, bucket string) (int, error) {
+	conn, err := bolt.Open(db, 0600, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	v := 0
+	err = conn.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(MetaBucket))
+		if meta == nil {
+			return nil
+		}
+		if data := meta.Get([]byte(bucket)); data != nil {
+			var err error
+			v, err = strconv.Atoi(string(data))
+			return err
+		}
+		return nil
+	})
+	return v, err
+}
+
+// Migrate upgrades every stored user to the current schema and records the version in
+// the meta bucket, it returns how many users were rewritten. The indexes are rebuilt
+// afterwards, which fills the role index of databases written before it existed.
+func (us UserStore) Migrate() (int, error) {
+	n, err := migrateBucket(us.db, us.bucket, KindUser)
+	if err != nil {
+		return n, err
+	}
+	return n, us.Reindex()
+}
+
+// AppliedVersion returns the user schema version recorded by the last Migrate
+func (us UserStore) AppliedVersion() (int, error) {
+	return appliedVersion(us.db, us.bucket)
+}
+
+// Migrate upgrades every stored session to the current schema and records the version in
+// the meta bucket, it returns how many sessions were rewritten
+func (s Sess) Migrate() (int, error) {
+	return migrateBucket(s.db, s.bucket, KindSession)
+}
@@ -0,0 +1,165 @@
+package warlock
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// putRaw writes records straight into a bolt bucket, like older versions did
+func putRaw(t *testing.T, db, bucket string, records map[string]string) {
+	conn, err := bolt.Open(db, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = conn.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		for k, v := range records {
+			if err = b.Put([]byte(k), []byte(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// getRaw reads a record straight from a bolt bucket
+func getRaw(t *testing.T, db, bucket, key string) string {
+	conn, err := bolt.Open(db, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var data string
+	conn.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(bucket)); b != nil {
+			data = string(b.Get([]byte(key)))
+		}
+		return nil
+	})
+	return data
+}
+
+func TestUpgrade(t *testing.T) {
+	out, changed, err := upgrade(KindUser, []byte(`{"Email":"me@me.com"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error("Expected the record to change")
+	}
+	usr := new(User)
+	if err = json.Unmarshal(out, usr); err != nil {
+		t.Fatal(err)
+	}
+	if usr.DisplayEmail != "me@me.com" || usr.SchemaVersion != SchemaVersion(KindUser) {
+		t.Errorf("Expected an upgraded user actual %+v", usr)
+	}
+	if _, changed, _ = upgrade(KindUser, out); changed {
+		t.Error("Expected current records to be left alone")
+	}
+	if _, _, err = upgrade(KindUser, []byte(`{"schema_version":99}`)); err == nil || !strings.Contains(err.Error(), "99") {
+		t.Errorf("Expected newer records to be refused actual %v", err)
+	}
+}
+
+func TestRegisterMigration(t *testing.T) {
+	saved := migrations[KindUser]
+	defer func() { migrations[KindUser] = saved }()
+
+	v := RegisterMigration(KindUser, func(rec map[string]interface{}) error {
+		rec["FirstName"] = rec["Name"]
+		return nil
+	})
+	if v != len(saved)+1 || SchemaVersion(KindUser) != v {
+		t.Errorf("Expected version %d actual %d", len(saved)+1, v)
+	}
+	usr := new(User)
+	if err := unmarshalUser([]byte(`{"Email":"me@me.com","Name":"young"}`), usr); err != nil {
+		t.Fatal(err)
+	}
+	if usr.FirstName != "young" || usr.DisplayEmail != "me@me.com" {
+		t.Errorf("Expected both migrations to run actual %+v", usr)
+	}
+}
+
+func TestUserStore_Migrate(t *testing.T) {
+	ns := NewUserStore("migrate.db", "account")
+	defer ns.store.DeleteDatabase()
+	if err := ns.CreateUser(&User{Email: "new@me.com"}); err != nil {
+		t.Fatal(err)
+	}
+	putRaw(t, "migrate.db", "account", map[string]string{
+		"old@me.com":   `{"ID":"1","Email":"old@me.com"}`,
+		"older@me.com": `{"ID":"2","Email":"older@me.com"}`,
+	})
+
+	// lazily on read, the upgraded record is written back
+	usr, err := ns.GetUser("old@me.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usr.DisplayEmail != "old@me.com" {
+		t.Errorf("Expected old@me.com actual %s", usr.DisplayEmail)
+	}
+	if raw := getRaw(t, "migrate.db", "account", "old@me.com"); outdated(KindUser, []byte(raw)) {
+		t.Errorf("Expected the upgraded record on disk actual %s", raw)
+	}
+
+	// in bulk
+	if v, _ := ns.AppliedVersion(); v != 0 {
+		t.Errorf("Expected 0 actual %d", v)
+	}
+	n, err := ns.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Expected 1 actual %d", n)
+	}
+	if v, _ := ns.AppliedVersion(); v != SchemaVersion(KindUser) {
+		t.Errorf("Expected %d actual %d", SchemaVersion(KindUser), v)
+	}
+	if n, _ = ns.Migrate(); n != 0 {
+		t.Errorf("Expected nothing left to migrate actual %d", n)
+	}
+}
+
+func TestSess_Migrate(t *testing.T) {
+	store, _ := sessSetup(t)
+	defer store.store.DeleteDatabase()
+	putRaw(t, dbName, sBucket, map[string]string{
+		"old": `{"data":"x","expires":"2000-01-01T00:00:00Z"}`,
+	})
+	n, err := store.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Expected 1 actual %d", n)
+	}
+}
+
+func TestMemUserStore_upgradeOnRead(t *testing.T) {
+	ms := NewMemUserStore()
+	ms.users["old@me.com"] = []byte(`{"Email":"old@me.com"}`)
+	usr, err := ms.GetUser("old@me.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usr.DisplayEmail != "old@me.com" {
+		t.Errorf("Expected old@me.com actual %s", usr.DisplayEmail)
+	}
+	if raw := ms.users["old@me.com"]; outdated(KindUser, raw) {
+		t.Errorf("Expected the upgraded record to be kept actual %s", raw)
+	}
+}
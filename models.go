@@ -6,7 +6,6 @@ import (
 
 	valid "github.com/asaskevich/govalidator"
 	"github.com/fatih/structs"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // user contain account information of a user
@@ -15,30 +14,96 @@ type User struct {
 	FirstName       string `valid:"alphanum,required"`
 	LastName        string `valid:"alphanum,required"`
 	Email           string `valid:"email,required"`
-	Password        string `valid:"alphanum,required"`
-	ConfirmPassword string `valid:"alphanum,required" json:"-"`
+	DisplayEmail    string
+	Username        string `valid:"matches(^[a-zA-Z0-9_.-]+$),optional"`
+	Password        string `valid:"required"`
+	ConfirmPassword string `valid:"required" json:"-"`
+	Roles           []string
+	Permissions     []string
+	Disabled        bool
+	Verified        bool
+	ResetRequired   bool
 	CreatedAt       time.Time
 	UpdatedAt       time.Time
+	SchemaVersion   int `json:"schema_version"`
 }
 
+// RoleAdmin is the role given to users allowed to manage other accounts
+const RoleAdmin = "admin"
+
 // Config a basic configuration settings
 type Config struct {
-	RegisterTmpl  string `json:"reg_templ"`
-	LoginTmpl     string `json:"login_templ"`
-	NotFoundTmpl  string `json:"not_found_templ"`
-	ServerErrTmpl string `json:"server_error_templ"`
-	DB            string `json:"db"`
-	SessMaxAge    int    `json:"session_max_age"`
-	SessPath      string `json:"session_path"`
-	RegRedir      string `json:"reg_redirect"`
-	LoginRedir    string `json:"login_redirect"`
-	Secret        string `json:"secret"`
-	SessName      string `json:"session_name"`
+	RegisterTmpl  string    `json:"reg_templ"`
+	LoginTmpl     string    `json:"login_templ"`
+	NotFoundTmpl  string    `json:"not_found_templ"`
+	ServerErrTmpl string    `json:"server_error_templ"`
+	DB            string    `json:"db"`
+	SessMaxAge    int       `json:"session_max_age"`
+	SessPath      string    `json:"session_path"`
+	RegRedir      string    `json:"reg_redirect"`
+	LoginRedir    string    `json:"login_redirect"`
+	Secret        string    `json:"secret"`
+	Keys          []KeyPair `json:"keys"`
+	SessName      string    `json:"session_name"`
+	ForbiddenTmpl string    `json:"forbidden_templ"`
+	LoginPath     string    `json:"login_path"`
+	SessStore     string    `json:"session_store"`
+	SessDir       string    `json:"session_dir"`
+	Hasher        string    `json:"hasher"`
+	HashCost      int       `json:"hash_cost"`
+	BreachFile    string    `json:"breach_file"`
+	BreachAction  string    `json:"breach_action"`
+	DevMode       bool      `json:"dev_mode"`
+	SessSecure    *bool     `json:"session_secure"`
+	SessHTTPOnly  *bool     `json:"session_http_only"`
+	SessDomain    string    `json:"session_domain"`
+	SessSameSite  string    `json:"session_same_site"`
+
+	PasswordPolicy *PasswordPolicy `json:"password_policy"`
+
+	AdminUsersTmpl string `json:"admin_users_templ"`
+	AdminUserTmpl  string `json:"admin_user_templ"`
+	AdminPageSize  int    `json:"admin_page_size"`
+
+	StopImpersonatePath string `json:"stop_impersonate_path"`
+
+	Webhooks           []WebhookEndpoint `json:"webhooks"`
+	WebhookMaxAttempts int               `json:"webhook_max_attempts"`
+	AdminWebhooksTmpl  string            `json:"admin_webhooks_templ"`
+
+	InviteOnly   bool   `json:"invite_only"`
+	InviteMaxAge int    `json:"invite_max_age"`
+	InviteTmpl   string `json:"invite_templ"`
+	RegisterPath string `json:"register_path"`
+}
+
+// RegisterForm holds what clients may send when registering, everything else about the
+// account, like roles or the verified flag, is decided by the server
+type RegisterForm struct {
+	FirstName       string `json:"first_name"`
+	LastName        string `json:"last_name"`
+	Email           string `json:"email"`
+	Username        string `json:"username"`
+	Password        string `json:"password"`
+	ConfirmPassword string `json:"confirm_password"`
+	Invite          string `json:"invite" formam:"invite"`
+}
+
+// User returns the new account described by the form
+func (f *RegisterForm) User() *User {
+	return &User{
+		FirstName:       f.FirstName,
+		LastName:        f.LastName,
+		Email:           f.Email,
+		Username:        f.Username,
+		Password:        f.Password,
+		ConfirmPassword: f.ConfirmPassword,
+	}
 }
 
 type LoginForm struct {
 	Email    string `valid:"email,required"`
-	Password string `valid:"alphanum,required"`
+	Password string `valid:"required"`
 }
 
 func (l *LoginForm) Validate() map[string]string {
@@ -77,8 +142,29 @@ func defaultConfig() *Config {
 		SessPath:      "/",
 		RegRedir:      "/auth/login",
 		LoginRedir:    "/",
-		Secret:        "My-top-secre",
+		Secret:        defaultSecret,
 		SessName:      "_wrk",
+		ForbiddenTmpl: "403",
+		LoginPath:     "/auth/login",
+		SessStore:     SessBolt,
+		Hasher:        HashBcrypt,
+		BreachAction:  BreachReject,
+		SessSameSite:  SameSiteLax,
+
+		PasswordPolicy: DefaultPasswordPolicy(),
+
+		AdminUsersTmpl: "admin/users",
+		AdminUserTmpl:  "admin/user",
+		AdminPageSize:  20,
+
+		StopImpersonatePath: "/auth/impersonate/stop",
+
+		WebhookMaxAttempts: 8,
+		AdminWebhooksTmpl:  "admin/webhooks",
+
+		InviteMaxAge: 7 * 24 * 3600,
+		InviteTmpl:   "auth/invite",
+		RegisterPath: "/auth/register",
 	}
 }
 
@@ -100,9 +186,21 @@ func mergeConfig(src *Config, base *Config) *Config {
 }
 
 // Validates checks for the field validation also makes sure password anc ConfirmPassword
-// fields match. This should be Called only when creating a new user
+// fields match and that the password follows the default policy. This should be Called
+// only when creating a new user
 func (usr *User) Validate() map[string]string {
+	return usr.ValidateWith(DefaultPasswordPolicy())
+}
+
+// ValidateWith is like Validate but checks the password against the given policy, each
+// broken rule is reported under the Password.<rule> key
+func (usr *User) ValidateWith(p *PasswordPolicy) map[string]string {
 	m := make(map[string]string)
+	if p != nil {
+		for rule, msg := range p.Check(usr.Password, usr) {
+			m["Password."+rule] = msg
+		}
+	}
 	if ok, errs := valid.ValidateStruct(usr); !ok {
 		switch e := errs.(type) {
 		case valid.Errors:
@@ -124,8 +222,60 @@ func (usr *User) Validate() map[string]string {
 		m["ConfirmPassword"] = m["ConfirmPassword"] + ms
 		return m
 	}
+	if len(m) > 0 {
+		return m
+	}
 	return nil
 }
+
+// MatchPassword checks pass against the stored hash, any of the supported hash formats
+// is accepted
 func (u *User) MatchPassword(pass string) error {
-	return bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(pass))
+	return VerifyPassword(u.Password, pass)
+}
+
+// HasRole returns true if the user has been granted any of the given roles
+func (u *User) HasRole(roles ...string) bool {
+	for _, r := range roles {
+		if hasString(u.Roles, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPermission returns true if the user has been granted all of the given permissions
+func (u *User) HasPermission(perms ...string) bool {
+	for _, p := range perms {
+		if !hasString(u.Permissions, p) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func addString(list []string, s string) []string {
+	if hasString(list, s) {
+		return list
+	}
+	return append(list, s)
+}
+
+func removeString(list []string, s string) []string {
+	var out []string
+	for _, v := range list {
+		if v != s {
+			out = append(out, v)
+		}
+	}
+	return out
 }
@@ -23,3 +23,45 @@ func TestConfig_custom(t *testing.T) {
 		t.Errorf("Expected 30 actual %d", cfg.SessMaxAge)
 	}
 }
+
+func TestUser_roles(t *testing.T) {
+	u := &User{Roles: []string{RoleAdmin}, Permissions: []string{"read", "write"}}
+	if !u.HasRole("staff", RoleAdmin) {
+		t.Errorf("Expected true actual %v", u.HasRole("staff", RoleAdmin))
+	}
+	if u.HasRole("staff") {
+		t.Errorf("Expected false actual %v", u.HasRole("staff"))
+	}
+	if !u.HasPermission("read", "write") {
+		t.Errorf("Expected true actual %v", u.HasPermission("read", "write"))
+	}
+	if u.HasPermission("read", "delete") {
+		t.Errorf("Expected false actual %v", u.HasPermission("read", "delete"))
+	}
+}
+
+func TestUser_validateUsername(t *testing.T) {
+	sample := []struct {
+		username string
+		valid    bool
+	}{
+		{"", true},
+		{"young.warlock_42", true},
+		{"young warlock", false},
+		{"me@home", false},
+	}
+	for _, v := range sample {
+		u := &User{
+			FirstName:       "young",
+			LastName:        "warlock",
+			Email:           "me@home.com",
+			Username:        v.username,
+			Password:        "open sesame 42",
+			ConfirmPassword: "open sesame 42",
+		}
+		_, bad := u.Validate()["Username"]
+		if bad == v.valid {
+			t.Errorf("Expected valid %v for %q actual %v", v.valid, v.username, u.Validate())
+		}
+	}
+}
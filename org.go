@@ -0,0 +1,618 @@
+package warlock
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/sessions"
+	u "github.com/nu7hatch/gouuid"
+)
+
+// OrgBucket is the bucket used by YoungWarlock for organizations, memberships are kept in
+// the <bucket>_members bucket and indexed by user in <bucket>_user
+const OrgBucket = "organizations"
+
+// Roles of organization members, applications are free to use others
+const (
+	OrgRoleOwner  = "owner"
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+)
+
+var (
+	// ErrOrgNotFound is returned for unknown organizations
+	ErrOrgNotFound = errors.New("warlock: organization not found")
+
+	// ErrNotMember is returned when the user does not belong to the organization
+	ErrNotMember = errors.New("warlock: not a member of the organization")
+
+	// ErrAlreadyMember is returned when adding a user who already belongs to the organization
+	ErrAlreadyMember = errors.New("warlock: already a member of the organization")
+
+	// ErrLastOwner is returned when a change would leave an organization without owner
+	ErrLastOwner = errors.New("warlock: an organization needs at least one owner")
+
+	// ErrRoleNotGrantable is returned when a member hands out a role above their own
+	ErrRoleNotGrantable = errors.New("warlock: role is above the roles of the granting member")
+)
+
+// Organization groups users, like the customer accounts of a SaaS product. The same user
+// can belong to several organizations with different roles in each.
+type Organization struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Membership records that the user with Email belongs to the organization OrgID, Roles
+// only apply within that organization
+type Membership struct {
+	OrgID    string    `json:"org_id"`
+	Email    string    `json:"email"`
+	Roles    []string  `json:"roles,omitempty"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// HasRole returns true if the member has any of the given roles in the organization
+func (m *Membership) HasRole(roles ...string) bool {
+	for _, r := range roles {
+		if hasString(m.Roles, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanGrant reports whether the member may hand out role. Nobody grants a role above their
+// own, so only owners grant the owner role and admins grant admin and below. Roles other
+// than the built in ones rank with member.
+func (m *Membership) CanGrant(role string) bool {
+	rank := 0
+	for _, r := range m.Roles {
+		if n := orgRoleRank(r); n > rank {
+			rank = n
+		}
+	}
+	return orgRoleRank(role) <= rank
+}
+
+func orgRoleRank(role string) int {
+	switch role {
+	case OrgRoleOwner:
+		return 2
+	case OrgRoleAdmin:
+		return 1
+	}
+	return 0
+}
+
+// OrgStore keeps organizations and their members in bolt
+type OrgStore struct {
+	db     string
+	bucket string
+}
+
+// NewOrgStore creates a bolt backed organization store
+func NewOrgStore(db, bucket string) OrgStore {
+	return OrgStore{db: db, bucket: bucket}
+}
+
+// CreateOrg stores a new organization, owner becomes its first member with the owner role
+func (s OrgStore) CreateOrg(org *Organization, owner string) error {
+	uid, err := u.NewV4()
+	if err != nil {
+		return err
+	}
+	org.ID = uid.String()
+	org.CreatedAt = time.Now()
+	return s.update(func(tx *orgTx) error {
+		if err := tx.putOrg(org); err != nil {
+			return err
+		}
+		return tx.putMember(&Membership{
+			OrgID:    org.ID,
+			Email:    NormalizeEmail(owner),
+			Roles:    []string{OrgRoleOwner},
+			JoinedAt: org.CreatedAt,
+		})
+	})
+}
+
+// GetOrg returns the organization with the given id
+func (s OrgStore) GetOrg(id string) (*Organization, error) {
+	var org *Organization
+	err := s.view(func(tx *orgTx) error {
+		var err error
+		org, err = tx.org(id)
+		return err
+	})
+	return org, err
+}
+
+// ListOrgs returns every organization sorted by name
+func (s OrgStore) ListOrgs() ([]*Organization, error) {
+	var list []*Organization
+	err := s.view(func(tx *orgTx) error {
+		return tx.orgs.ForEach(func(k, v []byte) error {
+			org := new(Organization)
+			if err := json.Unmarshal(v, org); err != nil {
+				return err
+			}
+			list = append(list, org)
+			return nil
+		})
+	})
+	if err == ErrOrgNotFound {
+		return nil, nil
+	}
+	sortOrgs(list)
+	return list, err
+}
+
+// DeleteOrg removes the organization and all of its memberships
+func (s OrgStore) DeleteOrg(id string) error {
+	return s.update(func(tx *orgTx) error {
+		if _, err := tx.org(id); err != nil {
+			return err
+		}
+		members, err := tx.orgMembers(id)
+		if err != nil {
+			return err
+		}
+		for _, m := range members {
+			if err = tx.deleteMember(m); err != nil {
+				return err
+			}
+		}
+		return tx.orgs.Delete([]byte(id))
+	})
+}
+
+// AddMember adds the user with email to the organization with the given roles
+func (s OrgStore) AddMember(orgID, email string, roles ...string) error {
+	email = NormalizeEmail(email)
+	return s.update(func(tx *orgTx) error {
+		if _, err := tx.org(orgID); err != nil {
+			return err
+		}
+		if _, err := tx.member(orgID, email); err == nil {
+			return ErrAlreadyMember
+		}
+		return tx.putMember(&Membership{
+			OrgID:    orgID,
+			Email:    email,
+			Roles:    roles,
+			JoinedAt: time.Now(),
+		})
+	})
+}
+
+// SetMemberRoles replaces the roles of a member, the last owner can not give up the role
+func (s OrgStore) SetMemberRoles(orgID, email string, roles ...string) error {
+	email = NormalizeEmail(email)
+	return s.update(func(tx *orgTx) error {
+		m, err := tx.member(orgID, email)
+		if err != nil {
+			return err
+		}
+		if m.HasRole(OrgRoleOwner) && !hasString(roles, OrgRoleOwner) {
+			if err = tx.keepOwner(orgID, email); err != nil {
+				return err
+			}
+		}
+		m.Roles = roles
+		return tx.putMember(m)
+	})
+}
+
+// RemoveMember takes the user with email out of the organization, the last owner can not
+// be removed
+func (s OrgStore) RemoveMember(orgID, email string) error {
+	email = NormalizeEmail(email)
+	return s.update(func(tx *orgTx) error {
+		m, err := tx.member(orgID, email)
+		if err != nil {
+			return err
+		}
+		if m.HasRole(OrgRoleOwner) {
+			if err = tx.keepOwner(orgID, email); err != nil {
+				return err
+			}
+		}
+		return tx.deleteMember(m)
+	})
+}
+
+// Member returns the membership of the user with email in the organization
+func (s OrgStore) Member(orgID, email string) (*Membership, error) {
+	var m *Membership
+	err := s.view(func(tx *orgTx) error {
+		var err error
+		m, err = tx.member(orgID, NormalizeEmail(email))
+		return err
+	})
+	if err == ErrOrgNotFound {
+		return nil, ErrNotMember
+	}
+	return m, err
+}
+
+// Members returns the memberships of the organization sorted by email
+func (s OrgStore) Members(orgID string) ([]*Membership, error) {
+	var list []*Membership
+	err := s.view(func(tx *orgTx) error {
+		if _, err := tx.org(orgID); err != nil {
+			return err
+		}
+		var err error
+		list, err = tx.orgMembers(orgID)
+		return err
+	})
+	return list, err
+}
+
+// UserOrgs returns the organizations the user with email belongs to sorted by name
+func (s OrgStore) UserOrgs(email string) ([]*Organization, error) {
+	var list []*Organization
+	err := s.view(func(tx *orgTx) error {
+		prefix := memberKey(NormalizeEmail(email), "")
+		c := tx.users.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			org, err := tx.org(string(k[len(prefix):]))
+			if err != nil {
+				return err
+			}
+			list = append(list, org)
+		}
+		return nil
+	})
+	if err == ErrOrgNotFound {
+		return nil, nil
+	}
+	sortOrgs(list)
+	return list, err
+}
+
+// RemoveUser drops every membership of the user with email, it is meant for deleted
+// accounts and does not protect the last owner
+func (s OrgStore) RemoveUser(email string) error {
+	email = NormalizeEmail(email)
+	return s.update(func(tx *orgTx) error {
+		prefix := memberKey(email, "")
+		var orgIDs []string
+		c := tx.users.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			orgIDs = append(orgIDs, string(k[len(prefix):]))
+		}
+		for _, id := range orgIDs {
+			m, err := tx.member(id, email)
+			if err != nil {
+				return err
+			}
+			if err = tx.deleteMember(m); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// orgTx holds the buckets of an organization store within one transaction
+type orgTx struct {
+	orgs, members, users *bolt.Bucket
+}
+
+func (s OrgStore) update(fn func(*orgTx) error) error {
+	db, err := bolt.Open(s.db, 0600, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		var ot orgTx
+		for name, b := range map[string]**bolt.Bucket{
+			s.bucket:              &ot.orgs,
+			s.bucket + "_members": &ot.members,
+			s.bucket + "_user":    &ot.users,
+		} {
+			if *b, err = tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return fn(&ot)
+	})
+}
+
+// view runs fn in a read-only transaction, there are no organizations until the buckets
+// exist
+func (s OrgStore) view(fn func(*orgTx) error) error {
+	db, err := bolt.Open(s.db, 0600, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		ot := &orgTx{
+			orgs:    tx.Bucket([]byte(s.bucket)),
+			members: tx.Bucket([]byte(s.bucket + "_members")),
+			users:   tx.Bucket([]byte(s.bucket + "_user")),
+		}
+		if ot.orgs == nil || ot.members == nil || ot.users == nil {
+			return ErrOrgNotFound
+		}
+		return fn(ot)
+	})
+}
+
+func (tx *orgTx) org(id string) (*Organization, error) {
+	data := tx.orgs.Get([]byte(id))
+	if data == nil {
+		return nil, ErrOrgNotFound
+	}
+	org := new(Organization)
+	return org, json.Unmarshal(data, org)
+}
+
+func (tx *orgTx) putOrg(org *Organization) error {
+	data, err := json.Marshal(org)
+	if err != nil {
+		return err
+	}
+	return tx.orgs.Put([]byte(org.ID), data)
+}
+
+func (tx *orgTx) member(orgID, email string) (*Membership, error) {
+	data := tx.members.Get(memberKey(orgID, email))
+	if data == nil {
+		return nil, ErrNotMember
+	}
+	m := new(Membership)
+	return m, json.Unmarshal(data, m)
+}
+
+func (tx *orgTx) orgMembers(orgID string) ([]*Membership, error) {
+	var list []*Membership
+	prefix := memberKey(orgID, "")
+	c := tx.members.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		m := new(Membership)
+		if err := json.Unmarshal(v, m); err != nil {
+			return nil, err
+		}
+		list = append(list, m)
+	}
+	return list, nil
+}
+
+func (tx *orgTx) putMember(m *Membership) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err = tx.members.Put(memberKey(m.OrgID, m.Email), data); err != nil {
+		return err
+	}
+	return tx.users.Put(memberKey(m.Email, m.OrgID), []byte{})
+}
+
+func (tx *orgTx) deleteMember(m *Membership) error {
+	if err := tx.members.Delete(memberKey(m.OrgID, m.Email)); err != nil {
+		return err
+	}
+	return tx.users.Delete(memberKey(m.Email, m.OrgID))
+}
+
+// keepOwner returns ErrLastOwner unless a member other than email owns the organization
+func (tx *orgTx) keepOwner(orgID, email string) error {
+	members, err := tx.orgMembers(orgID)
+	if err != nil {
+		return err
+	}
+	for _, m := range members {
+		if m.Email != email && m.HasRole(OrgRoleOwner) {
+			return nil
+		}
+	}
+	return ErrLastOwner
+}
+
+// memberKey joins the parts of membership keys, the separator can not appear in ids or emails
+func memberKey(a, b string) []byte {
+	return []byte(a + "\x00" + b)
+}
+
+func sortOrgs(list []*Organization) {
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name == list[j].Name {
+			return list[i].ID < list[j].ID
+		}
+		return list[i].Name < list[j].Name
+	})
+}
+
+// sessionOrg returns the organization picked by the user in the session along with the
+// membership. Users who did not pick one, or left the one they picked, are placed in the
+// first of their organizations by name.
+func (h *Handlers) sessionOrg(usr *User, ss *sessions.Session) (*Organization, *Membership) {
+	if id, ok := ss.Values[sessionOrgKey].(string); ok && id != "" {
+		if m, err := h.orgs.Member(id, usr.Email); err == nil {
+			if org, err := h.orgs.GetOrg(id); err == nil {
+				return org, m
+			}
+		}
+	}
+	list, err := h.orgs.UserOrgs(usr.Email)
+	if err != nil || len(list) == 0 {
+		return nil, nil
+	}
+	m, err := h.orgs.Member(list[0].ID, usr.Email)
+	if err != nil {
+		return nil, nil
+	}
+	return list[0], m
+}
+
+// SwitchOrg is a http handler making the organization given by the org value the current
+// one of the session. Users are sent to the next value, or get the organization back when
+// they asked for json.
+func (h *Handlers) SwitchOrg(w http.ResponseWriter, r *http.Request) {
+	asJSON := wantsJSON(r)
+	usr, ss := h.sessionUser(r)
+	if usr == nil {
+		h.orgDenied(w, asJSON, http.StatusUnauthorized, "login required")
+		return
+	}
+	req := struct {
+		Org  string `json:"org"`
+		Next string `json:"next"`
+	}{}
+	if hasJSONBody(r) {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			h.rendr.JSON(w, http.StatusBadRequest, apiResponse{Error: "malformed request"})
+			return
+		}
+	} else {
+		req.Org, req.Next = r.FormValue("org"), r.FormValue("next")
+	}
+	if _, err := h.orgs.Member(req.Org, usr.Email); err != nil {
+		h.orgDenied(w, asJSON, http.StatusForbidden, "not a member of the organization")
+		return
+	}
+	org, err := h.orgs.GetOrg(req.Org)
+	if err != nil {
+		h.orgDenied(w, asJSON, http.StatusForbidden, "not a member of the organization")
+		return
+	}
+	h.enterOrg(w, r, ss, org, req.Next, asJSON)
+}
+
+// JoinOrg is a http handler adding logged in users to the organization of the invitation
+// given by the invite value, with the roles of the invitation. The organization becomes
+// the current one of the session.
+func (h *Handlers) JoinOrg(w http.ResponseWriter, r *http.Request) {
+	asJSON := wantsJSON(r)
+	usr, ss := h.sessionUser(r)
+	if usr == nil {
+		h.orgDenied(w, asJSON, http.StatusUnauthorized, "login required")
+		return
+	}
+	req := struct {
+		Invite string `json:"invite"`
+		Next   string `json:"next"`
+	}{}
+	if hasJSONBody(r) {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			h.rendr.JSON(w, http.StatusBadRequest, apiResponse{Error: "malformed request"})
+			return
+		}
+	} else {
+		req.Invite, req.Next = r.FormValue("invite"), r.FormValue("next")
+	}
+	inv, err := h.invites.Get(req.Invite)
+	if err != nil || inv.OrgID == "" {
+		h.orgDenied(w, asJSON, http.StatusForbidden, "a valid invitation is required to join")
+		return
+	}
+	if inv, err = h.invites.Consume(inv.Code, usr.Email); err != nil {
+		h.orgDenied(w, asJSON, http.StatusForbidden, "a valid invitation is required to join")
+		return
+	}
+	org, err := h.joinOrg(inv, usr.Email)
+	if err != nil {
+		if rerr := h.invites.Release(inv.Code); rerr != nil {
+			log.Println(rerr)
+		}
+		if err == ErrAlreadyMember {
+			h.orgDenied(w, asJSON, http.StatusConflict, "already a member of the organization")
+			return
+		}
+		log.Println(err)
+		h.orgDenied(w, asJSON, http.StatusForbidden, "a valid invitation is required to join")
+		return
+	}
+	h.enterOrg(w, r, ss, org, req.Next, asJSON)
+}
+
+// joinOrg adds email to the organization of the invitation, members invited without roles
+// get the member role. Unless the invitation is trusted the roles are checked again, the
+// inviter may have been demoted or removed from the organization since inviting.
+func (h *Handlers) joinOrg(inv *Invitation, email string) (*Organization, error) {
+	org, err := h.orgs.GetOrg(inv.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	roles := inv.Roles
+	if len(roles) == 0 {
+		roles = []string{OrgRoleMember}
+	}
+	if !inv.Trusted {
+		inviter, err := h.orgs.Member(org.ID, inv.Inviter)
+		switch {
+		case err == ErrNotMember:
+			return nil, ErrRoleNotGrantable
+		case err != nil:
+			return nil, err
+		case !inviter.HasRole(OrgRoleOwner, OrgRoleAdmin):
+			return nil, ErrRoleNotGrantable
+		}
+		for _, r := range roles {
+			if !inviter.CanGrant(r) {
+				return nil, ErrRoleNotGrantable
+			}
+		}
+	}
+	if err = h.orgs.AddMember(org.ID, email, roles...); err != nil {
+		return nil, err
+	}
+	h.audit(inv.Inviter, email, AuditJoinOrg, org.ID)
+	return org, nil
+}
+
+func (h *Handlers) enterOrg(w http.ResponseWriter, r *http.Request, ss *sessions.Session, org *Organization, next string, asJSON bool) {
+	ss.Values[sessionOrgKey] = org.ID
+	if err := ss.Save(r, w); err != nil {
+		log.Println(err)
+	}
+	if asJSON {
+		h.rendr.JSON(w, http.StatusOK, apiResponse{Org: org})
+		return
+	}
+	if !safeRedirect(next) {
+		next = "/"
+	}
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+func (h *Handlers) orgDenied(w http.ResponseWriter, asJSON bool, code int, msg string) {
+	if asJSON {
+		h.rendr.JSON(w, code, apiResponse{Error: msg})
+		return
+	}
+	if code == http.StatusUnauthorized || code == http.StatusForbidden {
+		h.forbidden(w)
+		return
+	}
+	http.Error(w, msg, code)
+}
+
+// RequireOrgRole allows only members having one of the given roles in the current
+// organization, it relies on SessionMiddleware having put the organization into the
+// request context
+func (h *Handlers) RequireOrgRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, m, ok := CurrentOrg(r.Context())
+			if !ok || !m.HasRole(roles...) {
+				h.forbidden(w)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
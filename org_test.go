@@ -0,0 +1,293 @@
+package warlock
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOrgStore(t *testing.T) {
+	defer cleanUp("warlock_test.db")
+	s := NewOrgStore("warlock_test.db", OrgBucket)
+
+	if list, err := s.UserOrgs("alice@me.com"); err != nil || len(list) != 0 {
+		t.Errorf("Expected no organizations actual %v %v", list, err)
+	}
+	if _, err := s.Member("nope", "alice@me.com"); err != ErrNotMember {
+		t.Errorf("Expected %v actual %v", ErrNotMember, err)
+	}
+
+	beta := &Organization{Name: "beta"}
+	acme := &Organization{Name: "acme"}
+	for _, org := range []*Organization{beta, acme} {
+		if err := s.CreateOrg(org, "Alice@me.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := s.UserOrgs("alice@me.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].ID != acme.ID {
+		t.Errorf("Expected acme then beta actual %+v", list)
+	}
+
+	if err = s.AddMember(acme.ID, "bob@me.com", OrgRoleMember); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.AddMember(acme.ID, "bob@me.com"); err != ErrAlreadyMember {
+		t.Errorf("Expected %v actual %v", ErrAlreadyMember, err)
+	}
+	if err = s.AddMember("nope", "bob@me.com"); err != ErrOrgNotFound {
+		t.Errorf("Expected %v actual %v", ErrOrgNotFound, err)
+	}
+	m, err := s.Member(acme.ID, "bob@me.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.HasRole(OrgRoleMember) || m.HasRole(OrgRoleOwner) {
+		t.Errorf("Expected [member] actual %v", m.Roles)
+	}
+	if _, err = s.Member(beta.ID, "bob@me.com"); err != ErrNotMember {
+		t.Errorf("Expected %v actual %v", ErrNotMember, err)
+	}
+
+	// The last owner stays
+	if err = s.RemoveMember(acme.ID, "alice@me.com"); err != ErrLastOwner {
+		t.Errorf("Expected %v actual %v", ErrLastOwner, err)
+	}
+	if err = s.SetMemberRoles(acme.ID, "alice@me.com", OrgRoleAdmin); err != ErrLastOwner {
+		t.Errorf("Expected %v actual %v", ErrLastOwner, err)
+	}
+	if err = s.SetMemberRoles(acme.ID, "bob@me.com", OrgRoleOwner); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.RemoveMember(acme.ID, "alice@me.com"); err != nil {
+		t.Errorf("Expected nil actual %v", err)
+	}
+
+	members, err := s.Members(acme.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0].Email != "bob@me.com" {
+		t.Errorf("Expected only bob actual %+v", members)
+	}
+
+	if err = s.RemoveUser("alice@me.com"); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ = s.UserOrgs("alice@me.com"); len(list) != 0 {
+		t.Errorf("Expected no organizations actual %+v", list)
+	}
+	if err = s.DeleteOrg(acme.ID); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ = s.UserOrgs("bob@me.com"); len(list) != 0 {
+		t.Errorf("Expected no organizations actual %+v", list)
+	}
+	if list, _ = s.ListOrgs(); len(list) != 1 || list[0].ID != beta.ID {
+		t.Errorf("Expected only beta actual %+v", list)
+	}
+}
+
+func TestHandlers_Orgs(t *testing.T) {
+	ts, alice, y := testServer(t)
+	defer ts.Close()
+	defer cleanUp("warlock_test.db")
+
+	for _, e := range []string{"alice@me.com", "bob@me.com"} {
+		if err := y.ustore.CreateUser(&User{Email: e, FirstName: "x", Password: "pass"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	acme, beta := &Organization{Name: "acme"}, &Organization{Name: "beta"}
+	for _, org := range []*Organization{acme, beta} {
+		if err := y.orgs.CreateOrg(org, "alice@me.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	jar, _ := cookiejar.New(nil)
+	bob := &http.Client{Jar: jar}
+	login := func(c *http.Client, email string) {
+		res, err := c.PostForm(ts.URL+lPath, url.Values{"Email": {email}, "Password": {"pass"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	get := func(c *http.Client) (int, string) {
+		res, err := c.Get(ts.URL + gPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		buf := new(bytes.Buffer)
+		io.Copy(buf, res.Body)
+		return res.StatusCode, buf.String()
+	}
+	postJSON := func(c *http.Client, path, body string) (int, apiResponse) {
+		req, _ := http.NewRequest("POST", ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var out apiResponse
+		json.NewDecoder(res.Body).Decode(&out)
+		return res.StatusCode, out
+	}
+
+	login(alice, "alice@me.com")
+	login(bob, "bob@me.com")
+
+	// The first organization by name is current until the user switches
+	if code, body := get(alice); code != http.StatusOK || body != "acme" {
+		t.Errorf("Expected %d acme actual %d %s", http.StatusOK, code, body)
+	}
+	if code, out := postJSON(alice, wPath, `{"org":"`+beta.ID+`"}`); code != http.StatusOK || out.Org == nil || out.Org.ID != beta.ID {
+		t.Errorf("Expected %d beta actual %d %+v", http.StatusOK, code, out)
+	}
+	if _, body := get(alice); body != "beta" {
+		t.Errorf("Expected beta actual %s", body)
+	}
+	if code, _ := postJSON(bob, wPath, `{"org":"`+beta.ID+`"}`); code != http.StatusForbidden {
+		t.Errorf("Expected %d actual %d", http.StatusForbidden, code)
+	}
+	if code, _ := get(bob); code != http.StatusForbidden {
+		t.Errorf("Expected %d actual %d", http.StatusForbidden, code)
+	}
+
+	// Only organization admins invite to it
+	if code, _ := postJSON(bob, iPath, `{"org":"`+beta.ID+`"}`); code != http.StatusForbidden {
+		t.Errorf("Expected %d actual %d", http.StatusForbidden, code)
+	}
+	code, out := postJSON(alice, iPath, `{"org":"`+beta.ID+`","roles":["admin"],"max_uses":2}`)
+	if code != http.StatusCreated || out.Invitation == nil || out.Invitation.Org != beta.ID {
+		t.Fatalf("Expected %d actual %d %+v", http.StatusCreated, code, out)
+	}
+	invite := out.Invitation.Code
+
+	// An existing user joins
+	if code, out = postJSON(bob, jPath, `{"invite":"`+invite+`"}`); code != http.StatusOK || out.Org == nil {
+		t.Errorf("Expected %d actual %d %+v", http.StatusOK, code, out)
+	}
+	if code, body := get(bob); code != http.StatusOK || body != "beta" {
+		t.Errorf("Expected %d beta actual %d %s", http.StatusOK, code, body)
+	}
+	if code, _ = postJSON(bob, jPath, `{"invite":"`+invite+`"}`); code != http.StatusConflict {
+		t.Errorf("Expected %d actual %d", http.StatusConflict, code)
+	}
+
+	// A new user registers with it, the roles apply within the organization only
+	jar, _ = cookiejar.New(nil)
+	carol := &http.Client{Jar: jar}
+	res, err := carol.PostForm(ts.URL+rPath, url.Values{
+		"FirstName": {"carol"}, "LastName": {"c"}, "Email": {"carol@me.com"},
+		"Password": {"open sesame 42"}, "ConfirmPassword": {"open sesame 42"},
+		"invite": {invite},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	usr, err := y.ustore.GetUser("carol@me.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usr.HasRole(RoleAdmin) {
+		t.Errorf("Expected no global roles actual %v", usr.Roles)
+	}
+	m, err := y.orgs.Member(beta.ID, "carol@me.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.HasRole(OrgRoleAdmin) {
+		t.Errorf("Expected [admin] actual %v", m.Roles)
+	}
+
+	// Roles above the inviter's own can not be granted
+	if code, _ = postJSON(carol, iPath, `{"org":"`+beta.ID+`","roles":["owner"]}`); code != http.StatusForbidden {
+		t.Errorf("Expected %d actual %d", http.StatusForbidden, code)
+	}
+	if code, _ = postJSON(alice, iPath, `{"org":"`+beta.ID+`","roles":["owner"]}`); code != http.StatusCreated {
+		t.Errorf("Expected %d actual %d", http.StatusCreated, code)
+	}
+	code, out = postJSON(carol, iPath, `{"org":"`+beta.ID+`","roles":["admin"]}`)
+	if code != http.StatusCreated || out.Invitation == nil {
+		t.Fatalf("Expected %d actual %d %+v", http.StatusCreated, code, out)
+	}
+
+	// and are checked again on joining, the inviter may have been demoted since
+	if err = y.orgs.SetMemberRoles(beta.ID, "carol@me.com", OrgRoleMember); err != nil {
+		t.Fatal(err)
+	}
+	if err = y.orgs.RemoveMember(beta.ID, "bob@me.com"); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ = postJSON(bob, jPath, `{"invite":"`+out.Invitation.Code+`"}`); code != http.StatusForbidden {
+		t.Errorf("Expected %d actual %d", http.StatusForbidden, code)
+	}
+	if _, err = y.orgs.Member(beta.ID, "bob@me.com"); err != ErrNotMember {
+		t.Errorf("Expected %v actual %v", ErrNotMember, err)
+	}
+
+	// or removed from it
+	if err = y.orgs.SetMemberRoles(beta.ID, "carol@me.com", OrgRoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	code, out = postJSON(carol, iPath, `{"org":"`+beta.ID+`","roles":["admin"]}`)
+	if code != http.StatusCreated || out.Invitation == nil {
+		t.Fatalf("Expected %d actual %d %+v", http.StatusCreated, code, out)
+	}
+	if err = y.orgs.RemoveMember(beta.ID, "carol@me.com"); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ = postJSON(bob, jPath, `{"invite":"`+out.Invitation.Code+`"}`); code != http.StatusForbidden {
+		t.Errorf("Expected %d actual %d", http.StatusForbidden, code)
+	}
+	if _, err = y.orgs.Member(beta.ID, "bob@me.com"); err != ErrNotMember {
+		t.Errorf("Expected %v actual %v", ErrNotMember, err)
+	}
+
+	// Trusted invitations are made with the command line tool by non members
+	trusted := &Invitation{Inviter: "ops@me.com", OrgID: beta.ID, Roles: []string{OrgRoleAdmin}, Trusted: true}
+	if err = y.invites.Create(trusted, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ = postJSON(bob, jPath, `{"invite":"`+trusted.Code+`"}`); code != http.StatusOK {
+		t.Errorf("Expected %d actual %d", http.StatusOK, code)
+	}
+	if m, err = y.orgs.Member(beta.ID, "bob@me.com"); err != nil || !m.HasRole(OrgRoleAdmin) {
+		t.Errorf("Expected [admin] actual %+v %v", m, err)
+	}
+}
+
+func TestMembership_CanGrant(t *testing.T) {
+	sample := []struct {
+		roles []string
+		role  string
+		ok    bool
+	}{
+		{[]string{OrgRoleOwner}, OrgRoleOwner, true},
+		{[]string{OrgRoleAdmin}, OrgRoleOwner, false},
+		{[]string{OrgRoleAdmin}, OrgRoleAdmin, true},
+		{[]string{OrgRoleAdmin}, "billing", true},
+		{[]string{OrgRoleMember}, OrgRoleAdmin, false},
+		{[]string{"billing", OrgRoleAdmin}, OrgRoleAdmin, true},
+	}
+	for _, v := range sample {
+		m := &Membership{Roles: v.roles}
+		if got := m.CanGrant(v.role); got != v.ok {
+			t.Errorf("Expected %v for %v granting %s actual %v", v.ok, v.roles, v.role, got)
+		}
+	}
+}
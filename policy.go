@@ -0,0 +1,184 @@
+package warlock
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PasswordPolicy describes what a new password must look like. Every rule which fails
+// produces its own message, keyed by the rule name.
+type PasswordPolicy struct {
+	MinLength        int     `json:"min_length"`
+	MaxLength        int     `json:"max_length"`
+	MaxBytes         int     `json:"max_bytes"`
+	RequireUpper     bool    `json:"require_upper"`
+	RequireLower     bool    `json:"require_lower"`
+	RequireDigit     bool    `json:"require_digit"`
+	RequireSymbol    bool    `json:"require_symbol"`
+	DisallowPersonal bool    `json:"disallow_personal"`
+	MinEntropy       float64 `json:"min_entropy"`
+	DenyListFile     string  `json:"deny_list_file"`
+
+	denied map[string]bool
+}
+
+// DefaultPasswordPolicy accepts any password of 8 to 128 characters which does not
+// contain the email or the name of the user
+func DefaultPasswordPolicy() *PasswordPolicy {
+	return &PasswordPolicy{
+		MinLength:        8,
+		MaxLength:        128,
+		DisallowPersonal: true,
+	}
+}
+
+// bcryptMaxBytes is the longest password bcrypt accepts
+const bcryptMaxBytes = 72
+
+// ForHasher returns the policy to use with passwords hashed by h. Bcrypt refuses
+// passwords longer than 72 bytes, so for it MaxBytes is capped to that and such
+// passwords are reported as a broken rule instead of failing when they are hashed.
+// The policy itself is left untouched, a nil policy stays nil for other hashers.
+func (p *PasswordPolicy) ForHasher(h Hasher) *PasswordPolicy {
+	if _, ok := h.(*BcryptHasher); !ok {
+		return p
+	}
+	np := &PasswordPolicy{}
+	if p != nil {
+		*np = *p
+	}
+	if np.MaxBytes == 0 || np.MaxBytes > bcryptMaxBytes {
+		np.MaxBytes = bcryptMaxBytes
+	}
+	return np
+}
+
+// LoadDenyList reads the passwords which must never be used from a file, one password
+// per line. Empty lines and lines starting with # are ignored, matching is case insensitive.
+func (p *PasswordPolicy) LoadDenyList(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	denied := make(map[string]bool)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		denied[strings.ToLower(line)] = true
+	}
+	if err = s.Err(); err != nil {
+		return err
+	}
+	p.denied = denied
+	return nil
+}
+
+// Check returns the rules password breaks mapped to a message, the user is used to
+// reject passwords containing personal details. It returns nil when the password is fine.
+func (p *PasswordPolicy) Check(password string, usr *User) map[string]string {
+	m := make(map[string]string)
+	n := utf8.RuneCountInString(password)
+	if n < p.MinLength {
+		m["min_length"] = fmt.Sprintf("must be at least %d characters long", p.MinLength)
+	}
+	if p.MaxLength > 0 && n > p.MaxLength {
+		m["max_length"] = fmt.Sprintf("must be at most %d characters long", p.MaxLength)
+	}
+	if p.MaxBytes > 0 && len(password) > p.MaxBytes {
+		m["max_bytes"] = fmt.Sprintf("must be at most %d bytes long", p.MaxBytes)
+	}
+	upper, lower, digit, symbol := charClasses(password)
+	if p.RequireUpper && !upper {
+		m["upper"] = "must contain an upper case letter"
+	}
+	if p.RequireLower && !lower {
+		m["lower"] = "must contain a lower case letter"
+	}
+	if p.RequireDigit && !digit {
+		m["digit"] = "must contain a digit"
+	}
+	if p.RequireSymbol && !symbol {
+		m["symbol"] = "must contain a symbol"
+	}
+	if p.DisallowPersonal && usr != nil && containsPersonal(password, usr) {
+		m["personal"] = "must not contain your email or name"
+	}
+	if p.MinEntropy > 0 && Entropy(password) < p.MinEntropy {
+		m["entropy"] = "is too easy to guess"
+	}
+	if p.denied[strings.ToLower(password)] {
+		m["deny_list"] = "is too common"
+	}
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
+
+// Entropy estimates the strength of a password in bits from its length and the size
+// of the character classes it draws from
+func Entropy(password string) float64 {
+	upper, lower, digit, symbol := charClasses(password)
+	pool := 0
+	for _, c := range []struct {
+		has  bool
+		size int
+	}{{upper, 26}, {lower, 26}, {digit, 10}, {symbol, 33}} {
+		if c.has {
+			pool += c.size
+		}
+	}
+	for _, r := range password {
+		if r > unicode.MaxASCII {
+			pool += 100
+			break
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+	return float64(utf8.RuneCountInString(password)) * math.Log2(float64(pool))
+}
+
+func charClasses(password string) (upper, lower, digit, symbol bool) {
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+	return
+}
+
+// containsPersonal checks for the email, its local part and the names of the user, parts
+// shorter than three characters are ignored as they match too often
+func containsPersonal(password string, usr *User) bool {
+	pass := strings.ToLower(password)
+	email := strings.ToLower(usr.Email)
+	parts := []string{email, usr.FirstName, usr.LastName}
+	if i := strings.Index(email, "@"); i > 0 {
+		parts = append(parts, email[:i])
+	}
+	for _, v := range parts {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if utf8.RuneCountInString(v) >= 3 && strings.Contains(pass, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package warlock
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	usr := &User{FirstName: "young", LastName: "warlock", Email: "gernest@home.com"}
+	p := DefaultPasswordPolicy()
+	sample := []struct {
+		pass  string
+		rules []string
+	}{
+		{"open sesame 42", nil},
+		{"a", []string{"min_length"}},
+		{"young and restless", []string{"personal"}},
+		{"hello gernest", []string{"personal"}},
+		{"pass words with spaces & symbols!", nil},
+	}
+	for _, v := range sample {
+		m := p.Check(v.pass, usr)
+		if len(m) != len(v.rules) {
+			t.Errorf("Expected %v for %q actual %v", v.rules, v.pass, m)
+		}
+		for _, r := range v.rules {
+			if _, ok := m[r]; !ok {
+				t.Errorf("Expected rule %s to fail for %q actual %v", r, v.pass, m)
+			}
+		}
+	}
+
+	strict := &PasswordPolicy{
+		MinLength:     4,
+		MaxLength:     10,
+		RequireUpper:  true,
+		RequireLower:  true,
+		RequireDigit:  true,
+		RequireSymbol: true,
+		MinEntropy:    60,
+	}
+	m := strict.Check("aaaaaaaaaaaa", nil)
+	for _, r := range []string{"max_length", "upper", "digit", "symbol", "entropy"} {
+		if _, ok := m[r]; !ok {
+			t.Errorf("Expected rule %s to fail actual %v", r, m)
+		}
+	}
+	if _, ok := m["lower"]; ok {
+		t.Errorf("Expected lower to pass actual %v", m)
+	}
+	if m = strict.Check("Ab1!xY9?zQ", nil); m != nil {
+		t.Errorf("Expected nil actual %v", m)
+	}
+}
+
+func TestPasswordPolicy_denyList(t *testing.T) {
+	f, err := ioutil.TempFile("", "deny")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# common passwords\nPassword1\n\nletmein123\n")
+	f.Close()
+
+	p := DefaultPasswordPolicy()
+	if err = p.LoadDenyList(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.Check("password1", nil)["deny_list"]; !ok {
+		t.Errorf("Expected password1 to be denied")
+	}
+	if _, ok := p.Check("LetMeIn123", nil)["deny_list"]; !ok {
+		t.Errorf("Expected LetMeIn123 to be denied")
+	}
+	if m := p.Check("open sesame 42", nil); m != nil {
+		t.Errorf("Expected nil actual %v", m)
+	}
+	if err = p.LoadDenyList("missing.txt"); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
+
+func TestUser_ValidateWith(t *testing.T) {
+	usr := &User{
+		FirstName:       "young",
+		LastName:        "warlock",
+		Email:           "me@me.com",
+		Password:        "pass",
+		ConfirmPassword: "pass",
+	}
+	m := usr.ValidateWith(DefaultPasswordPolicy())
+	if _, ok := m["Password.min_length"]; !ok {
+		t.Errorf("Expected Password.min_length actual %v", m)
+	}
+	if m = usr.ValidateWith(nil); m != nil {
+		t.Errorf("Expected nil actual %v", m)
+	}
+	usr.Password = "correct horse: battery staple"
+	usr.ConfirmPassword = usr.Password
+	if m = usr.Validate(); m != nil {
+		t.Errorf("Expected nil actual %v", m)
+	}
+}
+
+func TestEntropy(t *testing.T) {
+	if e := Entropy(""); e != 0 {
+		t.Errorf("Expected 0 actual %v", e)
+	}
+	if Entropy("aaaaaaaa") >= Entropy("aA1!aA1!") {
+		t.Errorf("Expected mixed classes to score higher")
+	}
+}
+
+func TestPasswordPolicy_ForHasher(t *testing.T) {
+	long := strings.Repeat("x", 73)
+	p := DefaultPasswordPolicy()
+	if m := p.Check(long, nil); m != nil {
+		t.Errorf("Expected nil actual %v", m)
+	}
+	bp := p.ForHasher(NewBcryptHasher())
+	if _, ok := bp.Check(long, nil)["max_bytes"]; !ok {
+		t.Errorf("Expected max_bytes to fail for %d bytes", len(long))
+	}
+	if bp.Check(long[:72], nil) != nil {
+		t.Errorf("Expected 72 bytes to pass")
+	}
+	if p.MaxBytes != 0 {
+		t.Errorf("Expected %d actual %d", 0, p.MaxBytes)
+	}
+	if np := (*PasswordPolicy)(nil).ForHasher(NewBcryptHasher()); np == nil || np.MaxBytes != bcryptMaxBytes {
+		t.Errorf("Expected %d actual %v", bcryptMaxBytes, np)
+	}
+	if ap := p.ForHasher(NewArgon2Hasher()); ap != p {
+		t.Errorf("Expected the policy to be unchanged for argon2id")
+	}
+}
@@ -0,0 +1,278 @@
+package warlock
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// SessionStore is implemented by session backends, on top of gorilla's sessions.Store
+// it must be able to remove a session.
+type SessionStore interface {
+	sessions.Store
+
+	// Delete removes the session from the backend and expires the cookie
+	Delete(r *http.Request, w http.ResponseWriter, session *sessions.Session) error
+}
+
+// SessionLister is implemented by session backends which keep sessions on the server and
+// can find them by user, the admin dashboard uses it to show and end the sessions of a user
+type SessionLister interface {
+	// UserSessions returns the live sessions of the user with the given email
+	UserSessions(email string) ([]SessionInfo, error)
+
+	// DeleteUserSessions removes every session of the user with the given email and
+	// returns how many were removed
+	DeleteUserSessions(email string) (int, error)
+}
+
+// SessionInfo describes a stored session
+type SessionInfo struct {
+	ID      string
+	Expires time.Time
+}
+
+// sessionUserKey is the session value holding the email of the logged in user
+const sessionUserKey = "user"
+
+// sessionImpersonatorKey is the session value holding the email of the admin who is
+// impersonating the user of the session
+const sessionImpersonatorKey = "impersonator"
+
+// sessionOrgKey is the session value holding the id of the organization the user switched to
+const sessionOrgKey = "org"
+
+// sessionCSRFKey is the session value holding the token the admin dashboard forms post back
+const sessionCSRFKey = "csrf"
+
+func sortSessions(list []SessionInfo) {
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Expires.After(list[j].Expires)
+	})
+}
+
+// Supported values for Config.SessStore
+const (
+	SessBolt       = "bolt"
+	SessMemory     = "memory"
+	SessCookie     = "cookie"
+	SessFilesystem = "filesystem"
+)
+
+// newSessionStore creates the session backend selected in the configuration, cookies are
+// encoded with the newest key pair and decoded with any of them
+func newSessionStore(c *Config, opts *sessions.Options) (SessionStore, error) {
+	encrypt := c.SessStore == SessCookie || c.SessStore == SessFilesystem
+	keys, err := c.keyPairs(encrypt)
+	if err != nil {
+		return nil, err
+	}
+	switch c.SessStore {
+	case "", SessBolt:
+		return NewSessStore(c.DB, SessionBucket, 100, opts, keys...), nil
+	case SessMemory:
+		return NewMemSessStore(100, opts, keys...), nil
+	case SessCookie:
+		return NewCookieSessStore(opts, keys...), nil
+	case SessFilesystem:
+		return NewFileSessStore(c.SessDir, opts, keys...), nil
+	}
+	return nil, errors.New("warlock: unknown session store " + c.SessStore)
+}
+
+// blockKey derives an AES-256 key from Config.Secret for backends which keep the session
+// values in the cookie or on disk when no key pairs are configured
+func blockKey(secret []byte) []byte {
+	k := sha256.Sum256(append([]byte("warlock-block-key:"), secret...))
+	return k[:]
+}
+
+// MemSess keeps sessions in memory, the cookie only carries the session ID
+type MemSess struct {
+	mu       *sync.RWMutex
+	data     map[string]memSession
+	options  *sessions.Options
+	codecs   []securecookie.Codec
+	duration int // Time before the session expires
+}
+
+type memSession struct {
+	values  map[interface{}]interface{}
+	expires time.Time
+}
+
+// NewMemSessStore creates a new in memory session store backend
+func NewMemSessStore(duration int, opts *sessions.Options, secrets ...[]byte) MemSess {
+	return MemSess{
+		mu:       &sync.RWMutex{},
+		data:     make(map[string]memSession),
+		options:  opts,
+		codecs:   securecookie.CodecsFromPairs(secrets...),
+		duration: duration,
+	}
+}
+
+// Get fetches a session from the registry
+func (s MemSess) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New create new session
+func (s MemSess) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, err
+	}
+	err = securecookie.DecodeMulti(name, cookie.Value, &session.ID, s.codecs...)
+	if err != nil {
+		return session, err
+	}
+	s.mu.RLock()
+	v, ok := s.data[session.ID]
+	s.mu.RUnlock()
+	if !ok {
+		return session, errors.New("warlock: session not found")
+	}
+	if v.expires.Before(time.Now()) {
+		return session, errors.New("warlock: session expired")
+	}
+	for k, val := range v.values {
+		session.Values[k] = val
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+// Save keeps a copy of the session values in memory
+func (s MemSess) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.ID == "" {
+		sessID := base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+		session.ID = strings.TrimRight(sessID, "=")
+	}
+	values := make(map[interface{}]interface{}, len(session.Values))
+	for k, v := range session.Values {
+		values[k] = v
+	}
+	maxAge := session.Options.MaxAge
+	if maxAge <= 0 {
+		maxAge = s.duration
+	}
+	s.mu.Lock()
+	s.data[session.ID] = memSession{
+		values:  values,
+		expires: time.Now().Add(time.Second * time.Duration(maxAge)),
+	}
+	s.mu.Unlock()
+	e, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), e, session.Options))
+	return nil
+}
+
+// Delete removes session from memory and the request
+func (s MemSess) Delete(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	options := *session.Options
+	options.MaxAge = -1
+	http.SetCookie(w, sessions.NewCookie(session.Name(), "", &options))
+	for k := range session.Values {
+		delete(session.Values, k)
+	}
+	s.mu.Lock()
+	delete(s.data, session.ID)
+	s.mu.Unlock()
+	return nil
+}
+
+// UserSessions returns the live sessions of the user with the given email
+func (s MemSess) UserSessions(email string) ([]SessionInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []SessionInfo
+	for id, v := range s.data {
+		if user, _ := v.values[sessionUserKey].(string); user == email && v.expires.After(time.Now()) {
+			out = append(out, SessionInfo{ID: id, Expires: v.expires})
+		}
+	}
+	sortSessions(out)
+	return out, nil
+}
+
+// DeleteUserSessions removes every session of the user with the given email
+func (s MemSess) DeleteUserSessions(email string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for id, v := range s.data {
+		if user, _ := v.values[sessionUserKey].(string); user == email {
+			delete(s.data, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// CookieSess is a stateless backend, the session values are encrypted and kept in the
+// cookie itself so nothing is stored on the server
+type CookieSess struct {
+	*sessions.CookieStore
+}
+
+// NewCookieSessStore creates a new cookie based session store backend. The key pairs are
+// hash and block keys, the block key must be given for the values to be encrypted.
+func NewCookieSessStore(opts *sessions.Options, keyPairs ...[]byte) CookieSess {
+	cs := sessions.NewCookieStore(keyPairs...)
+	cs.Options = opts
+	cs.MaxAge(opts.MaxAge)
+	return CookieSess{CookieStore: cs}
+}
+
+// Delete expires the session cookie
+func (s CookieSess) Delete(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	return expireSession(s.CookieStore, r, w, session)
+}
+
+// FileSess keeps the encrypted session values in files in a directory
+type FileSess struct {
+	*sessions.FilesystemStore
+}
+
+// NewFileSessStore creates a new filesystem based session store backend, sessions are
+// stored in the os temporary directory when dir is empty.
+func NewFileSessStore(dir string, opts *sessions.Options, keyPairs ...[]byte) FileSess {
+	fs := sessions.NewFilesystemStore(dir, keyPairs...)
+	fs.Options = opts
+	fs.MaxAge(opts.MaxAge)
+	return FileSess{FilesystemStore: fs}
+}
+
+// Delete removes the session file and expires the cookie
+func (s FileSess) Delete(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	return expireSession(s.FilesystemStore, r, w, session)
+}
+
+// expireSession relies on gorilla stores erasing the session when it is saved with a
+// negative MaxAge
+func expireSession(store sessions.Store, r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	options := *session.Options
+	options.MaxAge = -1
+	session.Options = &options
+	for k := range session.Values {
+		delete(session.Values, k)
+	}
+	return store.Save(r, w, session)
+}
@@ -0,0 +1,222 @@
+package warlock
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestMemSess(t *testing.T) {
+	opts := &sessions.Options{MaxAge: maxAge, Path: sPath}
+	testSessionStore(t, NewMemSessStore(10, opts, secret))
+}
+
+func TestSessionLister(t *testing.T) {
+	opts := &sessions.Options{MaxAge: maxAge, Path: sPath}
+	testSessionLister(t, NewMemSessStore(10, opts, secret))
+
+	store := NewSessStore(dbName, sBucket, 10, opts, secret)
+	defer store.store.DeleteDatabase()
+	testSessionLister(t, store)
+}
+
+func testSessionLister(t *testing.T, store interface {
+	SessionStore
+	SessionLister
+}) {
+	for _, user := range []string{"gernest", "gernest", "other"} {
+		req, _ := http.NewRequest("GET", testURL, nil)
+		s, _ := store.New(req, cName)
+		s.Values["user"] = user
+		if err := s.Save(req, httptest.NewRecorder()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := store.UserSessions("gernest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Errorf("Expected 2 actual %d", len(list))
+	}
+	n, err := store.DeleteUserSessions("gernest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("Expected 2 actual %d", n)
+	}
+	if list, _ = store.UserSessions("gernest"); len(list) != 0 {
+		t.Errorf("Expected no sessions actual %v", list)
+	}
+	if list, _ = store.UserSessions("other"); len(list) != 1 {
+		t.Errorf("Expected 1 actual %d", len(list))
+	}
+}
+
+func TestCookieSess(t *testing.T) {
+	opts := &sessions.Options{MaxAge: maxAge, Path: sPath}
+	store := NewCookieSessStore(opts, secret, blockKey(secret))
+	testSessionStore(t, store)
+
+	// values are encrypted so they must not show up in the cookie
+	req, _ := http.NewRequest("GET", testURL, nil)
+	s, _ := store.New(req, cName)
+	s.Values["user"] = "gernest"
+	w := httptest.NewRecorder()
+	if err := s.Save(req, w); err != nil {
+		t.Fatal(err)
+	}
+	plain := NewCookieSessStore(opts, secret)
+	req.AddCookie(w.Result().Cookies()[0])
+	if _, err := plain.New(req, cName); err == nil {
+		t.Error("Expected an error decoding without the block key")
+	}
+}
+
+func TestFileSess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := &sessions.Options{MaxAge: maxAge, Path: sPath}
+	testSessionStore(t, NewFileSessStore(dir, opts, secret, blockKey(secret)))
+}
+
+func TestNewSessionStore(t *testing.T) {
+	opts := &sessions.Options{MaxAge: maxAge, Path: sPath}
+	sample := []struct {
+		name, kind string
+	}{
+		{"", SessBolt},
+		{SessBolt, SessBolt},
+		{SessMemory, SessMemory},
+		{SessCookie, SessCookie},
+		{SessFilesystem, SessFilesystem},
+	}
+	for _, v := range sample {
+		c := NewConfig(&Config{SessStore: v.name})
+		s, err := newSessionStore(c, opts)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		var kind string
+		switch s.(type) {
+		case Sess:
+			kind = SessBolt
+		case MemSess:
+			kind = SessMemory
+		case CookieSess:
+			kind = SessCookie
+		case FileSess:
+			kind = SessFilesystem
+		}
+		if kind != v.kind {
+			t.Errorf("Expected %s actual %s", v.kind, kind)
+		}
+	}
+	if _, err := newSessionStore(&Config{SessStore: "redis"}, opts); err == nil {
+		t.Error("Expected an error for an unknown store")
+	}
+}
+
+// testSessionStore saves a session, reads it back using the cookie and deletes it
+func testSessionStore(t *testing.T, store SessionStore) {
+	req, err := http.NewRequest("GET", testURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := store.New(req, cName)
+	if !s.IsNew {
+		t.Errorf("Expected true actual %v", s.IsNew)
+	}
+	s.Values["user"] = "gernest"
+	w := httptest.NewRecorder()
+	if err = s.Save(req, w); err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected 1 actual %d", len(cookies))
+	}
+
+	req, _ = http.NewRequest("GET", testURL, nil)
+	req.AddCookie(cookies[0])
+	ss, err := store.New(req, cName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ss.IsNew {
+		t.Errorf("Expected false actual %v", ss.IsNew)
+	}
+	if ss.Values["user"] != "gernest" {
+		t.Errorf("Expected gernest, actual %v", ss.Values["user"])
+	}
+
+	w = httptest.NewRecorder()
+	if err = store.Delete(req, w, ss); err != nil {
+		t.Fatal(err)
+	}
+	cookies = w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Errorf("Expected an expired cookie actual %v", cookies)
+	}
+	if len(ss.Values) != 0 {
+		t.Errorf("Expected no values actual %v", ss.Values)
+	}
+}
+
+func TestSessionStore_cookieAttributes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, kind := range []string{SessBolt, SessMemory, SessCookie, SessFilesystem} {
+		c := NewConfig(&Config{
+			DB:         dbName,
+			Secret:     "0123456789abcdef0123456789abcdef",
+			SessStore:  kind,
+			SessDir:    dir,
+			SessDomain: "example.com",
+		})
+		store, err := newSessionStore(c, c.cookieOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("GET", testURL, nil)
+		s, _ := store.New(req, cName)
+		s.Values["user"] = "gernest"
+		w := httptest.NewRecorder()
+		if err = s.Save(req, w); err != nil {
+			t.Fatal(err)
+		}
+		checkCookieAttributes(t, kind+" save", w)
+		w = httptest.NewRecorder()
+		if err = store.Delete(req, w, s); err != nil {
+			t.Fatal(err)
+		}
+		checkCookieAttributes(t, kind+" delete", w)
+		if kind == SessBolt {
+			os.Remove(dbName)
+		}
+	}
+}
+
+func checkCookieAttributes(t *testing.T, name string, w *httptest.ResponseRecorder) {
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Errorf("%s: Expected 1 cookie actual %d", name, len(cookies))
+		return
+	}
+	c := cookies[0]
+	if !c.Secure || !c.HttpOnly || c.SameSite != http.SameSiteLaxMode || c.Domain != "example.com" {
+		t.Errorf("%s: Expected secure attributes actual %s", name, c)
+	}
+}
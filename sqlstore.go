@@ -0,0 +1,359 @@
+package warlock
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SQLUserStore keeps users in a table of a database/sql database. The email, ID and lower
+// cased username are stored in their own columns, the rest of the user is kept as json in
+// the data column.
+type SQLUserStore struct {
+	db     *sql.DB
+	table  string
+	dollar bool
+	hasher Hasher
+}
+
+// NewSQLUserStore returns a user store backed by the given table, the table is created
+// when it does not exist and the username column is added to tables created by older
+// versions. The driver name is used to pick the query placeholder style.
+// Passwords are hashed with the given hasher or with bcrypt at the default cost.
+func NewSQLUserStore(db *sql.DB, driver, table string, h ...Hasher) (*SQLUserStore, error) {
+	s := &SQLUserStore{
+		db:     db,
+		table:  table,
+		dollar: driver == "postgres" || driver == "pgx",
+		hasher: pickHasher(h),
+	}
+	_, err := db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	email VARCHAR(255) NOT NULL PRIMARY KEY,
+	id VARCHAR(64) NOT NULL UNIQUE,
+	username VARCHAR(255) UNIQUE,
+	data TEXT NOT NULL
+)`, table))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(s.query("SELECT username FROM %s WHERE 1 = 0")); err != nil {
+		_, err = db.Exec(s.query("ALTER TABLE %s ADD COLUMN username VARCHAR(255)"))
+		if err != nil {
+			return nil, err
+		}
+		_, err = db.Exec(fmt.Sprintf("CREATE UNIQUE INDEX %s_username ON %s (username)", table, table))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// CreateUser creates a new user, the normalized email is used as the key.
+func (s *SQLUserStore) CreateUser(usr *User) error {
+	normalizeUser(usr)
+	if s.Exist(usr) {
+		return ErrUserExists
+	}
+	if s.usernameTaken(usr) {
+		return ErrUsernameExists
+	}
+	if err := prepareUser(usr, s.hasher); err != nil {
+		return err
+	}
+	data, err := marshalUser(usr)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(s.query("INSERT INTO %s (email, id, username, data) VALUES (?, ?, ?, ?)"),
+		usr.Email, usr.ID, sqlUsername(usr), string(data))
+	return err
+}
+
+// GetUser retrives a user given a valid email address
+func (s *SQLUserStore) GetUser(email string) (*User, error) {
+	return s.getBy("email", NormalizeEmail(email))
+}
+
+// GetUserByID retrives a user given its ID
+func (s *SQLUserStore) GetUserByID(id string) (*User, error) {
+	return s.getBy("id", id)
+}
+
+// GetUserByUsername retrives a user given its username, ignoring case
+func (s *SQLUserStore) GetUserByUsername(username string) (*User, error) {
+	return s.getBy("username", usernameKey(username))
+}
+
+func (s *SQLUserStore) getBy(column, value string) (*User, error) {
+	var data string
+	err := s.db.QueryRow(s.query("SELECT data FROM %s WHERE "+column+" = ?"), value).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	usr := new(User)
+	if err = unmarshalUser([]byte(data), usr); err != nil {
+		return nil, err
+	}
+	if outdated(KindUser, []byte(data)) {
+		s.writeBack(usr.Email, data)
+	}
+	return usr, nil
+}
+
+// writeBack stores the upgraded form of a user read at an older schema version so the
+// migrations run once. The row is only updated when it still holds what was read, and
+// failures are only logged since the read succeeded.
+func (s *SQLUserStore) writeBack(email, stale string) {
+	out, changed, err := upgrade(KindUser, []byte(stale))
+	if err == nil && changed {
+		_, err = s.db.Exec(s.query("UPDATE %s SET data = ? WHERE email = ? AND data = ?"), string(out), email, stale)
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// UpdateUser updates user
+func (s *SQLUserStore) UpdateUser(usr *User) error {
+	usr.Email = NormalizeEmail(usr.Email)
+	if s.usernameTaken(usr) {
+		return ErrUsernameExists
+	}
+	usr.UpdatedAt = time.Now()
+	data, err := marshalUser(usr)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(s.query("UPDATE %s SET id = ?, username = ?, data = ? WHERE email = ?"),
+		usr.ID, sqlUsername(usr), string(data), usr.Email)
+	if err != nil {
+		return err
+	}
+	return mustAffect(res)
+}
+
+// Exist checks if a give user already exists
+func (s *SQLUserStore) Exist(usr *User) bool {
+	var n int
+	err := s.db.QueryRow(s.query("SELECT 1 FROM %s WHERE email = ?"), NormalizeEmail(usr.Email)).Scan(&n)
+	return err == nil
+}
+
+// DeleteUser removes the user with the given email
+func (s *SQLUserStore) DeleteUser(email string) error {
+	res, err := s.db.Exec(s.query("DELETE FROM %s WHERE email = ?"), NormalizeEmail(email))
+	if err != nil {
+		return err
+	}
+	return mustAffect(res)
+}
+
+// ListUsers returns all users ordered by email
+func (s *SQLUserStore) ListUsers() ([]*User, error) {
+	rows, err := s.db.Query(s.query("SELECT data FROM %s ORDER BY email"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []*User
+	for rows.Next() {
+		var data string
+		if err = rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		usr := new(User)
+		if err = unmarshalUser([]byte(data), usr); err != nil {
+			return nil, err
+		}
+		users = append(users, usr)
+	}
+	return users, rows.Err()
+}
+
+// List returns a page of the users matching the options, the cursor and prefix are applied
+// by the database and the other filters while reading the rows
+func (s *SQLUserStore) List(opts ListOptions) (*UserPage, error) {
+	q := "SELECT data FROM %s WHERE email > ?"
+	args := []interface{}{opts.Cursor}
+	if opts.Prefix != "" {
+		q += " AND email LIKE ? ESCAPE '!'"
+		args = append(args, likeEscape(opts.Prefix)+"%")
+	}
+	rows, err := s.db.Query(s.query(q+" ORDER BY email"), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	p := &pager{opts: opts}
+	for rows.Next() {
+		var data string
+		if err = rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		usr := new(User)
+		if err = unmarshalUser([]byte(data), usr); err != nil {
+			return nil, err
+		}
+		if p.add(usr) {
+			break
+		}
+	}
+	return &p.page, rows.Err()
+}
+
+// Migrate upgrades every stored user to the current schema, it returns how many users
+// were rewritten
+func (s *SQLUserStore) Migrate() (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(s.query("SELECT email, data FROM %s"))
+	if err != nil {
+		return 0, err
+	}
+	changed := make(map[string][]byte)
+	for rows.Next() {
+		var email, data string
+		if err = rows.Scan(&email, &data); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		out, ok, err := upgrade(KindUser, []byte(data))
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("%s: %v", email, err)
+		}
+		if ok {
+			changed[email] = out
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	for email, data := range changed {
+		if _, err = tx.Exec(s.query("UPDATE %s SET data = ? WHERE email = ?"), string(data), email); err != nil {
+			return 0, err
+		}
+	}
+	return len(changed), tx.Commit()
+}
+
+// likeEscape escapes the LIKE wildcards in s with !, backslashes are not portable since
+// mysql also treats them as escapes in string literals
+func likeEscape(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
+
+// NormalizeEmails finds users stored under an email which is not normalized, when apply is
+// set they are moved to the normalized key and the stored email is kept as DisplayEmail.
+// Users whose emails collide once normalized are only reported.
+func (s *SQLUserStore) NormalizeEmails(apply bool) (*EmailReport, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(s.query("SELECT email FROM %s"))
+	if err != nil {
+		return nil, err
+	}
+	var stored []string
+	for rows.Next() {
+		var e string
+		if err = rows.Scan(&e); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		stored = append(stored, e)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	report := planEmails(stored)
+	if !apply {
+		return report, nil
+	}
+	for from, to := range report.Renamed {
+		var data string
+		if err = tx.QueryRow(s.query("SELECT data FROM %s WHERE email = ?"), from).Scan(&data); err != nil {
+			return nil, err
+		}
+		usr := new(User)
+		if err = unmarshalUser([]byte(data), usr); err != nil {
+			return nil, err
+		}
+		usr.DisplayEmail = from
+		usr.Email = to
+		b, err := marshalUser(usr)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(s.query("UPDATE %s SET email = ?, data = ? WHERE email = ?"), to, string(b), from)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return report, tx.Commit()
+}
+
+// usernameTaken reports whether another user has the username of usr, the unique
+// constraint still guards against races
+func (s *SQLUserStore) usernameTaken(usr *User) bool {
+	if usr.Username == "" {
+		return false
+	}
+	var n int
+	err := s.db.QueryRow(s.query("SELECT 1 FROM %s WHERE username = ? AND email <> ?"),
+		usernameKey(usr.Username), usr.Email).Scan(&n)
+	return err == nil
+}
+
+// sqlUsername is the value of the username column, NULL when the user has none so the
+// unique constraint does not apply
+func sqlUsername(usr *User) interface{} {
+	if usr.Username == "" {
+		return nil
+	}
+	return usernameKey(usr.Username)
+}
+
+// query fills in the table name and rewrites ? placeholders for drivers which expect $1
+func (s *SQLUserStore) query(q string) string {
+	q = fmt.Sprintf(q, s.table)
+	if !s.dollar {
+		return q
+	}
+	var buf strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			buf.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		buf.WriteRune(c)
+	}
+	return buf.String()
+}
+
+func mustAffect(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
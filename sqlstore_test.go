@@ -0,0 +1,97 @@
+package warlock
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+func TestSQLUserStore(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// every connection gets its own in memory database
+	db.SetMaxOpenConns(1)
+	s, err := NewSQLUserStore(db, "sqlite", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testUserStorer(t, s)
+	if err = s.UpdateUser(&User{Email: "nobody@home.com"}); err != ErrUserNotFound {
+		t.Errorf("Expected %v actual %v", ErrUserNotFound, err)
+	}
+}
+
+func TestSQLUserStore_addsUsername(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	// the table as created before usernames existed
+	_, err = db.Exec(`CREATE TABLE users (
+	email VARCHAR(255) NOT NULL PRIMARY KEY,
+	id VARCHAR(64) NOT NULL UNIQUE,
+	data TEXT NOT NULL
+)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSQLUserStore(db, "sqlite", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.CreateUser(&User{Email: "me@home.com", Username: "me", Password: "pass"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.GetUserByUsername("me"); err != nil {
+		t.Errorf("Expected nil actual %v", err)
+	}
+}
+
+func TestSQLUserStore_upgradeOnRead(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	s, err := NewSQLUserStore(db, "sqlite", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(`INSERT INTO users (email, id, data) VALUES ('old@home.com', '1', '{"Email":"old@home.com"}')`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.GetUser("old@home.com"); err != nil {
+		t.Fatal(err)
+	}
+	var data string
+	if err = db.QueryRow(`SELECT data FROM users WHERE email = 'old@home.com'`).Scan(&data); err != nil {
+		t.Fatal(err)
+	}
+	if outdated(KindUser, []byte(data)) {
+		t.Errorf("Expected the upgraded record to be stored actual %s", data)
+	}
+}
+
+func TestSQLUserStore_query(t *testing.T) {
+	s := &SQLUserStore{table: "users", dollar: true}
+	q := s.query("UPDATE %s SET id = ?, data = ? WHERE email = ?")
+	e := "UPDATE users SET id = $1, data = $2 WHERE email = $3"
+	if q != e {
+		t.Errorf("Expected %s actual %s", e, q)
+	}
+	s.dollar = false
+	q = s.query("SELECT data FROM %s WHERE email = ?")
+	e = "SELECT data FROM users WHERE email = ?"
+	if q != e {
+		t.Errorf("Expected %s actual %s", e, q)
+	}
+}
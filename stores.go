@@ -1,25 +1,34 @@
 package warlock
 
 import (
+	"bytes"
 	"encoding/base32"
 	"encoding/json"
 	"errors"
 	"log"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 
 	u "github.com/nu7hatch/gouuid"
 
+	"github.com/boltdb/bolt"
 	"github.com/gernest/nutz"
 	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
-	"golang.org/x/crypto/bcrypt"
+)
+
+// Bucket names used by YoungWarlock for the bolt stores
+const (
+	UserBucket    = "warlock"
+	SessionBucket = "sessions"
 )
 
 // Sess implements gorilla sessions storage backend interface
 type Sess struct {
 	store    nutz.Storage
+	db       string
 	bucket   string
 	options  *sessions.Options
 	codecs   []securecookie.Codec
@@ -29,12 +38,58 @@ type Sess struct {
 type sessionValue struct {
 	Data    string    `json:"data"`
 	Expires time.Time `json:"expires"`
+	User    string    `json:"user,omitempty"`
+	Version int       `json:"schema_version"`
+}
+
+var (
+	// ErrUserExists is returned when creating a user whose email is already taken
+	ErrUserExists = errors.New("warlock: email already exists")
+
+	// ErrUserNotFound is returned when there is no user with the given key
+	ErrUserNotFound = errors.New("warlock: user not found")
+
+	// ErrUsernameExists is returned when saving a user whose username is already taken
+	ErrUsernameExists = errors.New("warlock: username already exists")
+)
+
+// UserStorer is implemented by user storage backends. Handlers accept any of them
+// through YoungWarlock.
+type UserStorer interface {
+	// CreateUser hashes the password and stores a new user, email is used as the key.
+	CreateUser(usr *User) error
+
+	// GetUser retrives a user given a valid email address
+	GetUser(email string) (*User, error)
+
+	// UpdateUser persists changes made to the user
+	UpdateUser(usr *User) error
+
+	// Exist checks if a given user already exists
+	Exist(usr *User) bool
+
+	// DeleteUser removes the user with the given email
+	DeleteUser(email string) error
+
+	// ListUsers returns all users ordered by email
+	ListUsers() ([]*User, error)
+
+	// GetUserByID retrives a user given its ID
+	GetUserByID(id string) (*User, error)
+
+	// GetUserByUsername retrives a user given its username, ignoring case
+	GetUserByUsername(username string) (*User, error)
+
+	// List returns a page of the users matching the options, ordered by email
+	List(opts ListOptions) (*UserPage, error)
 }
 
-// UserStore user storage stuffs
+// UserStore user storage stuffs, it is backed by bolt
 type UserStore struct {
 	store  nutz.Storage
+	db     string
 	bucket string
+	hasher Hasher
 }
 
 type Flash struct {
@@ -78,6 +133,7 @@ func (f *Flash) Get(s *sessions.Session) *Flash {
 func NewSessStore(db, bucket string, duration int, opts *sessions.Options, secrets ...[]byte) Sess {
 	return Sess{
 		store:    nutz.NewStorage(db, 0660, nil),
+		db:       db,
 		bucket:   bucket,
 		options:  opts,
 		codecs:   securecookie.CodecsFromPairs(secrets...),
@@ -146,10 +202,20 @@ func (s Sess) save(session *sessions.Session) error {
 	if err != nil {
 		return err
 	}
+	user, _ := session.Values[sessionUserKey].(string)
 	v, err := json.Marshal(sessionValue{
 		Data:    encoded,
 		Expires: s.getExpires(session.Options.MaxAge),
+		User:    user,
+		Version: SchemaVersion(KindSession),
 	})
+	if err != nil {
+		return err
+	}
+	// loaded sessions already have a record which Create refuses to overwrite
+	if !session.IsNew {
+		return s.store.Update(s.bucket, session.ID, v).Error
+	}
 	ss := s.store.Create(s.bucket, session.ID, v)
 	return ss.Error
 }
@@ -157,7 +223,7 @@ func (s Sess) save(session *sessions.Session) error {
 func (s Sess) load(session *sessions.Session) error {
 	v := &sessionValue{}
 	ss := s.store.Get(s.bucket, session.ID)
-	err := json.Unmarshal(ss.Data, v)
+	err := unmarshalSession(ss.Data, v)
 	if err != nil {
 		return err
 	}
@@ -171,6 +237,66 @@ func (s Sess) load(session *sessions.Session) error {
 	return nil
 }
 
+// Purge removes expired sessions from the database, or every session when all is set,
+// and returns how many were removed
+func (s Sess) Purge(all bool) (int, error) {
+	list := s.store.GetAll(s.bucket)
+	if list.Error != nil {
+		return 0, list.Error
+	}
+	n := 0
+	for id, data := range list.DataList {
+		v := &sessionValue{}
+		if !all && unmarshalSession(data, v) == nil && v.Expires.After(time.Now()) {
+			continue
+		}
+		if d := s.store.Delete(s.bucket, id); d.Error != nil {
+			return n, d.Error
+		}
+		n++
+	}
+	return n, nil
+}
+
+// UserSessions returns the live sessions of the user with the given email
+func (s Sess) UserSessions(email string) ([]SessionInfo, error) {
+	list := s.store.GetAll(s.bucket)
+	if list.Error != nil {
+		// the bucket is only created with the first session
+		return nil, nil
+	}
+	var out []SessionInfo
+	for id, data := range list.DataList {
+		v := &sessionValue{}
+		if unmarshalSession(data, v) != nil || v.User != email || v.Expires.Before(time.Now()) {
+			continue
+		}
+		out = append(out, SessionInfo{ID: id, Expires: v.Expires})
+	}
+	sortSessions(out)
+	return out, nil
+}
+
+// DeleteUserSessions removes every session of the user with the given email
+func (s Sess) DeleteUserSessions(email string) (int, error) {
+	list := s.store.GetAll(s.bucket)
+	if list.Error != nil {
+		return 0, nil
+	}
+	n := 0
+	for id, data := range list.DataList {
+		v := &sessionValue{}
+		if unmarshalSession(data, v) != nil || v.User != email {
+			continue
+		}
+		if d := s.store.Delete(s.bucket, id); d.Error != nil {
+			return n, d.Error
+		}
+		n++
+	}
+	return n, nil
+}
+
 func (s Sess) getExpires(maxAge int) time.Time {
 	if maxAge <= 0 {
 		return time.Now().Add(time.Second * time.Duration(s.duration))
@@ -178,69 +304,508 @@ func (s Sess) getExpires(maxAge int) time.Time {
 	return time.Now().Add(time.Second * time.Duration(maxAge))
 }
 
-// NewUserStore deals with storage of users
-func NewUserStore(db, bucket string) UserStore {
+// NewUserStore deals with storage of users, passwords are hashed with the given hasher or
+// with bcrypt at the default cost when none is given. Users are kept under their email in
+// the bucket, the <bucket>_id, <bucket>_username and <bucket>_role buckets index them by
+// ID, username and role.
+func NewUserStore(db, bucket string, h ...Hasher) UserStore {
 	return UserStore{
 		store:  nutz.NewStorage(db, 0600, nil),
+		db:     db,
 		bucket: bucket,
+		hasher: pickHasher(h),
 	}
 }
 
-// CreateUser creates a new user, email is used as the key.
+// CreateUser creates a new user, the normalized email is used as the key.
 func (us UserStore) CreateUser(usr *User) error {
-	uid, err := u.NewV4()
-	if err != nil {
-		log.Println(err)
-	}
-	usr.ID = uid.String()
-	usr.CreatedAt = time.Now()
-	p, err := bcrypt.GenerateFromPassword([]byte(usr.Password), 8)
-	if err != nil {
+	normalizeUser(usr)
+	if err := prepareUser(usr, us.hasher); err != nil {
 		return err
 	}
-	usr.Password = string(p)
-	data, err := json.Marshal(usr)
+	data, err := marshalUser(usr)
 	if err != nil {
 		return err
 	}
-	g := us.store.Get(us.bucket, usr.Email)
-	if g.Data != nil {
-		return errors.New("warlock: email already exists")
-	}
-	z := g.Create(us.bucket, usr.Email, data)
-	return z.Error
+	return us.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(us.bucket))
+		if b.Get([]byte(usr.Email)) != nil {
+			return ErrUserExists
+		}
+		if err := us.index(tx, nil, usr); err != nil {
+			return err
+		}
+		return b.Put([]byte(usr.Email), data)
+	})
 }
 
 // GetUser retrives a user given a valid email address
 func (us UserStore) GetUser(email string) (*User, error) {
-	g := us.store.Get(us.bucket, email)
-	if g.Error != nil {
-		return nil, g.Error
-	}
 	usr := new(User)
-	err := json.Unmarshal(g.Data, usr)
+	var stale []byte
+	err := us.view(func(tx *bolt.Tx) error {
+		var err error
+		stale, err = readBoltUser(tx.Bucket([]byte(us.bucket)), NormalizeEmail(email), usr)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
+	us.writeBack(usr.Email, stale)
 	return usr, nil
 }
 
-// UpdateUser updates user
+// GetUserByID retrives a user given its ID
+func (us UserStore) GetUserByID(id string) (*User, error) {
+	return us.getIndexed(us.bucket+"_id", id)
+}
+
+// GetUserByUsername retrives a user given its username, usernames are matched ignoring case
+func (us UserStore) GetUserByUsername(username string) (*User, error) {
+	return us.getIndexed(us.bucket+"_username", usernameKey(username))
+}
+
+// UpdateUser updates user, the indexes are updated in the same transaction
 func (us UserStore) UpdateUser(usr *User) error {
+	usr.Email = NormalizeEmail(usr.Email)
 	usr.UpdatedAt = time.Now()
-	data, err := json.Marshal(usr)
+	data, err := marshalUser(usr)
 	if err != nil {
 		return err
 	}
-	up := us.store.Update(us.bucket, usr.Email, data)
-	return up.Error
+	return us.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(us.bucket))
+		old := new(User)
+		if err := getBoltUser(b, usr.Email, old); err != nil {
+			return err
+		}
+		if err := us.index(tx, old, usr); err != nil {
+			return err
+		}
+		return b.Put([]byte(usr.Email), data)
+	})
 }
 
 // Exists checks if a give user already exists
 func (us UserStore) Exist(usr *User) bool {
-	g := us.store.Get(us.bucket, usr.Email)
-	if g.Data != nil {
-		return true
+	_, err := us.GetUser(usr.Email)
+	return err == nil
+}
+
+// DeleteUser removes the user with the given email along with its index entries
+func (us UserStore) DeleteUser(email string) error {
+	email = NormalizeEmail(email)
+	return us.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(us.bucket))
+		old := new(User)
+		if err := getBoltUser(b, email, old); err != nil {
+			return err
+		}
+		if err := us.index(tx, old, nil); err != nil {
+			return err
+		}
+		return b.Delete([]byte(email))
+	})
+}
+
+// ListUsers returns all users ordered by email
+func (us UserStore) ListUsers() ([]*User, error) {
+	var users []*User
+	err := us.view(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(us.bucket)).ForEach(func(k, v []byte) error {
+			usr := new(User)
+			if err := unmarshalUser(v, usr); err != nil {
+				return err
+			}
+			users = append(users, usr)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// List returns a page of the users matching the options. The bolt cursor seeks to the
+// page cursor or the email prefix, and walks the role index when a role is asked for.
+// Databases which have not been written to since the role index was added have none yet,
+// their users are scanned instead.
+func (us UserStore) List(opts ListOptions) (*UserPage, error) {
+	p := &pager{opts: opts}
+	err := us.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(us.bucket))
+		if roles := tx.Bucket([]byte(us.bucket + "_role")); opts.Role != "" && roles != nil {
+			prefix := roleKey(opts.Role, "")
+			c := roles.Cursor()
+			for k, v := c.Seek([]byte(roleKey(opts.Role, opts.start()))); k != nil && strings.HasPrefix(string(k), prefix); k, v = c.Next() {
+				if opts.pastPrefix(string(v)) {
+					break
+				}
+				usr := new(User)
+				if err := getBoltUser(b, string(v), usr); err != nil {
+					return err
+				}
+				if p.add(usr) {
+					break
+				}
+			}
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(opts.start())); k != nil && !opts.pastPrefix(string(k)); k, v = c.Next() {
+			usr := new(User)
+			if err := unmarshalUser(v, usr); err != nil {
+				return err
+			}
+			if p.add(usr) {
+				break
+			}
+		}
+		return nil
+	})
+	if err == ErrUserNotFound {
+		// nothing has been stored yet
+		return &p.page, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p.page, nil
+}
+
+// index moves the index entries of old to the ones of usr, either of them is nil when a
+// user is created or deleted. Usernames taken by another user are refused.
+func (us UserStore) index(tx *bolt.Tx, old, usr *User) error {
+	ids := tx.Bucket([]byte(us.bucket + "_id"))
+	names := tx.Bucket([]byte(us.bucket + "_username"))
+	roles := tx.Bucket([]byte(us.bucket + "_role"))
+	if old != nil {
+		for _, r := range old.Roles {
+			if err := roles.Delete([]byte(roleKey(r, old.Email))); err != nil {
+				return err
+			}
+		}
+		if old.ID != "" {
+			if err := ids.Delete([]byte(old.ID)); err != nil {
+				return err
+			}
+		}
+		if old.Username != "" {
+			if err := names.Delete([]byte(usernameKey(old.Username))); err != nil {
+				return err
+			}
+		}
+	}
+	if usr == nil {
+		return nil
+	}
+	for _, r := range usr.Roles {
+		if err := roles.Put([]byte(roleKey(r, usr.Email)), []byte(usr.Email)); err != nil {
+			return err
+		}
+	}
+	if usr.Username != "" {
+		key := []byte(usernameKey(usr.Username))
+		if owner := names.Get(key); owner != nil && string(owner) != usr.Email {
+			return ErrUsernameExists
+		}
+		if err := names.Put(key, []byte(usr.Email)); err != nil {
+			return err
+		}
+	}
+	if usr.ID == "" {
+		return nil
+	}
+	return ids.Put([]byte(usr.ID), []byte(usr.Email))
+}
+
+func (us UserStore) getIndexed(index, key string) (*User, error) {
+	usr := new(User)
+	var stale []byte
+	err := us.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(index))
+		if b == nil {
+			return ErrUserNotFound
+		}
+		email := b.Get([]byte(key))
+		if email == nil {
+			return ErrUserNotFound
+		}
+		var err error
+		stale, err = readBoltUser(tx.Bucket([]byte(us.bucket)), string(email), usr)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	us.writeBack(usr.Email, stale)
+	return usr, nil
+}
+
+// Reindex rebuilds the indexes from the stored users. Missing indexes are built on the
+// next write, this is needed for indexes which are out of step with the users, like the
+// role index of databases written by versions which created it empty.
+func (us UserStore) Reindex() error {
+	return us.update(us.reindex)
+}
+
+// reindex replaces the index buckets with ones built from the stored users
+func (us UserStore) reindex(tx *bolt.Tx) error {
+	for _, name := range us.indexes() {
+		if err := tx.DeleteBucket([]byte(name)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		if _, err := tx.CreateBucket([]byte(name)); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket([]byte(us.bucket)).ForEach(func(k, v []byte) error {
+		usr := new(User)
+		if err := unmarshalUser(v, usr); err != nil {
+			return err
+		}
+		return us.index(tx, nil, usr)
+	})
+}
+
+// NormalizeEmails finds users stored under an email which is not normalized, when apply is
+// set they are moved to the normalized key and the stored email is kept as DisplayEmail.
+// Users whose emails collide once normalized are only reported.
+func (us UserStore) NormalizeEmails(apply bool) (*EmailReport, error) {
+	var report *EmailReport
+	err := us.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(us.bucket))
+		var stored []string
+		err := b.ForEach(func(k, v []byte) error {
+			stored = append(stored, string(k))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		report = planEmails(stored)
+		if !apply {
+			return nil
+		}
+		for from, to := range report.Renamed {
+			old := new(User)
+			if err = getBoltUser(b, from, old); err != nil {
+				return err
+			}
+			usr := *old
+			usr.DisplayEmail = from
+			usr.Email = to
+			data, err := marshalUser(&usr)
+			if err != nil {
+				return err
+			}
+			if err = us.index(tx, old, &usr); err != nil {
+				return err
+			}
+			if err = b.Delete([]byte(from)); err != nil {
+				return err
+			}
+			if err = b.Put([]byte(to), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return report, err
+}
+
+// update runs fn in a read-write transaction. The user bucket is created when missing,
+// and the indexes are built from the stored users when one of their buckets is, so an
+// index bucket only ever exists complete.
+func (us UserStore) update(fn func(*bolt.Tx) error) error {
+	db, err := bolt.Open(us.db, 0600, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists([]byte(us.bucket)); err != nil {
+			return err
+		}
+		for _, name := range us.indexes() {
+			if tx.Bucket([]byte(name)) == nil {
+				if err := us.reindex(tx); err != nil {
+					return err
+				}
+				break
+			}
+		}
+		return fn(tx)
+	})
+}
+
+// view runs fn in a read-only transaction, there are no users until the bucket exists
+func (us UserStore) view(fn func(*bolt.Tx) error) error {
+	db, err := bolt.Open(us.db, 0600, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(us.bucket)) == nil {
+			return ErrUserNotFound
+		}
+		return fn(tx)
+	})
+}
+
+// indexes returns the names of the index buckets
+func (us UserStore) indexes() []string {
+	return []string{us.bucket + "_id", us.bucket + "_username", us.bucket + "_role"}
+}
+
+// roleKey is the key of the role index, the email follows the role so the users of a
+// role are kept in email order
+func roleKey(role, email string) string {
+	return role + "\x00" + email
+}
+
+// readBoltUser is getBoltUser for read-only transactions. When the stored record was at an
+// older schema version it also returns a copy of it, to be handed to writeBack once the
+// transaction is over.
+func readBoltUser(b *bolt.Bucket, email string, usr *User) ([]byte, error) {
+	if err := getBoltUser(b, email, usr); err != nil {
+		return nil, err
+	}
+	if data := b.Get([]byte(email)); outdated(KindUser, data) {
+		return append([]byte(nil), data...), nil
+	}
+	return nil, nil
+}
+
+// writeBack stores the upgraded form of a user record read at an older schema version so
+// the migrations run once instead of on every read. The record is left alone when it
+// changed since it was read, and failures are only logged since the read succeeded.
+func (us UserStore) writeBack(email string, stale []byte) {
+	if stale == nil {
+		return
+	}
+	out, changed, err := upgrade(KindUser, stale)
+	if err == nil && changed {
+		err = us.update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(us.bucket))
+			if !bytes.Equal(b.Get([]byte(email)), stale) {
+				return nil
+			}
+			return b.Put([]byte(email), out)
+		})
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func getBoltUser(b *bolt.Bucket, email string, usr *User) error {
+	data := b.Get([]byte(email))
+	if data == nil {
+		return ErrUserNotFound
+	}
+	return unmarshalUser(data, usr)
+}
+
+// usernameKey is the form usernames are indexed under, they are unique ignoring case
+func usernameKey(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// prepareUser assigns a fresh ID and creation time to a new user and hashes the password
+func prepareUser(usr *User, h Hasher) error {
+	uid, err := u.NewV4()
+	if err != nil {
+		return err
+	}
+	usr.ID = uid.String()
+	usr.CreatedAt = time.Now()
+	p, err := h.Hash(usr.Password)
+	if err != nil {
+		return err
+	}
+	usr.Password = p
+	return nil
+}
+
+func pickHasher(h []Hasher) Hasher {
+	if len(h) > 0 && h[0] != nil {
+		return h[0]
+	}
+	return NewBcryptHasher()
+}
+
+func sortUsers(users []*User) {
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Email < users[j].Email
+	})
+}
+
+// SetPassword replaces the password of the user with the given email by the hash of pass,
+// a pending password reset is cleared
+func SetPassword(s UserStorer, h Hasher, email, pass string) error {
+	usr, err := s.GetUser(email)
+	if err != nil {
+		return err
+	}
+	p, err := h.Hash(pass)
+	if err != nil {
+		return err
+	}
+	usr.Password = p
+	usr.ResetRequired = false
+	return s.UpdateUser(usr)
+}
+
+// SetDisabled locks or unlocks the account of the user with the given email, locked users
+// can not log in and their sessions are ignored
+func SetDisabled(s UserStorer, email string, disabled bool) error {
+	usr, err := s.GetUser(email)
+	if err != nil {
+		return err
+	}
+	usr.Disabled = disabled
+	return s.UpdateUser(usr)
+}
+
+// GrantRole adds role to the user with the given email
+func GrantRole(s UserStorer, email, role string) error {
+	usr, err := s.GetUser(email)
+	if err != nil {
+		return err
+	}
+	usr.Roles = addString(usr.Roles, role)
+	return s.UpdateUser(usr)
+}
+
+// RevokeRole removes role from the user with the given email
+func RevokeRole(s UserStorer, email, role string) error {
+	usr, err := s.GetUser(email)
+	if err != nil {
+		return err
+	}
+	usr.Roles = removeString(usr.Roles, role)
+	return s.UpdateUser(usr)
+}
+
+// GrantPermission adds perm to the user with the given email
+func GrantPermission(s UserStorer, email, perm string) error {
+	usr, err := s.GetUser(email)
+	if err != nil {
+		return err
+	}
+	usr.Permissions = addString(usr.Permissions, perm)
+	return s.UpdateUser(usr)
+}
+
+// RevokePermission removes perm from the user with the given email
+func RevokePermission(s UserStorer, email, perm string) error {
+	usr, err := s.GetUser(email)
+	if err != nil {
+		return err
 	}
-	return false
+	usr.Permissions = removeString(usr.Permissions, perm)
+	return s.UpdateUser(usr)
 }
@@ -4,8 +4,11 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 )
@@ -154,6 +157,319 @@ func TestUserStore(t *testing.T) {
 	}
 
 }
+func TestUserStore_roles(t *testing.T) {
+	ns := NewUserStore("roles.db", "account")
+	defer ns.store.DeleteDatabase()
+	u := &User{Email: "gernest@home.com"}
+	if err := ns.CreateUser(u); err != nil {
+		t.Error(err)
+	}
+	if err := GrantRole(ns, u.Email, RoleAdmin); err != nil {
+		t.Error(err)
+	}
+	if err := GrantPermission(ns, u.Email, "users.delete"); err != nil {
+		t.Error(err)
+	}
+	usr, err := ns.GetUser(u.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !usr.HasRole(RoleAdmin) || !usr.HasPermission("users.delete") {
+		t.Errorf("Expected role and permission to be granted actual %v %v", usr.Roles, usr.Permissions)
+	}
+	if err = RevokeRole(ns, u.Email, RoleAdmin); err != nil {
+		t.Error(err)
+	}
+	if err = RevokePermission(ns, u.Email, "users.delete"); err != nil {
+		t.Error(err)
+	}
+	usr, err = ns.GetUser(u.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usr.HasRole(RoleAdmin) || usr.HasPermission("users.delete") {
+		t.Errorf("Expected role and permission to be revoked actual %v %v", usr.Roles, usr.Permissions)
+	}
+}
+
+func TestUserStore_storer(t *testing.T) {
+	ns := NewUserStore("storer.db", "account")
+	defer ns.store.DeleteDatabase()
+	testUserStorer(t, ns)
+}
+
+// testUserStorer runs the behaviour every UserStorer implementation must have
+func testUserStorer(t *testing.T, s UserStorer) {
+	emails := []string{"warlock@home.com", "gernest@home.com"}
+	for _, e := range emails {
+		usr := &User{FirstName: "young", Email: e, Password: "pass"}
+		if err := s.CreateUser(usr); err != nil {
+			t.Fatal(err)
+		}
+		if usr.ID == "" {
+			t.Error("Expected an ID to be assigned")
+		}
+		if usr.Password == "pass" {
+			t.Error("Expected the password to be hashed")
+		}
+	}
+	if err := s.CreateUser(&User{Email: emails[0]}); err != ErrUserExists {
+		t.Errorf("Expected %v actual %v", ErrUserExists, err)
+	}
+	usr, err := s.GetUser(emails[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = usr.MatchPassword("pass"); err != nil {
+		t.Error(err)
+	}
+	if !s.Exist(usr) {
+		t.Errorf("Expected true actual %v", s.Exist(usr))
+	}
+	usr.FirstName = "old"
+	if err = s.UpdateUser(usr); err != nil {
+		t.Error(err)
+	}
+	usr, err = s.GetUser(emails[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usr.FirstName != "old" {
+		t.Errorf("Expected old actual %s", usr.FirstName)
+	}
+	users, err := s.ListUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("Expected 2 actual %d", len(users))
+	}
+	if users[0].Email != emails[1] || users[1].Email != emails[0] {
+		t.Errorf("Expected users ordered by email actual %s %s", users[0].Email, users[1].Email)
+	}
+	if err = s.DeleteUser(emails[0]); err != nil {
+		t.Error(err)
+	}
+	if s.Exist(usr) {
+		t.Errorf("Expected false actual %v", s.Exist(usr))
+	}
+	if _, err = s.GetUser(emails[0]); err == nil {
+		t.Error("Expected an error getting a deleted user")
+	}
+	testUserLookups(t, s)
+	testUserList(t, s)
+}
+
+// testUserList checks List of a UserStorer, it expects users left by testUserLookups
+func testUserList(t *testing.T, s UserStorer) {
+	before := time.Now()
+	sample := []*User{
+		{Email: "ann@corp.com", FirstName: "Ann", Roles: []string{RoleAdmin}, Verified: true},
+		{Email: "ben@corp.com", FirstName: "Ben", Roles: []string{"staff"}, Disabled: true},
+		{Email: "cat@corp.com", FirstName: "Cat", Roles: []string{RoleAdmin, "staff"}},
+		{Email: "dan@home.com", FirstName: "Danny"},
+		{Email: "eve_x@corp.com", FirstName: "Eve", Roles: []string{RoleAdmin}, Verified: true},
+	}
+	for _, usr := range sample {
+		if err := s.CreateUser(usr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	yes, no := true, false
+	emails := func(p *UserPage) string {
+		var out []string
+		for _, u := range p.Users {
+			out = append(out, u.Email)
+		}
+		return strings.Join(out, " ")
+	}
+	cases := []struct {
+		opts  ListOptions
+		found string
+	}{
+		{ListOptions{Prefix: "b"}, "b@home.com ben@corp.com"},
+		{ListOptions{Role: RoleAdmin}, "ann@corp.com cat@corp.com eve_x@corp.com"},
+		{ListOptions{Role: "staff", Disabled: &no}, "cat@corp.com"},
+		{ListOptions{Verified: &yes}, "ann@corp.com eve_x@corp.com"},
+		{ListOptions{Search: "DAN"}, "dan@home.com"},
+		{ListOptions{Search: "corp", Prefix: "e"}, "eve_x@corp.com"},
+		{ListOptions{Prefix: "eve_"}, "eve_x@corp.com"},
+		{ListOptions{Prefix: "ev%"}, ""},
+		{ListOptions{CreatedAfter: before, Search: "corp"}, "ann@corp.com ben@corp.com cat@corp.com eve_x@corp.com"},
+		{ListOptions{CreatedBefore: before}, "b@home.com gernest@home.com"},
+	}
+	for _, v := range cases {
+		p, err := s.List(v.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := emails(p); got != v.found || p.Next != "" {
+			t.Errorf("Expected %q actual %q next %q for %+v", v.found, got, p.Next, v.opts)
+		}
+	}
+
+	// pages
+	opts := ListOptions{Limit: 2, Role: RoleAdmin}
+	p, err := s.List(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emails(p) != "ann@corp.com cat@corp.com" || p.Next != "cat@corp.com" {
+		t.Errorf("Expected the first page actual %q next %q", emails(p), p.Next)
+	}
+	opts.Cursor = p.Next
+	if p, err = s.List(opts); err != nil {
+		t.Fatal(err)
+	}
+	if emails(p) != "eve_x@corp.com" || p.Next != "" {
+		t.Errorf("Expected the last page actual %q next %q", emails(p), p.Next)
+	}
+
+	// role changes move the user in the role index
+	if err = RevokeRole(s, "cat@corp.com", RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ = s.List(ListOptions{Role: RoleAdmin}); emails(p) != "ann@corp.com eve_x@corp.com" {
+		t.Errorf("Expected cat to be gone actual %q", emails(p))
+	}
+}
+
+// testUserLookups checks the ID and username lookups of a UserStorer
+func testUserLookups(t *testing.T, s UserStorer) {
+	a := &User{Email: "a@home.com", Username: "Alice", Password: "pass"}
+	if err := s.CreateUser(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateUser(&User{Email: "b@home.com", Username: "alice", Password: "pass"}); err != ErrUsernameExists {
+		t.Errorf("Expected %v actual %v", ErrUsernameExists, err)
+	}
+	b := &User{Email: "b@home.com", Password: "pass"}
+	if err := s.CreateUser(b); err != nil {
+		t.Fatal(err)
+	}
+	usr, err := s.GetUserByID(a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usr.Email != a.Email {
+		t.Errorf("Expected %s actual %s", a.Email, usr.Email)
+	}
+	if usr, err = s.GetUserByUsername("ALICE"); err != nil || usr.Email != a.Email {
+		t.Errorf("Expected %s actual %v %v", a.Email, usr, err)
+	}
+
+	b.Username = "alice"
+	if err = s.UpdateUser(b); err != ErrUsernameExists {
+		t.Errorf("Expected %v actual %v", ErrUsernameExists, err)
+	}
+	a.Username = "al"
+	if err = s.UpdateUser(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.GetUserByUsername("alice"); err != ErrUserNotFound {
+		t.Errorf("Expected %v actual %v", ErrUserNotFound, err)
+	}
+	if err = s.UpdateUser(b); err != nil {
+		t.Errorf("Expected the freed username to be taken actual %v", err)
+	}
+	if usr, err = s.GetUserByUsername("al"); err != nil || usr.Email != a.Email {
+		t.Errorf("Expected %s actual %v %v", a.Email, usr, err)
+	}
+
+	if err = s.DeleteUser(a.Email); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.GetUserByID(a.ID); err != ErrUserNotFound {
+		t.Errorf("Expected %v actual %v", ErrUserNotFound, err)
+	}
+	if _, err = s.GetUserByUsername("al"); err != ErrUserNotFound {
+		t.Errorf("Expected %v actual %v", ErrUserNotFound, err)
+	}
+}
+
+func TestUserStore_Reindex(t *testing.T) {
+	ns := NewUserStore("reindex.db", "account")
+	defer ns.store.DeleteDatabase()
+	usr := &User{Email: "gernest@home.com", Username: "gernest"}
+	if err := ns.CreateUser(usr); err != nil {
+		t.Fatal(err)
+	}
+
+	// records written before the indexes existed
+	db, err := bolt.Open("reindex.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte("account_id")); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket([]byte("account_id"))
+		return err
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ns.GetUserByID(usr.ID); err != ErrUserNotFound {
+		t.Errorf("Expected %v actual %v", ErrUserNotFound, err)
+	}
+	if err = ns.Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ns.GetUserByID(usr.ID); err != nil {
+		t.Errorf("Expected nil actual %v", err)
+	}
+}
+
+func TestUserStore_roleIndex(t *testing.T) {
+	ns := NewUserStore("roles.db", "account")
+	defer ns.store.DeleteDatabase()
+	admins := func() string {
+		p, err := ns.List(ListOptions{Role: RoleAdmin})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for _, u := range p.Users {
+			out = append(out, u.Email)
+		}
+		return strings.Join(out, " ")
+	}
+
+	// written before the role index existed
+	putRaw(t, "roles.db", "account", map[string]string{
+		"old@home.com": `{"ID":"1","Email":"old@home.com","Roles":["admin"]}`,
+	})
+	putRaw(t, "roles.db", "account_id", map[string]string{"1": "old@home.com"})
+	putRaw(t, "roles.db", "account_username", nil)
+	if got := admins(); got != "old@home.com" {
+		t.Errorf("Expected old@home.com actual %q", got)
+	}
+
+	// the first write builds the missing index
+	if err := ns.CreateUser(&User{Email: "new@home.com", Roles: []string{RoleAdmin}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := admins(); got != "new@home.com old@home.com" {
+		t.Errorf("Expected both admins actual %q", got)
+	}
+
+	// an index left incomplete is repaired by Migrate
+	putRaw(t, "roles.db", "account", map[string]string{
+		"older@home.com": `{"ID":"2","Email":"older@home.com","Roles":["admin"]}`,
+	})
+	if got := admins(); got != "new@home.com old@home.com" {
+		t.Errorf("Expected the index to miss older@home.com actual %q", got)
+	}
+	if _, err := ns.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := admins(); got != "new@home.com old@home.com older@home.com" {
+		t.Errorf("Expected every admin actual %q", got)
+	}
+}
+
 func sessSetup(t *testing.T) (Sess, *http.Request) {
 	opts := &sessions.Options{MaxAge: maxAge, Path: sPath}
 	store := NewSessStore(dbName, sBucket, 10, opts, secret)
@@ -0,0 +1,433 @@
+package warlock
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	u "github.com/nu7hatch/gouuid"
+)
+
+// WebhookBucket is the bucket used by YoungWarlock for pending webhook deliveries, the
+// deliveries which ran out of attempts are moved to <bucket>_dead
+const WebhookBucket = "webhooks"
+
+// Account events delivered to webhooks
+const (
+	EventUserCreated     = "user.created"
+	EventUserLogin       = "user.login"
+	EventPasswordChanged = "password.changed"
+	EventUserDeleted     = "user.deleted"
+)
+
+// Headers of webhook requests. The signature is the hex encoded HMAC-SHA256 of the
+// timestamp, a dot and the body, keyed with the secret of the endpoint.
+const (
+	WebhookEventHeader     = "X-Warlock-Event"
+	WebhookDeliveryHeader  = "X-Warlock-Delivery"
+	WebhookTimestampHeader = "X-Warlock-Timestamp"
+	WebhookSignatureHeader = "X-Warlock-Signature"
+)
+
+var (
+	// ErrDeliveryNotFound is returned for unknown webhook deliveries
+	ErrDeliveryNotFound = errors.New("warlock: webhook delivery not found")
+
+	// ErrBadSignature is returned by VerifyWebhook for requests which were not signed with
+	// the secret or are too old
+	ErrBadSignature = errors.New("warlock: bad webhook signature")
+
+	// errNoEndpoint is the error of deliveries whose url is no longer configured, there
+	// is no secret to sign them with
+	errNoEndpoint = errors.New("warlock: no webhook endpoint with a secret is configured for the url")
+)
+
+// WebhookEndpoint is an url account events are posted to. Events limits the deliveries to
+// the given event types, every event is delivered when it is empty.
+type WebhookEndpoint struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events,omitempty"`
+}
+
+func (e WebhookEndpoint) wants(event string) bool {
+	return len(e.Events) == 0 || hasString(e.Events, event)
+}
+
+// WebhookEvent is the json body of webhook requests
+type WebhookEvent struct {
+	ID   string      `json:"id"`
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	User *PublicUser `json:"user"`
+}
+
+// Delivery is a webhook request waiting in the queue, or given up on in the dead letter
+// list
+type Delivery struct {
+	ID          string
+	URL         string
+	Event       string
+	Body        []byte
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+	CreatedAt   time.Time
+}
+
+// SignWebhook returns the signature of body sent at timestamp, a unix time in seconds
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook checks the signature of a webhook request received with header and body,
+// requests sent longer than maxAge ago are refused to prevent replays
+func VerifyWebhook(secret string, header http.Header, body []byte, maxAge time.Duration) error {
+	ts, err := strconv.ParseInt(header.Get(WebhookTimestampHeader), 10, 64)
+	if err != nil {
+		return ErrBadSignature
+	}
+	if age := time.Since(time.Unix(ts, 0)); age > maxAge || age < -maxAge {
+		return ErrBadSignature
+	}
+	want := SignWebhook(secret, ts, body)
+	if !hmac.Equal([]byte(want), []byte(header.Get(WebhookSignatureHeader))) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// WebhookQueue delivers account events to the configured endpoints. Events are stored in
+// bolt first and posted by Deliver, failed deliveries are retried with exponential backoff
+// until MaxAttempts is reached and are then kept as dead letters.
+type WebhookQueue struct {
+	db        string
+	bucket    string
+	endpoints []WebhookEndpoint
+
+	// Client posts the events, http.DefaultClient with a 10 seconds timeout by default
+	Client *http.Client
+
+	// MaxAttempts is how many times a delivery is tried before it is given up on
+	MaxAttempts int
+
+	// Backoff is the wait after the first failure, it doubles with every further one up
+	// to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// NewWebhookQueue creates a bolt backed queue delivering to endpoints
+func NewWebhookQueue(db, bucket string, endpoints []WebhookEndpoint) *WebhookQueue {
+	return &WebhookQueue{
+		db:          db,
+		bucket:      bucket,
+		endpoints:   endpoints,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		MaxAttempts: 8,
+		Backoff:     time.Second,
+		MaxBackoff:  time.Hour,
+	}
+}
+
+// Enqueue stores a delivery of the event about usr for every endpoint subscribed to it
+func (q *WebhookQueue) Enqueue(event string, usr *User) error {
+	uid, err := u.NewV4()
+	if err != nil {
+		return err
+	}
+	ev := &WebhookEvent{ID: uid.String(), Type: event, Time: time.Now().UTC(), User: usr.Public()}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return q.update(func(b, _ *bolt.Bucket) error {
+		for _, e := range q.endpoints {
+			if !e.wants(event) {
+				continue
+			}
+			did, err := u.NewV4()
+			if err != nil {
+				return err
+			}
+			d := &Delivery{
+				ID:          did.String(),
+				URL:         e.URL,
+				Event:       event,
+				Body:        body,
+				NextAttempt: ev.Time,
+				CreatedAt:   ev.Time,
+			}
+			if err = putDelivery(b, d); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Deliver posts the deliveries which are due and returns how many succeeded
+func (q *WebhookQueue) Deliver() (int, error) {
+	var due []*Delivery
+	now := time.Now()
+	err := q.view(func(b, _ *bolt.Bucket) error {
+		return b.ForEach(func(k, v []byte) error {
+			d := new(Delivery)
+			if err := json.Unmarshal(v, d); err != nil {
+				return err
+			}
+			if !d.NextAttempt.After(now) {
+				due = append(due, d)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		if err == ErrDeliveryNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].CreatedAt.Before(due[j].CreatedAt)
+	})
+	n := 0
+	for _, d := range due {
+		perr := q.post(d)
+		err = q.update(func(b, dead *bolt.Bucket) error {
+			if perr == nil {
+				return b.Delete([]byte(d.ID))
+			}
+			d.Attempts++
+			d.LastError = perr.Error()
+			if d.Attempts >= q.MaxAttempts || perr == errNoEndpoint {
+				if err := b.Delete([]byte(d.ID)); err != nil {
+					return err
+				}
+				return putDelivery(dead, d)
+			}
+			d.NextAttempt = time.Now().Add(q.backoff(d.Attempts))
+			return putDelivery(b, d)
+		})
+		if err != nil {
+			return n, err
+		}
+		if perr == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Run calls Deliver every interval until ctx is done
+func (q *WebhookQueue) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if _, err := q.Deliver(); err != nil {
+			log.Println(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Pending returns the deliveries waiting in the queue, oldest first
+func (q *WebhookQueue) Pending() ([]*Delivery, error) {
+	return q.list(false)
+}
+
+// DeadLetters returns the deliveries which ran out of attempts, oldest first
+func (q *WebhookQueue) DeadLetters() ([]*Delivery, error) {
+	return q.list(true)
+}
+
+// Retry moves a dead letter back into the queue with fresh attempts
+func (q *WebhookQueue) Retry(id string) error {
+	return q.update(func(b, dead *bolt.Bucket) error {
+		data := dead.Get([]byte(id))
+		if data == nil {
+			return ErrDeliveryNotFound
+		}
+		d := new(Delivery)
+		if err := json.Unmarshal(data, d); err != nil {
+			return err
+		}
+		d.Attempts = 0
+		d.NextAttempt = time.Now()
+		if err := dead.Delete([]byte(id)); err != nil {
+			return err
+		}
+		return putDelivery(b, d)
+	})
+}
+
+// post sends the delivery, responses outside of the 2xx range count as failures. It is
+// signed with the secret of the endpoint with the url of the delivery, deliveries left
+// from endpoints which were removed from the configuration fail with errNoEndpoint and
+// are never sent unsigned.
+func (q *WebhookQueue) post(d *Delivery) error {
+	var secret string
+	for _, e := range q.endpoints {
+		if e.URL == d.URL {
+			secret = e.Secret
+			break
+		}
+	}
+	if secret == "" {
+		return errNoEndpoint
+	}
+	req, err := http.NewRequest("POST", d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+	ts := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, d.Event)
+	req.Header.Set(WebhookDeliveryHeader, d.ID)
+	req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(ts, 10))
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(secret, ts, d.Body))
+	res, err := q.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("warlock: webhook %s responded %s", d.URL, res.Status)
+	}
+	return nil
+}
+
+// backoff returns the wait before the next attempt of a delivery which failed attempts
+// times
+func (q *WebhookQueue) backoff(attempts int) time.Duration {
+	wait := q.Backoff
+	for i := 1; i < attempts && wait < q.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > q.MaxBackoff {
+		wait = q.MaxBackoff
+	}
+	return wait
+}
+
+func (q *WebhookQueue) list(dead bool) ([]*Delivery, error) {
+	var list []*Delivery
+	err := q.view(func(b, d *bolt.Bucket) error {
+		if dead {
+			b = d
+		}
+		return b.ForEach(func(k, v []byte) error {
+			d := new(Delivery)
+			if err := json.Unmarshal(v, d); err != nil {
+				return err
+			}
+			list = append(list, d)
+			return nil
+		})
+	})
+	if err == ErrDeliveryNotFound {
+		return nil, nil
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list, err
+}
+
+func (q *WebhookQueue) update(fn func(queue, dead *bolt.Bucket) error) error {
+	db, err := bolt.Open(q.db, 0600, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(q.bucket))
+		if err != nil {
+			return err
+		}
+		dead, err := tx.CreateBucketIfNotExists([]byte(q.bucket + "_dead"))
+		if err != nil {
+			return err
+		}
+		return fn(b, dead)
+	})
+}
+
+// view runs fn in a read-only transaction, the queue is empty until the buckets exist
+func (q *WebhookQueue) view(fn func(queue, dead *bolt.Bucket) error) error {
+	db, err := bolt.Open(q.db, 0600, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		b, dead := tx.Bucket([]byte(q.bucket)), tx.Bucket([]byte(q.bucket+"_dead"))
+		if b == nil || dead == nil {
+			return ErrDeliveryNotFound
+		}
+		return fn(b, dead)
+	})
+}
+
+func putDelivery(b *bolt.Bucket, d *Delivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(d.ID), data)
+}
+
+// checkWebhooks validates the configured endpoints
+func checkWebhooks(endpoints []WebhookEndpoint) (errs []string) {
+	for i, e := range endpoints {
+		if pu, err := url.Parse(e.URL); err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+			errs = append(errs, fmt.Sprintf("webhooks[%d]: url must be an absolute http or https url", i))
+		}
+		if e.Secret == "" {
+			errs = append(errs, fmt.Sprintf("webhooks[%d]: secret is required", i))
+		}
+	}
+	return errs
+}
+
+// emit queues the event about usr for the configured webhooks, failures are logged since
+// the account change already happened
+func (h *Handlers) emit(event string, usr *User) {
+	if h.webhooks == nil {
+		return
+	}
+	if err := h.webhooks.Enqueue(event, usr); err != nil {
+		log.Println(err)
+	}
+}
+
+// Webhooks returns the queue delivering account events to Config.Webhooks, it is nil when
+// no endpoint is configured. Events are only stored by the handlers, applications run the
+// delivery with
+//
+//	go h.Webhooks().Run(ctx, time.Second)
+func (h *Handlers) Webhooks() *WebhookQueue {
+	return h.webhooks
+}
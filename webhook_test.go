@@ -0,0 +1,260 @@
+package warlock
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver is a webhook endpoint recording the events with a valid signature
+type receiver struct {
+	mu     sync.Mutex
+	secret string
+	fail   bool
+	events []WebhookEvent
+	bad    int
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := VerifyWebhook(rc.secret, r.Header, body, time.Minute); err != nil {
+		rc.bad++
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if rc.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var ev WebhookEvent
+	json.Unmarshal(body, &ev)
+	if ev.Type != r.Header.Get(WebhookEventHeader) {
+		rc.bad++
+	}
+	rc.events = append(rc.events, ev)
+}
+
+func (rc *receiver) types() []string {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	var out []string
+	for _, ev := range rc.events {
+		out = append(out, ev.Type+" "+ev.User.Email)
+	}
+	return out
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	body := []byte(`{"type":"user.created"}`)
+	now := time.Now().Unix()
+	h := http.Header{}
+	h.Set(WebhookTimestampHeader, strconv.FormatInt(now, 10))
+	h.Set(WebhookSignatureHeader, SignWebhook("secret", now, body))
+	if err := VerifyWebhook("secret", h, body, time.Minute); err != nil {
+		t.Errorf("Expected nil actual %v", err)
+	}
+	if err := VerifyWebhook("other", h, body, time.Minute); err != ErrBadSignature {
+		t.Errorf("Expected %v actual %v", ErrBadSignature, err)
+	}
+	if err := VerifyWebhook("secret", h, []byte(`{"type":"user.deleted"}`), time.Minute); err != ErrBadSignature {
+		t.Errorf("Expected %v actual %v", ErrBadSignature, err)
+	}
+	old := now - 3600
+	h.Set(WebhookTimestampHeader, strconv.FormatInt(old, 10))
+	h.Set(WebhookSignatureHeader, SignWebhook("secret", old, body))
+	if err := VerifyWebhook("secret", h, body, time.Minute); err != ErrBadSignature {
+		t.Errorf("Expected %v actual %v", ErrBadSignature, err)
+	}
+}
+
+func TestWebhookQueue(t *testing.T) {
+	defer cleanUp("warlock_test.db")
+	billing := &receiver{secret: "billing-secret"}
+	crm := &receiver{secret: "crm-secret", fail: true}
+	bs, cs := httptest.NewServer(billing), httptest.NewServer(crm)
+	defer bs.Close()
+	defer cs.Close()
+
+	q := NewWebhookQueue("warlock_test.db", WebhookBucket, []WebhookEndpoint{
+		{URL: bs.URL, Secret: "billing-secret"},
+		{URL: cs.URL, Secret: "crm-secret", Events: []string{EventUserDeleted}},
+	})
+	q.MaxAttempts = 2
+	q.Backoff = 0
+
+	if n, err := q.Deliver(); err != nil || n != 0 {
+		t.Errorf("Expected 0 nil actual %d %v", n, err)
+	}
+	usr := &User{Email: "me@me.com", Password: "hash"}
+	for _, ev := range []string{EventUserCreated, EventPasswordChanged, EventUserDeleted} {
+		if err := q.Enqueue(ev, usr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pending, _ := q.Pending()
+	if len(pending) != 4 {
+		t.Errorf("Expected 4 actual %d", len(pending))
+	}
+	if strings.Contains(string(pending[0].Body), "hash") {
+		t.Errorf("Expected no password in %s", pending[0].Body)
+	}
+
+	n, err := q.Deliver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("Expected 3 actual %d", n)
+	}
+	expect := "user.created me@me.com,password.changed me@me.com,user.deleted me@me.com"
+	if got := strings.Join(billing.types(), ","); got != expect {
+		t.Errorf("Expected %s actual %s", expect, got)
+	}
+	if billing.bad != 0 || crm.bad != 0 {
+		t.Errorf("Expected valid signatures actual %d %d", billing.bad, crm.bad)
+	}
+
+	// The failing endpoint is retried then given up on
+	pending, _ = q.Pending()
+	if len(pending) != 1 || pending[0].Attempts != 1 || pending[0].LastError == "" {
+		t.Fatalf("Expected one retry actual %+v", pending)
+	}
+	q.Deliver()
+	dead, err := q.DeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].URL != cs.URL || dead[0].Event != EventUserDeleted {
+		t.Fatalf("Expected one dead letter actual %+v", dead)
+	}
+	if pending, _ = q.Pending(); len(pending) != 0 {
+		t.Errorf("Expected an empty queue actual %+v", pending)
+	}
+
+	crm.mu.Lock()
+	crm.fail = false
+	crm.mu.Unlock()
+	if err = q.Retry(dead[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Retry(dead[0].ID); err != ErrDeliveryNotFound {
+		t.Errorf("Expected %v actual %v", ErrDeliveryNotFound, err)
+	}
+	if n, _ = q.Deliver(); n != 1 {
+		t.Errorf("Expected 1 actual %d", n)
+	}
+	if got := crm.types(); len(got) != 1 || got[0] != "user.deleted me@me.com" {
+		t.Errorf("Expected user.deleted actual %v", got)
+	}
+}
+
+func TestWebhookQueue_removedEndpoint(t *testing.T) {
+	defer cleanUp("warlock_test.db")
+	rc := &receiver{secret: "crm-secret"}
+	rs := httptest.NewServer(rc)
+	defer rs.Close()
+
+	q := NewWebhookQueue("warlock_test.db", WebhookBucket, []WebhookEndpoint{{URL: rs.URL, Secret: "crm-secret"}})
+	if err := q.Enqueue(EventUserCreated, &User{Email: "me@me.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the endpoint is dropped from the configuration before the delivery is sent
+	q = NewWebhookQueue("warlock_test.db", WebhookBucket, nil)
+	if n, err := q.Deliver(); err != nil || n != 0 {
+		t.Errorf("Expected 0 nil actual %d %v", n, err)
+	}
+	rc.mu.Lock()
+	sent := len(rc.events) + rc.bad
+	rc.mu.Unlock()
+	if sent != 0 {
+		t.Errorf("Expected nothing to be sent actual %d", sent)
+	}
+	dead, err := q.DeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].LastError != errNoEndpoint.Error() {
+		t.Errorf("Expected one dead letter actual %+v", dead)
+	}
+}
+
+func TestWebhookQueue_backoff(t *testing.T) {
+	q := NewWebhookQueue("", WebhookBucket, nil)
+	sample := []struct {
+		attempts int
+		wait     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{40, time.Hour},
+	}
+	for _, v := range sample {
+		if w := q.backoff(v.attempts); w != v.wait {
+			t.Errorf("Expected %v actual %v", v.wait, w)
+		}
+	}
+}
+
+func TestHandlers_Webhooks(t *testing.T) {
+	rc := &receiver{secret: "crm-secret"}
+	rs := httptest.NewServer(rc)
+	defer rs.Close()
+	ts, client, y := testServerConfig(t, &Config{
+		Webhooks: []WebhookEndpoint{{URL: rs.URL, Secret: "crm-secret"}},
+	})
+	defer ts.Close()
+	defer cleanUp("warlock_test.db")
+
+	res, err := client.PostForm(ts.URL+rPath, url.Values{
+		"FirstName": {"young"}, "LastName": {"warlock"}, "Email": {"me@me.com"},
+		"Password": {"open sesame 42"}, "ConfirmPassword": {"open sesame 42"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if err = GrantRole(y.ustore, "me@me.com", RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if res, err = client.PostForm(ts.URL+oPath, nil); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res, err = client.PostForm(ts.URL+lPath, url.Values{"Email": {"me@me.com"}, "Password": {"open sesame 42"}}); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	// Nothing is sent until the queue is delivered
+	if got := rc.types(); len(got) != 0 {
+		t.Errorf("Expected no events actual %v", got)
+	}
+	res, err = client.Get(ts.URL + dPath + "/webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if !strings.Contains(string(body), "user.created to "+rs.URL) {
+		t.Errorf("Expected the pending delivery actual %s", body)
+	}
+
+	if _, err = y.Webhooks().Deliver(); err != nil {
+		t.Fatal(err)
+	}
+	expect := "user.created me@me.com,user.login me@me.com"
+	if got := strings.Join(rc.types(), ","); got != expect {
+		t.Errorf("Expected %s actual %s", expect, got)
+	}
+}